@@ -5,9 +5,11 @@ go 1.17
 require (
 	github.com/aws/aws-sdk-go v1.40.32
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/net v0.17.0
 )
 
 require (
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	golang.org/x/sys v0.0.0-20210423082822-04245dca01da // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 )
@@ -4,30 +4,46 @@ import (
 	"flag"
 	"net"
 	"strconv"
+	"strings"
 
 	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/encryption"
 	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/hls"
 	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/mediachunk"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tsanalyzer"
 	"github.com/jordicenzano/go-ts-segmenter/uploaders/httpuploader"
 	"github.com/jordicenzano/go-ts-segmenter/uploaders/s3uploader"
+	"github.com/jordicenzano/go-ts-segmenter/uploaders/uploadqueue"
 	"github.com/sirupsen/logrus"
 
 	"bufio"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"time"
 )
 
 const (
 	readBufferSize = 128
+
+	uploadQueueStatsPeriod = 10 * time.Second
 )
 
 var (
 	verbose                 = flag.Bool("verbose", false, "enable to get verbose logging")
 	baseOutPath             = flag.String("dstPath", "./results", "Output path")
 	chunkBaseFilename       = flag.String("chunksBaseFilename", "chunk_", "Chunks base filename")
-	chunkListFilename       = flag.String("chunklistFilename", "chunklist.m3u8", "Chunklist filename")
+	chunkListFilename       = flag.String("chunklistFilename", "chunklist.m3u8", "Chunklist filename (it can be a template, see chunksTemplate)")
+	iFramesChunklist        = flag.String("iFramesChunklistFilename", "", "If set it generates an I-frame (trick play) chunklist with this filename")
+	chunksTemplate          = flag.String("chunksTemplate", "", "Chunks filename template, it overrides chunksBaseFilename. Identifiers: $Number$, $Number%08d$, $Time$ (see timeSource), $Year$, $Month$, $Day$, $Hour$, $Minute$, $Second$ (UTC wall clock), $Rendition$ (ex: $Year$/$Month$/$Day$/chunk_$Number%08d$.ts)")
+	initTemplate            = flag.String("initTemplate", "", "Init chunk filename template (see chunksTemplate), it needs $Number$")
+	renditionName           = flag.String("renditionName", "", "Rendition name used for $Rendition$ in the templates")
+	timeSource              = flag.Int("timeSource", int(mediachunk.TimeSourcePTS), "Value used for $Time$ in the templates (0- PTS of the 1st packet of the chunk in 90KHz ticks, 1- Chunk creation wall clock in ms since epoch)")
 	targetSegmentDurS       = flag.Float64("targetDur", 4.0, "Target chunk duration in seconds")
+	maxSegmentDurS          = flag.Float64("maxSegmentDur", 0, "Max chunk duration in seconds, if there is no IDR before it the chunk is cut anyway (not independent). 0 = wait for the next IDR")
 	liveWindowSize          = flag.Int("liveWindowSize", 3, "Live window size in chunks")
 	lhlsAdvancedChunks      = flag.Int("lhls", 0, "If > 0 activates LHLS, and it indicates the number of advanced chunks to create")
 	manifestTypeInt         = flag.Int("manifestType", int(hls.LiveWindow), "Manifest to generate (0- Vod, 1- Live event, 2- Live sliding window")
@@ -35,14 +51,46 @@ var (
 	videoPID                = flag.Int("vpid", -1, "Video PID to parse")
 	audioPID                = flag.Int("apid", -1, "Audio PID to parse")
 	chunkInitType           = flag.Int("initType", int(manifestgenerator.ChunkInitStart), "Indicates where to put the init data PAT and PMT packets (0- No ini data, 1- Init segment, 2- At the beginning of each chunk")
-	mediaDestinationType    = flag.Int("mediaDestinationType", 1, "Indicates where the destination (0- No output, 1- File + flag indicator, 2- HTTP chunked transfer, 3- HTTP regular, 4- S3 regular)")
+	mediaDestinationType    = flag.Int("mediaDestinationType", 1, "Indicates where the destination (0- No output, 1- File + flag indicator, 2- HTTP chunked transfer, 3- HTTP regular, 4- S3 regular, 5- Single file with byte ranges, no LHLS)")
 	manifestDestinationType = flag.Int("manifestDestinationType", 1, "Indicates where the destination (0- No output, 1- File + flag indicator, 2- HTTP, 3- S3)")
+	failedSegmentPolicy     = flag.Int("failedSegmentPolicy", int(manifestgenerator.FailedSegmentList), "Indicates what to do in the chunklist with the segments that could not be delivered (0- List them anyway, 1- Skip them and add discontinuity, 2- List them with gap tag)")
+	programDateTime         = flag.Bool("programDateTime", false, "Add EXT-X-PROGRAM-DATE-TIME to every chunk in the chunklist")
+	programDateTimeStart    = flag.String("programDateTimeStart", "", "Wall clock time (RFC3339) of the stream start used for the program date time, if empty the time when the 1st chunk is received is used")
+	programNumber           = flag.Int("programNumber", -1, "Program to process from a multi program TS (MPTS), -1 = the 1st program of the PAT")
+	splitPrograms           = flag.Bool("splitPrograms", false, "Process all the programs of a multi program TS (MPTS), each one in the subdirectory program_<number> of dstPath (state file with suffix .<number>)")
+	stateFile               = flag.String("stateFile", "", "File used to persist the chunk numbering and chunklist, if it exists they are resumed from it (with a discontinuity)")
+	encryptionMethod        = flag.Int("encryption", int(encryption.MethodNone), "Chunks encryption (0- None, 1- AES-128 whole chunk, 2- SAMPLE-AES H.264 and AAC samples), not compatible with single file output and I-frame chunklist")
+	keyFile                 = flag.String("keyFile", "", "File with the encryption key (16 bytes or 32 hex chars), if empty random keys are generated and published next to the chunks")
+	keyURI                  = flag.String("keyURI", "", "Key URI for the chunklist, if keyFile is empty it is the prefix of the generated key filenames")
+	keyIV                   = flag.String("keyIV", "", "Encryption IV (32 hex chars), if empty the chunk number is used")
+	keyBaseFilename         = flag.String("keyBaseFilename", "key_", "Generated keys base filename")
+	keyRotation             = flag.Int("keyRotation", 0, "Number of chunks encrypted with the same generated key (0 = never rotate)")
+	fileSync                = flag.Bool("fsync", false, "Flush chunks and chunklists to disk (fsync) before making them visible, for file output")
 	httpScheme              = flag.String("protocol", "http", "HTTP Scheme (http, https)")
 	httpHost                = flag.String("host", "localhost:9094", "HTTP Host")
 	logPath                 = flag.String("logsPath", "", "Logs file path")
-	httpMaxRetries          = flag.Int("httpMaxRetries", 40, "Max retries for HTTP service unavailable")
-	initialHTTPRetryDelay   = flag.Int("initialHTTPRetryDelay", 5, "Initial retry delay in MS for chunk HTTP (no chunk transfer) uploads. Value = intent * initialHttpRetryDelay")
+	httpMaxRetries          = flag.Int("httpMaxRetries", 40, "Max retries for HTTP retryable errors (service unavailable, gateway errors, network errors, timeouts)")
+	initialHTTPRetryDelay   = flag.Int("initialHTTPRetryDelay", 5, "Initial retry delay in MS for HTTP uploads, it doubles in every retry (with jitter)")
+	httpMaxRetryDelay       = flag.Int("httpMaxRetryDelay", 5000, "Max retry delay in MS for HTTP uploads")
+	httpRetryMaxElapsed     = flag.Int("httpRetryMaxElapsed", 0, "Max time in MS since the 1st attempt to keep retrying an HTTP upload (0 = no limit)")
+	httpUploadTimeout       = flag.Int("httpUploadTimeout", 0, "Timeout in MS for every HTTP (no chunk transfer) upload attempt (0 = no timeout)")
+	httpChunkedMaxBuffer    = flag.Int("httpChunkedMaxBuffer", httpuploader.DefaultMaxChunkedTransferBufferBytes, "Max bytes kept in memory per HTTP chunked transfer upload to be able to retry it (0 = no limit)")
+	httpMethod              = flag.String("httpMethod", httpuploader.DefaultHTTPMethod, "HTTP method used for uploads (POST, PUT)")
+	httpBasePath            = flag.String("httpBasePath", "", "Path prefix added to all HTTP uploads")
+	httpAuthUser            = flag.String("httpAuthUser", "", "User for HTTP basic authentication")
+	httpAuthPassword        = flag.String("httpAuthPassword", "", "Password for HTTP basic authentication (if empty it is read from the env var "+envHTTPAuthPassword+")")
+	httpAuthToken           = flag.String("httpAuthToken", "", "Token for HTTP bearer authentication, if set basic auth is not used (if empty it is read from the env var "+envHTTPAuthToken+")")
+	httpH2C                 = flag.Bool("httpH2C", false, "Use HTTP/2 cleartext (prior knowledge) for HTTP out, all uploads share the same connection")
+	httpDisableHTTP2        = flag.Bool("httpDisableHTTP2", false, "Disable HTTP/2 negotiation for HTTPS out")
+	httpMaxIdleConnsPerHost = flag.Int("httpMaxIdleConnsPerHost", httpuploader.DefaultTransportOptions().MaxIdleConnsPerHost, "Max idle (keep-alive) connections kept per host for HTTP out")
+	httpMaxConnsPerHost     = flag.Int("httpMaxConnsPerHost", 0, "Max connections per host for HTTP out (0 = no limit)")
+	httpDialTimeout         = flag.Int("httpDialTimeout", httpuploader.DefaultTransportOptions().DialTimeoutMs, "Timeout in MS to establish HTTP out connections")
+	httpKeepAlive           = flag.Int("httpKeepAlive", httpuploader.DefaultTransportOptions().KeepAliveMs, "Keep-alive probes interval in MS for HTTP out connections")
+	httpResponseTimeout     = flag.Int("httpResponseHeaderTimeout", 0, "Timeout in MS to receive the response headers after sending the HTTP body (0 = no limit)")
 	httpsInsecure           = flag.Bool("insecure", false, "Skips CA verification for HTTPS out")
+	httpsCAFile             = flag.String("httpsCA", "", "PEM file with the CAs used to verify the HTTPS server (added to the system ones)")
+	httpsCertFile           = flag.String("httpsCert", "", "PEM file with the client certificate for HTTPS mTLS")
+	httpsKeyFile            = flag.String("httpsKey", "", "PEM file with the client key for HTTPS mTLS")
 	inputType               = flag.Int("inputType", 1, "Where gets the input data (1-stdin, 2-TCP socket)")
 	localPort               = flag.Int("localPort", 2002, "Local port to listen in case inputType = 2")
 	awsID                   = flag.String("awsId", "", "AWSId in case you do not want to use default machine credentials")
@@ -51,16 +99,71 @@ var (
 	s3Bucket                = flag.String("s3Bucket", "", "S3 bucket to upload files, in case of sing an S3 destination")
 	s3UploadTimeOut         = flag.Int("s3UploadTimeout", 10000, "Timeout for any S3 upload in MS")
 	s3IsPublicRead          = flag.Bool("s3IsPublicRead", false, "Set ACL = \"public-read\" for all S3 uploads")
+	uploadWorkers           = flag.Int("uploadWorkers", 0, "Number of workers to upload chunks (HTTP regular, S3) and chunklists asynchronously (0 = synchronous uploads)")
+	uploadQueueSize         = flag.Int("uploadQueueSize", 100, "Max number of uploads waiting in the asynchronous upload queue")
+	uploadQueueOverflow     = flag.Int("uploadQueueOverflow", int(uploadqueue.OverflowBlock), "What to do when the asynchronous upload queue is full (0- Block the input, 1- Drop the newest upload, 2- Drop the oldest upload)")
+	analyze                 = flag.Bool("analyze", false, "Only analyze the input TS errors (TR 101 290 priority 1 and 2) and write the JSON report to analysisReport (stdout if empty, the logs go to stderr), no chunks are created")
+	analysisReport          = flag.String("analysisReport", "", "If set the input TS errors (TR 101 290 priority 1 and 2) are analyzed while segmenting and the JSON report is written to this file at the end (with suffix .<number> in splitPrograms mode)")
+	keepM2TSTimestamps      = flag.Bool("keepM2TSTimestamps", false, "For M2TS input (192 bytes packets) keep the 4 bytes header with the arrival timestamp in the chunks, by default it is removed (as the Reed-Solomon bytes of 204 bytes packets), not compatible with SAMPLE-AES")
+	httpHeaders             = headerFlags{}
 )
 
+// Env vars for the secrets, to avoid exposing them in the process list
+const (
+	envHTTPAuthPassword = "TSSEGMENTER_HTTP_AUTH_PASSWORD"
+	envHTTPAuthToken    = "TSSEGMENTER_HTTP_AUTH_TOKEN"
+)
+
+// headerFlags Repeatable flag with "Name: Value" headers
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("invalid header %q, expected \"Name: Value\"", value)
+	}
+	h[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+
+	return nil
+}
+
+func init() {
+	flag.Var(httpHeaders, "httpHeader", "Static header added to all HTTP uploads as \"Name: Value\" (can be repeated)")
+}
+
 func main() {
 	flag.Parse()
 
-	var log = configureLogger(*verbose, *logPath)
+	setFromEnvIfEmpty(httpAuthPassword, envHTTPAuthPassword)
+	setFromEnvIfEmpty(httpAuthToken, envHTTPAuthToken)
+
+	logOutput := io.Writer(os.Stdout)
+	if *analyze {
+		// Stdout is used for the report
+		logOutput = os.Stderr
+	}
+	var log = configureLogger(*verbose, *logPath, logOutput)
 
 	log.Info(manifestgenerator.Version, logPath)
 	log.Info("Started tssegmenter", logPath)
 
+	if *analyze {
+		report, err := tsanalyzer.Analyze(createInputReader(log))
+		if err != nil {
+			log.Error("Error reading the input, the report is partial. Err: ", err)
+		}
+		saveAnalysisReport(log, *analysisReport, report)
+
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if *autoPID == false && manifestgenerator.ChunkInitTypes(*chunkInitType) != manifestgenerator.ChunkNoIni {
 		log.Error("Manual PID mode and Chunk No ini data are not compatible")
 		os.Exit(1)
@@ -70,14 +173,44 @@ func main() {
 	hlsOutputType := hls.OutputTypes(*manifestDestinationType)
 
 	// Creating output dir if does not exists
-	if chunkOutputType == mediachunk.ChunkOutputModeFile || hlsOutputType == hls.HlsOutputModeFile {
+	if chunkOutputType == mediachunk.ChunkOutputModeFileSingle && *lhlsAdvancedChunks > 0 {
+		log.Error("Single file output and LHLS are not compatible")
+		os.Exit(1)
+	}
+
+	if chunkOutputType == mediachunk.ChunkOutputModeFile || chunkOutputType == mediachunk.ChunkOutputModeFileSingle || hlsOutputType == hls.HlsOutputModeFile {
 		os.MkdirAll(*baseOutPath, 0744)
 	}
 
 	var httpUploader *httpuploader.HTTPUploader = nil
 	var s3Uploader *s3uploader.S3Uploader = nil
 	if isHTTPOut() {
-		httpUploaderTmp := httpuploader.New(log, *httpsInsecure, *httpScheme, *httpHost, *httpMaxRetries, *initialHTTPRetryDelay)
+		tlsOptions := httpuploader.TLSOptions{Insecure: *httpsInsecure, CAFile: *httpsCAFile, ClientCertFile: *httpsCertFile, ClientKeyFile: *httpsKeyFile}
+		transportOptions := httpuploader.DefaultTransportOptions()
+		transportOptions.H2C = *httpH2C
+		transportOptions.DisableHTTP2 = *httpDisableHTTP2
+		transportOptions.MaxIdleConnsPerHost = *httpMaxIdleConnsPerHost
+		transportOptions.MaxConnsPerHost = *httpMaxConnsPerHost
+		transportOptions.DialTimeoutMs = *httpDialTimeout
+		transportOptions.KeepAliveMs = *httpKeepAlive
+		transportOptions.ResponseHeaderTimeoutMs = *httpResponseTimeout
+		httpUploaderTmp, err := httpuploader.NewWithOptions(log, tlsOptions, transportOptions, *httpScheme, *httpHost, *httpMaxRetries, *initialHTTPRetryDelay)
+		if err != nil {
+			log.Error("Error configuring HTTP out. Err: ", err)
+			os.Exit(1)
+		}
+		httpUploaderTmp.MaxChunkedTransferBufferBytes = *httpChunkedMaxBuffer
+		httpUploaderTmp.RetryPolicy.MaxDelayMs = *httpMaxRetryDelay
+		httpUploaderTmp.RetryPolicy.MaxElapsedTimeMs = *httpRetryMaxElapsed
+		httpUploaderTmp.RetryPolicy.AttemptTimeoutMs = *httpUploadTimeout
+		httpUploaderTmp.HTTPMethod = strings.ToUpper(*httpMethod)
+		httpUploaderTmp.HTTPBasePath = *httpBasePath
+		httpUploaderTmp.ExtraHeaders = httpHeaders
+		if *httpAuthToken != "" {
+			httpUploaderTmp.Auth = httpuploader.AuthConfig{Type: httpuploader.AuthBearer, Token: *httpAuthToken}
+		} else if *httpAuthUser != "" {
+			httpUploaderTmp.Auth = httpuploader.AuthConfig{Type: httpuploader.AuthBasic, User: *httpAuthUser, Password: *httpAuthPassword}
+		}
 		httpUploader = &httpUploaderTmp
 	} else if isS3Out() {
 		awsCreds := s3uploader.AWSLocalCreds{}
@@ -90,41 +223,52 @@ func main() {
 		s3Uploader = &s3UploaderTmp
 	}
 
-	mg := manifestgenerator.New(log,
-		chunkOutputType,
-		hlsOutputType,
-		*baseOutPath,
-		*chunkBaseFilename,
-		*chunkListFilename,
-		*targetSegmentDurS,
-		manifestgenerator.ChunkInitTypes(*chunkInitType),
-		*autoPID,
-		-1,
-		-1,
-		hls.ManifestTypes(*manifestTypeInt),
-		*liveWindowSize,
-		*lhlsAdvancedChunks,
-		httpUploader,
-		s3Uploader)
+	var uploadQueue *uploadqueue.Queue = nil
+	if *uploadWorkers > 0 && (httpUploader != nil || s3Uploader != nil) {
+		uploadQueue = uploadqueue.New(log, *uploadWorkers, *uploadQueueSize, uploadqueue.OverflowPolicies(*uploadQueueOverflow))
 
-	// Create the requested input reader
-	var r *bufio.Reader = nil
-	if *inputType == 2 {
-		// Reader from TCP server socket
+		go logUploadQueueStats(log, uploadQueue)
+	}
 
-		log.Info("Listening on port " + strconv.Itoa(*localPort))
-		// listen on all interfaces
-		ln, _ := net.Listen("tcp", ":"+strconv.Itoa(*localPort))
-		// accept connection on port
-		conn, _ := ln.Accept()
-		log.Info("Connection TCP accepted")
+	pdtReference := time.Time{}
+	if *programDateTimeStart != "" {
+		var err error
+		pdtReference, err = time.Parse(time.RFC3339Nano, *programDateTimeStart)
+		if err != nil {
+			log.Error("Error parsing program date time start ", *programDateTimeStart, ". Err: ", err)
+			os.Exit(1)
+		}
+	}
 
-		r = bufio.NewReader(conn)
+	if *maxSegmentDurS > 0 && *maxSegmentDurS < *targetSegmentDurS {
+		log.Error("The max segment duration ", *maxSegmentDurS, " can not be smaller than the target duration ", *targetSegmentDurS)
+		os.Exit(1)
+	}
+
+	var mg *manifestgenerator.ManifestGenerator = nil
+	var mp *manifestgenerator.MultiProgram = nil
+	if *splitPrograms {
+		// Every program in its own directory, with its own state file
+		mpTmp := manifestgenerator.NewMultiProgram(log, func(programNumber int) (*manifestgenerator.ManifestGenerator, error) {
+			programStateFile := ""
+			if *stateFile != "" {
+				programStateFile = *stateFile + "." + strconv.Itoa(programNumber)
+			}
+			return createManifestGenerator(log, path.Join(*baseOutPath, "program_"+strconv.Itoa(programNumber)), programStateFile, pdtReference, httpUploader, s3Uploader, uploadQueue)
+		})
+		mp = &mpTmp
 	} else {
-		// Reader from std in
-		r = bufio.NewReader(os.Stdin)
+		var err error
+		mg, err = createManifestGenerator(log, *baseOutPath, *stateFile, pdtReference, httpUploader, s3Uploader, uploadQueue)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		mg.SetProgramNumber(*programNumber)
 	}
 
+	r := createInputReader(log)
+
 	// Buffer
 	buf := make([]byte, 0, readBufferSize)
 
@@ -134,7 +278,30 @@ func main() {
 			// Detected EOF
 			// Closing
 			log.Info("Closing process detected EOF")
-			mg.Close()
+			if mp != nil {
+				errClose := mp.Close()
+				if errClose != nil {
+					log.Error("Error delivering last data. Err: ", errClose)
+				}
+				for _, programNumber := range mp.GetProgramNumbers() {
+					logStats(log, programNumber, mp.GetManifestGenerator(programNumber))
+					if *analysisReport != "" {
+						saveAnalysisReport(log, *analysisReport+"."+strconv.Itoa(programNumber), mp.GetManifestGenerator(programNumber).GetAnalysisReport())
+					}
+				}
+			} else {
+				errClose := mg.Close()
+				if errClose != nil {
+					log.Error("Error delivering last data. Err: ", errClose)
+				}
+				logStats(log, *programNumber, mg)
+				if *analysisReport != "" {
+					saveAnalysisReport(log, *analysisReport, mg.GetAnalysisReport())
+				}
+			}
+			if uploadQueue != nil {
+				uploadQueue.Close()
+			}
 
 			break
 		}
@@ -147,7 +314,15 @@ func main() {
 
 		// process buf
 		log.Debug("Sent to process: ", n, " bytes")
-		mg.AddData(buf[:n])
+		var errAdd error
+		if mp != nil {
+			errAdd = mp.AddData(buf[:n])
+		} else {
+			errAdd = mg.AddData(buf[:n])
+		}
+		if errAdd != nil {
+			log.Error("Error delivering data. Err: ", errAdd)
+		}
 	}
 
 	log.Info("Exit because detected EOF in the input reader")
@@ -155,6 +330,208 @@ func main() {
 	os.Exit(0)
 }
 
+// createInputReader Creates the requested input reader
+func createInputReader(log *logrus.Logger) *bufio.Reader {
+	var r *bufio.Reader = nil
+	if *inputType == 2 {
+		// Reader from TCP server socket
+
+		log.Info("Listening on port " + strconv.Itoa(*localPort))
+		// listen on all interfaces
+		ln, _ := net.Listen("tcp", ":"+strconv.Itoa(*localPort))
+		// accept connection on port
+		conn, _ := ln.Accept()
+		log.Info("Connection TCP accepted")
+
+		r = bufio.NewReader(conn)
+	} else {
+		// Reader from std in
+		r = bufio.NewReader(os.Stdin)
+	}
+
+	return r
+}
+
+// saveAnalysisReport Writes the JSON TS analysis report to the file (stdout if empty)
+func saveAnalysisReport(log *logrus.Logger, fileName string, report tsanalyzer.Report) {
+	data, err := report.JSON()
+	if err == nil {
+		if fileName == "" {
+			_, err = os.Stdout.Write(append(data, '\n'))
+		} else {
+			err = ioutil.WriteFile(fileName, data, 0644)
+		}
+	}
+	if err != nil {
+		log.Error("Error saving the TS analysis report. Err: ", err)
+		return
+	}
+
+	if fileName == "" {
+		fileName = "stdout"
+	}
+	log.WithFields(logrus.Fields{
+		"syncLoss":        report.Priority1.TSSyncLoss,
+		"patErrors":       report.Priority1.PATErrors,
+		"ccErrors":        report.Priority1.CCErrors,
+		"pmtErrors":       report.Priority1.PMTErrors,
+		"transportErrors": report.Priority2.TransportErrors,
+		"crcErrors":       report.Priority2.CRCErrors,
+	}).Info("TS analysis report saved to ", fileName)
+}
+
+func logUploadQueueStats(log *logrus.Logger, uploadQueue *uploadqueue.Queue) {
+	for range time.Tick(uploadQueueStatsPeriod) {
+		stats := uploadQueue.GetStats()
+		log.WithFields(logrus.Fields{
+			"queued":     stats.Queued,
+			"inProgress": stats.InProgress,
+			"maxQueued":  stats.MaxQueued,
+			"completed":  stats.Completed,
+			"failed":     stats.Failed,
+			"dropped":    stats.Dropped,
+		}).Info("Upload queue stats")
+	}
+}
+
+// createManifestGenerator Creates and configures a manifest generator that writes / uploads to outPath
+func createManifestGenerator(log *logrus.Logger, outPath string, stateFileName string, pdtReference time.Time, httpUploader *httpuploader.HTTPUploader, s3Uploader *s3uploader.S3Uploader, uploadQueue *uploadqueue.Queue) (*manifestgenerator.ManifestGenerator, error) {
+	chunkOutputType := mediachunk.OutputTypes(*mediaDestinationType)
+	hlsOutputType := hls.OutputTypes(*manifestDestinationType)
+
+	if chunkOutputType == mediachunk.ChunkOutputModeFile || chunkOutputType == mediachunk.ChunkOutputModeFileSingle || hlsOutputType == hls.HlsOutputModeFile {
+		os.MkdirAll(outPath, 0744)
+	}
+
+	mg := manifestgenerator.New(log,
+		chunkOutputType,
+		hlsOutputType,
+		outPath,
+		*chunkBaseFilename,
+		*chunkListFilename,
+		*targetSegmentDurS,
+		manifestgenerator.ChunkInitTypes(*chunkInitType),
+		*autoPID,
+		-1,
+		-1,
+		hls.ManifestTypes(*manifestTypeInt),
+		*liveWindowSize,
+		*lhlsAdvancedChunks,
+		httpUploader,
+		s3Uploader)
+
+	if uploadQueue != nil {
+		mg.SetUploadQueue(uploadQueue)
+	}
+
+	err := mg.SetNamingOptions(manifestgenerator.NamingOptions{
+		ChunkTemplate:     *chunksTemplate,
+		InitTemplate:      *initTemplate,
+		ChunklistTemplate: *chunkListFilename,
+		RenditionName:     *renditionName,
+		TimeSource:        mediachunk.TimeSources(*timeSource),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error in the filename templates. Err: %v", err)
+	}
+
+	err = mg.SetStateFile(stateFileName)
+	if err != nil {
+		return nil, fmt.Errorf("Error restoring state from %s. Err: %v", stateFileName, err)
+	}
+
+	mg.SetProgramDateTime(*programDateTime, pdtReference)
+	mg.SetMaxSegmentDuration(*maxSegmentDurS)
+	err = mg.SetIFramePlaylist(*iFramesChunklist)
+	if err != nil {
+		return nil, fmt.Errorf("Error setting the I-frame playlist. Err: %v", err)
+	}
+	mg.SetAnalysis(*analysisReport != "")
+
+	if encryption.Methods(*encryptionMethod) != encryption.MethodNone {
+		keyProvider, err := createKeyProvider()
+		if err != nil {
+			return nil, fmt.Errorf("Error creating the key provider. Err: %v", err)
+		}
+
+		err = mg.SetEncryption(manifestgenerator.EncryptionOptions{
+			Method:            encryption.Methods(*encryptionMethod),
+			KeyProvider:       keyProvider,
+			KeyRotationPeriod: uint64(*keyRotation),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error setting the encryption. Err: %v", err)
+		}
+	}
+
+	mg.SetKeepM2TSTimestamps(*keepM2TSTimestamps)
+	mg.SetFileSync(*fileSync)
+	mg.SetFailedSegmentPolicy(manifestgenerator.FailedSegmentPolicies(*failedSegmentPolicy))
+	mg.SetSegmentDeliveryCallback(func(result manifestgenerator.SegmentDeliveryResult) {
+		if result.Err != nil {
+			log.Error("Segment ", result.FileName, " NOT delivered. Err: ", result.Err)
+		} else {
+			log.Debug("Segment ", result.FileName, " delivered")
+		}
+	})
+
+	return &mg, nil
+}
+
+func logStats(log *logrus.Logger, programNumber int, mg *manifestgenerator.ManifestGenerator) {
+	gopStats := mg.GetGOPStats()
+	log.WithFields(logrus.Fields{
+		"program":         programNumber,
+		"maxGOPDurationS": gopStats.MaxGOPDurationS,
+		"forcedCuts":      gopStats.ForcedCuts,
+	}).Info("GOP stats")
+
+	for pID, continuityStats := range mg.GetContinuityStats() {
+		if continuityStats.Gaps == 0 && continuityStats.Duplicates == 0 {
+			continue
+		}
+		log.WithFields(logrus.Fields{
+			"program":     programNumber,
+			"pid":         pID,
+			"packets":     continuityStats.Packets,
+			"gaps":        continuityStats.Gaps,
+			"lostPackets": continuityStats.LostPackets,
+			"duplicates":  continuityStats.Duplicates,
+		}).Warn("Input continuity errors")
+	}
+
+	if syncLosses := mg.GetSyncLosses(); syncLosses > 0 {
+		log.WithFields(logrus.Fields{
+			"program":    programNumber,
+			"syncLosses": syncLosses,
+		}).Warn("Input TS sync losses")
+	}
+}
+
+func createKeyProvider() (encryption.KeyProvider, error) {
+	if *keyFile == "" {
+		return encryption.NewRandomKeyProvider(*keyBaseFilename, *keyURI), nil
+	}
+
+	var iv []byte = nil
+	if *keyIV != "" {
+		var err error
+		iv, err = hex.DecodeString(strings.TrimPrefix(strings.ToLower(*keyIV), "0x"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return encryption.NewFileKeyProvider(*keyFile, *keyURI, iv)
+}
+
+// setFromEnvIfEmpty Sets the flag value from the env var if it was not set
+func setFromEnvIfEmpty(value *string, envName string) {
+	if *value == "" {
+		*value = os.Getenv(envName)
+	}
+}
+
 func isHTTPOut() bool {
 	if (*mediaDestinationType == 2) || (*mediaDestinationType == 3) || (*manifestDestinationType == 2) {
 		return true
@@ -169,7 +546,7 @@ func isS3Out() bool {
 	return false
 }
 
-func configureLogger(verbose bool, logPath string) *logrus.Logger {
+func configureLogger(verbose bool, logPath string, out io.Writer) *logrus.Logger {
 	var log = logrus.New()
 	if verbose {
 		log.SetLevel(logrus.DebugLevel)
@@ -189,9 +566,9 @@ func configureLogger(verbose bool, logPath string) *logrus.Logger {
 			os.Exit(-1)
 		}
 
-		mw = io.MultiWriter(os.Stdout, f)
+		mw = io.MultiWriter(out, f)
 	} else {
-		mw = io.MultiWriter(os.Stdout)
+		mw = io.MultiWriter(out)
 	}
 
 	log.SetOutput(mw)
@@ -0,0 +1,23 @@
+package manifestgenerator
+
+import (
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tsanalyzer"
+)
+
+// SetAnalysis Enables the error analysis of the input TS (TR 101 290 priority 1 and 2), see GetAnalysisReport
+func (mg *ManifestGenerator) SetAnalysis(enabled bool) {
+	mg.analyzer = nil
+	if enabled {
+		analyzer := tsanalyzer.New()
+		mg.analyzer = &analyzer
+	}
+}
+
+// GetAnalysisReport Returns the error analysis of the input TS so far (empty if the analysis is not enabled)
+func (mg *ManifestGenerator) GetAnalysisReport() tsanalyzer.Report {
+	if mg.analyzer == nil {
+		return tsanalyzer.Report{}
+	}
+
+	return mg.analyzer.GetReport()
+}
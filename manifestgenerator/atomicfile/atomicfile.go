@@ -0,0 +1,57 @@
+package atomicfile
+
+import (
+	"os"
+	"path"
+)
+
+// TmpFilename Returns the hidden temp filename used to write the file (same dir, to be able to rename it atomically)
+func TmpFilename(fileName string) string {
+	return path.Join(path.Dir(fileName), "."+path.Base(fileName)+".tmp")
+}
+
+// WriteFile Writes the data to a temp file and renames it, so readers never get a partial file
+// If fileSync is true the file and its dir are flushed to disk (fsync) before returning
+func WriteFile(fileName string, data []byte, fileSync bool) error {
+	tmpFileName := TmpFilename(fileName)
+
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && fileSync {
+		err = f.Sync()
+	}
+	errClose := f.Close()
+	if err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	return Rename(tmpFileName, fileName, fileSync)
+}
+
+// Rename Renames a completely written file, if fileSync is true the dir is flushed to disk to persist the rename
+func Rename(oldFileName string, newFileName string, fileSync bool) error {
+	err := os.Rename(oldFileName, newFileName)
+	if err == nil && fileSync {
+		err = SyncDir(path.Dir(newFileName))
+	}
+
+	return err
+}
+
+// SyncDir Flushes the dir entries to disk (fsync)
+func SyncDir(dirPath string) error {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,38 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomicfile")
+	if err != nil {
+		t.Fatal("Error creating temp dir. Err: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := path.Join(dir, "state.json")
+	for _, data := range []string{"first", "second"} {
+		if err := WriteFile(fileName, []byte(data), true); err != nil {
+			t.Fatal("Error writing file. Err: ", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil || string(data) != "second" {
+		t.Errorf("Wrong file data, got: %s (err: %v), want: %s", string(data), err, "second")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Temp files left in the dir, got %d files, expected %d", len(files), 1)
+	}
+
+	// The destination can not be written, the temp file is removed
+	if err := WriteFile(path.Join(dir, "missing", "state.json"), []byte("data"), false); err == nil {
+		t.Error("Expected error writing in a missing dir")
+	}
+}
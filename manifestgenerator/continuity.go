@@ -0,0 +1,97 @@
+package manifestgenerator
+
+import (
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/mediachunk"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tspacket"
+)
+
+// ContinuityStats Input continuity counter (CC) errors of a PID
+type ContinuityStats struct {
+	// Packets Number of packets received
+	Packets uint64
+
+	// Gaps Number of CC jumps (packet loss)
+	Gaps uint64
+
+	// LostPackets Packets lost in the gaps (estimated, the CC wraps every 16 packets)
+	LostPackets uint64
+
+	// Duplicates Number of duplicated packets received (same CC), they are not added to the chunks
+	Duplicates uint64
+}
+
+// pidContinuity CC tracking of a PID
+type pidContinuity struct {
+	lastCC int
+	stats  ContinuityStats
+}
+
+// GetContinuityStats Returns the input CC errors by PID
+func (mg *ManifestGenerator) GetContinuityStats() map[int]ContinuityStats {
+	ret := make(map[int]ContinuityStats, len(mg.continuity))
+	for pID, c := range mg.continuity {
+		ret[pID] = c.stats
+	}
+
+	return ret
+}
+
+// checkContinuity Called for every packet received, detects the CC gaps and duplicates
+// Returns true if the packet is a duplicate (it must not be added to the chunks)
+func (mg *ManifestGenerator) checkContinuity() bool {
+	pID := mg.tsPacket.GetPID()
+	if pID < 0 || pID == int(tspacket.NullPID) {
+		return false
+	}
+
+	c := mg.continuity[pID]
+	if c == nil {
+		c = &pidContinuity{-1, ContinuityStats{}}
+		mg.continuity[pID] = c
+	}
+	c.stats.Packets++
+
+	if !mg.tsPacket.HasPayload() {
+		// CC does not increment
+		return false
+	}
+
+	cc := mg.tsPacket.GetContinuityCounter()
+	if c.lastCC >= 0 && !mg.tsPacket.IsDiscontinuity() {
+		expectedCC := (c.lastCC + 1) & 0x0F
+		if cc == c.lastCC {
+			mg.options.log.Debug("Duplicated packet in PID ", pID, ", CC: ", cc)
+			c.stats.Duplicates++
+			return true
+		} else if cc != expectedCC {
+			lost := uint64((cc - expectedCC) & 0x0F)
+			mg.options.log.Warn("CC error in PID ", pID, ": ", cc, ", expected: ", expectedCC, ". Lost packets: ", lost)
+			c.stats.Gaps++
+			c.stats.LostPackets += lost
+		}
+	}
+
+	c.lastCC = cc
+
+	return false
+}
+
+// addInitPSIToChunk Adds the PAT / PMT packets at the start of the chunk (ChunkInitStart) with the CC of the previous chunk + 1
+// So the PSI PIDs are continuous when the chunks are played one after the other
+func (mg *ManifestGenerator) addInitPSIToChunk(chunk *mediachunk.Chunk, packets []byte) error {
+	buf := append([]byte(nil), packets...)
+	for pos := 0; pos+tspacket.TsDefaultPacketSize <= len(buf); pos += tspacket.TsDefaultPacketSize {
+		packet := buf[pos : pos+tspacket.TsDefaultPacketSize]
+		if packet[3]&0x10 == 0 {
+			// No payload, CC does not increment
+			continue
+		}
+
+		pID := int(packet[1]&0x1F)<<8 | int(packet[2])
+		cc := mg.psiOutputCC[pID]
+		packet[3] = (packet[3] & 0xF0) | cc
+		mg.psiOutputCC[pID] = (cc + 1) & 0x0F
+	}
+
+	return mg.addPacketsToChunk(chunk, buf)
+}
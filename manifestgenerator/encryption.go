@@ -0,0 +1,118 @@
+package manifestgenerator
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/atomicfile"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/encryption"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/hls"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/mediachunk"
+)
+
+// EncryptionOptions Chunks encryption options
+type EncryptionOptions struct {
+	Method      encryption.Methods
+	KeyProvider encryption.KeyProvider
+
+	// KeyRotationPeriod Number of consecutive chunks encrypted with the same key (0 = never rotate)
+	KeyRotationPeriod uint64
+}
+
+// SetEncryption Encrypts the chunks (the init chunk is not encrypted), the keys with filename are published like the chunks
+// Not compatible with single file output nor I-frame playlists (the byte ranges change when encrypting)
+func (mg *ManifestGenerator) SetEncryption(encryptionOptions EncryptionOptions) error {
+	if encryptionOptions.Method != encryption.MethodNone {
+		if encryptionOptions.KeyProvider == nil {
+			return errors.New("encryption needs a key provider")
+		}
+		if mg.options.chunkOutputType == mediachunk.ChunkOutputModeFileSingle || mg.hlsIFrames != nil {
+			return errors.New("encryption is not compatible with single file output and I-frame playlists")
+		}
+
+		// Needed for EXT-X-KEY IV and SAMPLE-AES
+		mg.hlsChunklist.SetHlsVersion(5)
+
+		if encryptionOptions.Method == encryption.MethodSampleAES && mg.options.keepM2TSTimestamps {
+			mg.options.log.Warn("M2TS timestamps can not be kept with SAMPLE-AES encryption, ignored")
+			mg.options.keepM2TSTimestamps = false
+		}
+	}
+
+	mg.options.encryption = encryptionOptions
+
+	return nil
+}
+
+// isEncryptionReady SAMPLE-AES needs the stream info (PIDs, AAC config) to rewrite the PMT, nothing is saved until it is known
+func (mg *ManifestGenerator) isEncryptionReady() bool {
+	if mg.options.encryption.Method != encryption.MethodSampleAES {
+		return true
+	}
+	if mg.options.videoPID < 0 && mg.options.audioPID < 0 {
+		return false
+	}
+
+	return mg.options.audioPID < 0 || mg.audioConfig != nil
+}
+
+// createEncryptor Returns the encryptor of a chunk (nil if no encryption)
+// The init chunk is only processed in SAMPLE-AES mode (PMT changes)
+// It returns an error if the key can not be obtained (the chunk can not be saved unencrypted)
+func (mg *ManifestGenerator) createEncryptor(chunkIndex uint64, isInit bool) (encryption.Encryptor, error) {
+	method := mg.options.encryption.Method
+	if method == encryption.MethodNone || (isInit && method != encryption.MethodSampleAES) {
+		return nil, nil
+	}
+
+	keyIndex := uint64(0)
+	if mg.options.encryption.KeyRotationPeriod > 0 && !isInit {
+		keyIndex = chunkIndex / mg.options.encryption.KeyRotationPeriod
+	}
+
+	key, err := mg.options.encryption.KeyProvider.GetKey(keyIndex)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting the encryption key %d. Err: %v", keyIndex, err)
+	}
+
+	iv := key.GetChunkIV(chunkIndex)
+	encryptor, err := encryption.New(method, key.Key, iv, encryption.SampleAESOptions{PMTPID: mg.detectedPMTID, VideoPID: mg.options.videoPID, AudioPID: mg.options.audioPID, AudioConfig: mg.audioConfig})
+	if err != nil {
+		return nil, fmt.Errorf("Error creating the encryptor. Err: %v", err)
+	}
+
+	if !isInit {
+		mg.publishKey(keyIndex, key)
+		mg.chunkKeys[chunkIndex] = hls.Key{Method: method.String(), URI: key.URI, IV: iv}
+	}
+
+	return encryptor, nil
+}
+
+// publishKey Writes / uploads the key file (once per key period) before any chunklist references it
+func (mg *ManifestGenerator) publishKey(keyIndex uint64, key encryption.Key) {
+	if key.FileName == "" || (mg.publishedKeyIndex >= 0 && uint64(mg.publishedKeyIndex) == keyIndex) {
+		return
+	}
+
+	fileName := path.Join(mg.options.baseOutPath, key.FileName)
+	h := map[string]string{"Content-Type": "application/octet-stream"}
+
+	err := error(nil)
+	if mg.options.chunkOutputType == mediachunk.ChunkOutputModeFile || mg.options.chunkOutputType == mediachunk.ChunkOutputModeFileSingle {
+		err = atomicfile.WriteFile(fileName, key.Key, mg.options.fileSync)
+	} else if mg.options.chunkOutputType == mediachunk.ChunkOutputModeHTTPChunkedTransfer || mg.options.chunkOutputType == mediachunk.ChunkOutputModeHTTPRegular {
+		err = mg.options.httpUploader.UploadData(key.Key, fileName, h)
+	} else if mg.options.chunkOutputType == mediachunk.ChunkOutputModeS3 {
+		err = mg.options.s3Uploader.UploadData(key.Key, fileName, h)
+	}
+
+	if err != nil {
+		mg.options.log.Error("Error publishing key ", fileName, ". Err: ", err)
+		mg.addDeliveryError(err)
+		return
+	}
+
+	mg.publishedKeyIndex = int64(keyIndex)
+}
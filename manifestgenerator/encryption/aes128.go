@@ -0,0 +1,50 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+)
+
+// aes128Encryptor AES-128-CBC of the whole chunk with PKCS7 padding
+type aes128Encryptor struct {
+	mode    cipher.BlockMode
+	pending []byte
+}
+
+func newAES128Encryptor(key []byte, iv []byte) (*aes128Encryptor, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid IV size")
+	}
+
+	return &aes128Encryptor{cipher.NewCBCEncrypter(block, iv), nil}, nil
+}
+
+// Encrypt Encrypts all the complete blocks
+func (e *aes128Encryptor) Encrypt(buf []byte) ([]byte, error) {
+	e.pending = append(e.pending, buf...)
+
+	n := len(e.pending) / aes.BlockSize * aes.BlockSize
+	out := make([]byte, n)
+	e.mode.CryptBlocks(out, e.pending[:n])
+	e.pending = append(e.pending[:0], e.pending[n:]...)
+
+	return out, nil
+}
+
+// Close Pads and encrypts the last block
+func (e *aes128Encryptor) Close() ([]byte, error) {
+	padding := aes.BlockSize - len(e.pending)
+	e.pending = append(e.pending, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	out := make([]byte, len(e.pending))
+	e.mode.CryptBlocks(out, e.pending)
+	e.pending = nil
+
+	return out, nil
+}
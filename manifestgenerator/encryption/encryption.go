@@ -0,0 +1,189 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Methods indicates the encryption method
+type Methods int
+
+const (
+	// MethodNone No encryption
+	MethodNone Methods = iota
+
+	// MethodAES128 Whole chunk encrypted with AES-128-CBC (PKCS7 padding)
+	MethodAES128
+
+	// MethodSampleAES Only the H.264 and AAC samples are encrypted, the chunk is still a valid TS
+	MethodSampleAES
+)
+
+const (
+	// KeySize AES-128 key and IV size in bytes
+	KeySize = 16
+)
+
+// String Returns the method name used in EXT-X-KEY
+func (m Methods) String() string {
+	if m == MethodAES128 {
+		return "AES-128"
+	} else if m == MethodSampleAES {
+		return "SAMPLE-AES"
+	}
+
+	return "NONE"
+}
+
+// Key Key used to encrypt a group of chunks
+type Key struct {
+	// Key AES-128 key (16 bytes)
+	Key []byte
+
+	// IV If not set the IV of every chunk is its index (128 bits big endian)
+	IV []byte
+
+	// URI Where the players get the key (EXT-X-KEY URI)
+	URI string
+
+	// FileName If set the key is published (written / uploaded like the chunks) with this name, relative to the output base path
+	FileName string
+}
+
+// GetChunkIV Returns the IV used for a chunk
+func (k *Key) GetChunkIV(chunkIndex uint64) []byte {
+	if len(k.IV) == KeySize {
+		return k.IV
+	}
+
+	iv := make([]byte, KeySize)
+	binary.BigEndian.PutUint64(iv[8:], chunkIndex)
+
+	return iv
+}
+
+// KeyProvider Provides the encryption keys (ex: file, KMS, DRM server)
+type KeyProvider interface {
+	// GetKey Returns the key of the key period keyIndex (chunk index / rotation period)
+	GetKey(keyIndex uint64) (Key, error)
+}
+
+// FileKeyProvider Static key read from a local file (16 raw bytes or 32 hex chars)
+type FileKeyProvider struct {
+	key Key
+}
+
+// NewFileKeyProvider Reads the key file, uri is the URI of the key for the players (the key is not published)
+func NewFileKeyProvider(keyFileName string, uri string, iv []byte) (*FileKeyProvider, error) {
+	data, err := ioutil.ReadFile(keyFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %v", keyFileName, err)
+	}
+	if iv != nil && len(iv) != KeySize {
+		return nil, errors.New("invalid IV size")
+	}
+
+	return &FileKeyProvider{Key{key, iv, uri, ""}}, nil
+}
+
+func parseKey(data []byte) ([]byte, error) {
+	if len(data) == KeySize {
+		return data, nil
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != KeySize {
+		return nil, errors.New("the key must be 16 bytes or 32 hex chars")
+	}
+
+	return key, nil
+}
+
+// GetKey Returns the same key for all the periods
+func (p *FileKeyProvider) GetKey(keyIndex uint64) (Key, error) {
+	return p.key, nil
+}
+
+// RandomKeyProvider Generates a random key for every period and publishes it as keyBaseFilename + index + .key
+type RandomKeyProvider struct {
+	keyBaseFilename string
+	uriPrefix       string
+
+	mutex sync.Mutex
+	keys  map[uint64]Key
+}
+
+// NewRandomKeyProvider Creates a random key provider, the key URI is uriPrefix + key filename
+func NewRandomKeyProvider(keyBaseFilename string, uriPrefix string) *RandomKeyProvider {
+	return &RandomKeyProvider{keyBaseFilename, uriPrefix, sync.Mutex{}, make(map[uint64]Key)}
+}
+
+// GetKey Returns the key of the period (generated the 1st time)
+func (p *RandomKeyProvider) GetKey(keyIndex uint64) (Key, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if key, found := p.keys[keyIndex]; found {
+		return key, nil
+	}
+
+	keyData := make([]byte, KeySize)
+	_, err := rand.Read(keyData)
+	if err != nil {
+		return Key{}, err
+	}
+
+	fileName := fmt.Sprintf("%s%05d.key", p.keyBaseFilename, keyIndex)
+	key := Key{keyData, nil, p.uriPrefix + fileName, fileName}
+
+	// Only the recent periods are used
+	for index := range p.keys {
+		if index+1 < keyIndex {
+			delete(p.keys, index)
+		}
+	}
+	p.keys[keyIndex] = key
+
+	return key, nil
+}
+
+// Encryptor Encrypts the chunk data as it is received
+type Encryptor interface {
+	// Encrypt Returns the encrypted data ready to be written (it can be less or more than buf)
+	Encrypt(buf []byte) ([]byte, error)
+
+	// Close Returns the remaining encrypted data
+	Close() ([]byte, error)
+}
+
+// SampleAESOptions Stream info needed by SAMPLE-AES
+type SampleAESOptions struct {
+	PMTPID   int
+	VideoPID int
+	AudioPID int
+
+	// AudioConfig AAC AudioSpecificConfig (see GetAudioSpecificConfig), it is added to the PMT
+	AudioConfig []byte
+}
+
+// New Creates an encryptor for a chunk
+func New(method Methods, key []byte, iv []byte, sampleAESOptions SampleAESOptions) (Encryptor, error) {
+	if method == MethodAES128 {
+		return newAES128Encryptor(key, iv)
+	} else if method == MethodSampleAES {
+		return newSampleAESEncryptor(key, iv, sampleAESOptions)
+	}
+
+	return nil, errors.New("unsupported encryption method " + method.String())
+}
@@ -0,0 +1,195 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tspacket"
+)
+
+func TestAES128Encryptor(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := make([]byte, KeySize)
+	iv[15] = 3
+
+	data := make([]byte, 188*7)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	encryptor, err := New(MethodAES128, key, iv, SampleAESOptions{})
+	if err != nil {
+		t.Fatal("Error creating encryptor. Err: ", err)
+	}
+
+	encrypted := []byte{}
+	for pos := 0; pos < len(data); pos += 100 {
+		end := pos + 100
+		if end > len(data) {
+			end = len(data)
+		}
+		out, _ := encryptor.Encrypt(data[pos:end])
+		encrypted = append(encrypted, out...)
+	}
+	out, _ := encryptor.Close()
+	encrypted = append(encrypted, out...)
+
+	if len(encrypted) != (len(data)/aes.BlockSize+1)*aes.BlockSize {
+		t.Fatalf("Wrong encrypted size, got: %d", len(encrypted))
+	}
+
+	block, _ := aes.NewCipher(key)
+	decrypted := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+
+	padding := int(decrypted[len(decrypted)-1])
+	if !bytes.Equal(decrypted[:len(decrypted)-padding], data) {
+		t.Error("Decrypted data does not match the original")
+	}
+}
+
+func TestGetChunkIV(t *testing.T) {
+	key := Key{}
+	iv := key.GetChunkIV(258)
+	if !bytes.Equal(iv, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2}) {
+		t.Errorf("Wrong chunk IV, got: %x", iv)
+	}
+
+	key.IV = bytes.Repeat([]byte{0xAA}, KeySize)
+	if !bytes.Equal(key.GetChunkIV(258), key.IV) {
+		t.Error("Expected the key IV")
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFileName := path.Join(dir, "key.txt")
+	ioutil.WriteFile(keyFileName, []byte("000102030405060708090a0b0c0d0e0f\n"), 0644)
+
+	provider, err := NewFileKeyProvider(keyFileName, "https://keys/key", nil)
+	if err != nil {
+		t.Fatal("Error creating key provider. Err: ", err)
+	}
+	key, _ := provider.GetKey(5)
+	if key.Key[15] != 0x0F || key.URI != "https://keys/key" || key.FileName != "" {
+		t.Errorf("Wrong key, got: %v", key)
+	}
+
+	ioutil.WriteFile(keyFileName, []byte("short"), 0644)
+	if _, err := NewFileKeyProvider(keyFileName, "", nil); err == nil {
+		t.Error("Expected error for an invalid key")
+	}
+}
+
+func TestRandomKeyProvider(t *testing.T) {
+	provider := NewRandomKeyProvider("key_", "https://keys/")
+
+	key0, _ := provider.GetKey(0)
+	key0Again, _ := provider.GetKey(0)
+	key1, _ := provider.GetKey(1)
+
+	if !bytes.Equal(key0.Key, key0Again.Key) || bytes.Equal(key0.Key, key1.Key) {
+		t.Error("Expected the same key for the same period and a different one for the next")
+	}
+	if key1.FileName != "key_00001.key" || key1.URI != "https://keys/key_00001.key" {
+		t.Errorf("Wrong key names, got: %s, %s", key1.FileName, key1.URI)
+	}
+}
+
+func TestEmulationPrevention(t *testing.T) {
+	rbsp := []byte{0x65, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x10, 0x00}
+	nal := addEmulationPrevention(rbsp)
+
+	expected := []byte{0x65, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x03, 0x10, 0x00, 0x03}
+	if !bytes.Equal(nal, expected) {
+		t.Errorf("Wrong NAL, got: %x, want: %x", nal, expected)
+	}
+	if !bytes.Equal(removeEmulationPrevention(nal[:len(nal)-1]), rbsp) {
+		t.Errorf("Wrong RBSP, got: %x, want: %x", removeEmulationPrevention(nal[:len(nal)-1]), rbsp)
+	}
+}
+
+func TestPacketize(t *testing.T) {
+	for _, pesSize := range []int{1, 100, 176, 183, 184, 185, 1000} {
+		cc := uint8(15)
+		pes := bytes.Repeat([]byte{0x11}, pesSize)
+		pcr := []byte{0x50, 0, 0, 0, 0, 0, 0}
+
+		out := packetize(nil, 0x100, pcr, pes, &cc)
+		if len(out)%tsPacketSize != 0 {
+			t.Fatalf("PES %d: wrong TS size %d", pesSize, len(out))
+		}
+
+		payload := []byte{}
+		for pos := 0; pos < len(out); pos += tsPacketSize {
+			packet := out[pos : pos+tsPacketSize]
+			if packet[0] != 0x47 || (int(packet[1]&0x1F)<<8|int(packet[2])) != 0x100 {
+				t.Fatalf("PES %d: wrong TS header %x", pesSize, packet[:4])
+			}
+			if (pos == 0) != (packet[1]&0x40 != 0) {
+				t.Errorf("PES %d: wrong payload unit start in packet %d", pesSize, pos/tsPacketSize)
+			}
+			start := tsHeaderSize
+			if packet[3]&0x20 != 0 {
+				start += 1 + int(packet[4])
+			}
+			payload = append(payload, packet[start:]...)
+		}
+		if !bytes.Equal(payload, pes) {
+			t.Errorf("PES %d: wrong payload size %d", pesSize, len(payload))
+		}
+		if cc != uint8((15+len(out)/tsPacketSize)&0x0F) {
+			t.Errorf("PES %d: wrong continuity counter %d", pesSize, cc)
+		}
+	}
+}
+
+func TestRewritePMT(t *testing.T) {
+	// PMT PID 0x1000, PCR 0x100, H.264 0x100, AAC 0x101
+	section := []byte{0x02, 0xB0, 0x00, 0x00, 0x01, 0xC1, 0x00, 0x00, 0xE1, 0x00, 0xF0, 0x00,
+		h264StreamType, 0xE1, 0x00, 0xF0, 0x00,
+		adtsStreamType, 0xE1, 0x01, 0xF0, 0x00}
+	section[2] = byte(len(section) - 3 + 4)
+	crc := tspacket.CRC32MPEG2(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	packet := append([]byte{0x47, 0x50, 0x00, 0x10, 0x00}, section...)
+	for len(packet) < tsPacketSize {
+		packet = append(packet, 0xFF)
+	}
+
+	newPacket := rewritePMT(packet, SampleAESOptions{0x1000, 0x100, 0x101, []byte{0x12, 0x10}})
+	if len(newPacket) != tsPacketSize {
+		t.Fatalf("Wrong packet size %d", len(newPacket))
+	}
+
+	newSection := newPacket[5:]
+	sectionEnd := 3 + (int(newSection[1]&0x0F)<<8 | int(newSection[2]))
+	if tspacket.CRC32MPEG2(newSection[:sectionEnd]) != 0 {
+		t.Error("Wrong PMT CRC")
+	}
+	if newSection[12] != h264SampleAESStreamType {
+		t.Errorf("Wrong video stream type, got: %x", newSection[12])
+	}
+	videoDescriptorsLen := int(newSection[16])
+	if !bytes.Equal(newSection[17:17+videoDescriptorsLen], []byte{privateDataIndicatorDescriptorTag, 4, 'z', 'a', 'v', 'c'}) {
+		t.Errorf("Wrong video descriptors, got: %x", newSection[17:17+videoDescriptorsLen])
+	}
+	audio := newSection[17+videoDescriptorsLen:]
+	if audio[0] != adtsSampleAESStreamType {
+		t.Errorf("Wrong audio stream type, got: %x", audio[0])
+	}
+	if !bytes.Contains(audio[5:5+int(audio[4])], []byte{'a', 'p', 'a', 'd', 'z', 'a', 'a', 'c', 0, 0, 1, 2, 0x12, 0x10}) {
+		t.Errorf("Wrong audio descriptors, got: %x", audio[5:5+int(audio[4])])
+	}
+}
@@ -0,0 +1,536 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tspacket"
+)
+
+const (
+	tsPacketSize     = 188
+	tsHeaderSize     = 4
+	tsMaxPayloadSize = tsPacketSize - tsHeaderSize
+
+	h264StreamType          uint8 = 0x1B
+	adtsStreamType          uint8 = 0x0F
+	h264SampleAESStreamType uint8 = 0xDB
+	adtsSampleAESStreamType uint8 = 0xCF
+
+	registrationDescriptorTag         uint8 = 0x05
+	privateDataIndicatorDescriptorTag uint8 = 0x0F
+
+	// NAL units bigger than this are encrypted (1 block every 10, after a 32 bytes clear leader)
+	sampleAESMinNALSize       = 48
+	sampleAESNALClearLeader   = 32
+	sampleAESADTSClearLeader  = 16
+	sampleAESClearBlocksAfter = 9
+)
+
+// sampleAESEncryptor SAMPLE-AES of the H.264 video (slices) and the AAC ADTS audio frames
+// The PES packets are encrypted when complete and packetized again (the emulation prevention can change their size)
+// Only the adaptation field of the 1st TS packet of every PES is kept (PCR, random access)
+type sampleAESEncryptor struct {
+	block   cipher.Block
+	iv      []byte
+	options SampleAESOptions
+
+	// Incomplete TS packet
+	pending []byte
+
+	// TS packets of the PES being received, by PID
+	pesPackets map[int][][]byte
+
+	// Next continuity counter, by PID
+	continuityCounters map[int]uint8
+}
+
+func newSampleAESEncryptor(key []byte, iv []byte, options SampleAESOptions) (*sampleAESEncryptor, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid IV size")
+	}
+
+	return &sampleAESEncryptor{block, iv, options, nil, make(map[int][][]byte), make(map[int]uint8)}, nil
+}
+
+// Encrypt Processes the complete TS packets, the video and audio ones are returned when their PES is complete
+func (e *sampleAESEncryptor) Encrypt(buf []byte) ([]byte, error) {
+	e.pending = append(e.pending, buf...)
+
+	out := []byte{}
+	n := 0
+	for ; n+tsPacketSize <= len(e.pending); n += tsPacketSize {
+		packet := make([]byte, tsPacketSize)
+		copy(packet, e.pending[n:n+tsPacketSize])
+
+		out = e.processPacket(packet, out)
+	}
+	e.pending = append(e.pending[:0], e.pending[n:]...)
+
+	return out, nil
+}
+
+// Close Returns the PES packets still in process
+func (e *sampleAESEncryptor) Close() ([]byte, error) {
+	out := []byte{}
+	for _, pID := range []int{e.options.VideoPID, e.options.AudioPID} {
+		out = e.flushPES(pID, out)
+	}
+
+	// Incomplete packet
+	out = append(out, e.pending...)
+	e.pending = nil
+
+	return out, nil
+}
+
+func (e *sampleAESEncryptor) processPacket(packet []byte, out []byte) []byte {
+	if packet[0] != 0x47 {
+		return append(out, packet...)
+	}
+
+	pID := int(packet[1]&0x1F)<<8 | int(packet[2])
+	isPayloadStart := packet[1]&0x40 != 0
+
+	if pID == e.options.PMTPID && isPayloadStart {
+		return append(out, rewritePMT(packet, e.options)...)
+	}
+
+	if pID >= 0 && (pID == e.options.VideoPID || pID == e.options.AudioPID) {
+		if isPayloadStart {
+			out = e.flushPES(pID, out)
+		}
+		if isPayloadStart || len(e.pesPackets[pID]) > 0 {
+			e.pesPackets[pID] = append(e.pesPackets[pID], packet)
+			return out
+		}
+		// Data before the 1st PES start, we can not process it
+	}
+
+	return append(out, packet...)
+}
+
+func (e *sampleAESEncryptor) flushPES(pID int, out []byte) []byte {
+	packets := e.pesPackets[pID]
+	if len(packets) == 0 {
+		return out
+	}
+	delete(e.pesPackets, pID)
+
+	pes := []byte{}
+	var firstAdaptationField []byte
+	for i, packet := range packets {
+		adaptationFieldControl := (packet[3] >> 4) & 0x3
+		payloadStart := tsHeaderSize
+		if adaptationFieldControl&0x2 != 0 {
+			adaptationFieldLength := int(packet[4])
+			payloadStart = tsHeaderSize + 1 + adaptationFieldLength
+			if payloadStart > tsPacketSize {
+				payloadStart = tsPacketSize
+			}
+			if i == 0 {
+				firstAdaptationField = getEssentialAdaptationField(packet[tsHeaderSize+1 : payloadStart])
+			}
+		}
+		if adaptationFieldControl&0x1 != 0 {
+			pes = append(pes, packet[payloadStart:]...)
+		}
+	}
+
+	encryptedPES, ok := e.encryptPES(pID, pes)
+	if !ok {
+		// Not a valid PES, sent as it is
+		for _, packet := range packets {
+			out = append(out, packet...)
+		}
+		return out
+	}
+
+	continuityCounter, found := e.continuityCounters[pID]
+	if !found {
+		continuityCounter = packets[0][3] & 0x0F
+	}
+	out = packetize(out, pID, firstAdaptationField, encryptedPES, &continuityCounter)
+	e.continuityCounters[pID] = continuityCounter
+
+	return out
+}
+
+func (e *sampleAESEncryptor) encryptPES(pID int, pes []byte) ([]byte, bool) {
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return nil, false
+	}
+	headerLength := 9 + int(pes[8])
+	if headerLength > len(pes) {
+		return nil, false
+	}
+
+	var es []byte
+	if pID == e.options.VideoPID {
+		es = e.encryptH264(pes[headerLength:])
+	} else {
+		es = e.encryptADTS(pes[headerLength:])
+	}
+
+	encryptedPES := make([]byte, 0, headerLength+len(es))
+	encryptedPES = append(encryptedPES, pes[:headerLength]...)
+	encryptedPES = append(encryptedPES, es...)
+
+	// PES_packet_length (0 = unbounded, only allowed for video)
+	pesLength := len(encryptedPES) - 6
+	if (pes[4] == 0 && pes[5] == 0) || pesLength > 0xFFFF {
+		pesLength = 0
+	}
+	encryptedPES[4] = byte(pesLength >> 8)
+	encryptedPES[5] = byte(pesLength)
+
+	return encryptedPES, true
+}
+
+// encryptH264 Encrypts the slices NAL units of an Annex B byte stream
+func (e *sampleAESEncryptor) encryptH264(es []byte) []byte {
+	out := make([]byte, 0, len(es)+len(es)/100)
+
+	nalStart := -1
+	i := 0
+	for i+3 <= len(es) {
+		if es[i] == 0 && es[i+1] == 0 && es[i+2] == 1 {
+			if nalStart >= 0 {
+				out = e.appendNAL(out, es[nalStart:i])
+			} else {
+				out = append(out, es[:i]...)
+			}
+			out = append(out, 0, 0, 1)
+			i += 3
+			nalStart = i
+			continue
+		}
+		i++
+	}
+
+	if nalStart >= 0 {
+		out = e.appendNAL(out, es[nalStart:])
+	} else {
+		out = append(out, es...)
+	}
+
+	return out
+}
+
+func (e *sampleAESEncryptor) appendNAL(out []byte, nal []byte) []byte {
+	// The trailing zeros belong to the next start code
+	end := len(nal)
+	for end > 0 && nal[end-1] == 0 {
+		end--
+	}
+	trailingZeros := nal[end:]
+	nal = nal[:end]
+
+	nalType := uint8(0)
+	if len(nal) > 0 {
+		nalType = nal[0] & 0x1F
+	}
+
+	if (nalType == 1 || nalType == 5) && len(nal) > sampleAESMinNALSize {
+		rbsp := removeEmulationPrevention(nal)
+
+		mode := cipher.NewCBCEncrypter(e.block, e.iv)
+		for pos := sampleAESNALClearLeader; pos+aes.BlockSize <= len(rbsp); pos += aes.BlockSize * (1 + sampleAESClearBlocksAfter) {
+			mode.CryptBlocks(rbsp[pos:pos+aes.BlockSize], rbsp[pos:pos+aes.BlockSize])
+		}
+
+		nal = addEmulationPrevention(rbsp)
+	}
+
+	out = append(out, nal...)
+	return append(out, trailingZeros...)
+}
+
+// encryptADTS Encrypts the ADTS frames (header and 16 bytes leader in clear, then all the complete blocks)
+func (e *sampleAESEncryptor) encryptADTS(es []byte) []byte {
+	out := make([]byte, len(es))
+	copy(out, es)
+
+	pos := 0
+	for pos+7 <= len(out) {
+		if out[pos] != 0xFF || out[pos+1]&0xF0 != 0xF0 {
+			break
+		}
+		frameLength := int(out[pos+3]&0x3)<<11 | int(out[pos+4])<<3 | int(out[pos+5])>>5
+		headerLength := 7
+		if out[pos+1]&0x1 == 0 {
+			// CRC
+			headerLength = 9
+		}
+		if frameLength < headerLength || pos+frameLength > len(out) {
+			break
+		}
+
+		payload := out[pos+headerLength : pos+frameLength]
+		if len(payload) > sampleAESADTSClearLeader {
+			encryptedLength := (len(payload) - sampleAESADTSClearLeader) / aes.BlockSize * aes.BlockSize
+			if encryptedLength > 0 {
+				blocks := payload[sampleAESADTSClearLeader : sampleAESADTSClearLeader+encryptedLength]
+				cipher.NewCBCEncrypter(e.block, e.iv).CryptBlocks(blocks, blocks)
+			}
+		}
+
+		pos += frameLength
+	}
+
+	return out
+}
+
+func removeEmulationPrevention(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+
+	return out
+}
+
+func addEmulationPrevention(rbsp []byte) []byte {
+	out := make([]byte, 0, len(rbsp)+len(rbsp)/100)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	if len(out) > 0 && out[len(out)-1] == 0 {
+		out = append(out, 3)
+	}
+
+	return out
+}
+
+// getEssentialAdaptationField Returns the adaptation field (without length) removing the stuffing bytes
+func getEssentialAdaptationField(adaptationField []byte) []byte {
+	if len(adaptationField) == 0 {
+		return []byte{}
+	}
+
+	flags := adaptationField[0]
+	n := 1
+	if flags&0x10 != 0 {
+		// PCR
+		n += 6
+	}
+	if flags&0x08 != 0 {
+		// OPCR
+		n += 6
+	}
+	if flags&0x04 != 0 {
+		// Splice countdown
+		n++
+	}
+	if flags&0x02 != 0 && n < len(adaptationField) {
+		// Private data
+		n += 1 + int(adaptationField[n])
+	}
+	if flags&0x01 != 0 && n < len(adaptationField) {
+		// Extension
+		n += 1 + int(adaptationField[n])
+	}
+	if n > len(adaptationField) {
+		n = len(adaptationField)
+	}
+
+	ret := make([]byte, n)
+	copy(ret, adaptationField[:n])
+
+	return ret
+}
+
+// packetize Splits the PES in TS packets, the last one is filled with adaptation field stuffing
+func packetize(out []byte, pID int, firstAdaptationField []byte, pes []byte, continuityCounter *uint8) []byte {
+	isFirst := true
+	for isFirst || len(pes) > 0 {
+		hasAdaptationField := false
+		var adaptationField []byte
+		if isFirst && firstAdaptationField != nil {
+			hasAdaptationField = true
+			adaptationField = append(adaptationField, firstAdaptationField...)
+		}
+
+		space := tsMaxPayloadSize
+		if hasAdaptationField {
+			space -= 1 + len(adaptationField)
+		}
+
+		payloadSize := space
+		if len(pes) < space {
+			payloadSize = len(pes)
+			stuffing := space - len(pes)
+			if !hasAdaptationField {
+				hasAdaptationField = true
+				stuffing--
+			}
+			if stuffing > 0 && len(adaptationField) == 0 {
+				// Flags
+				adaptationField = append(adaptationField, 0x00)
+				stuffing--
+			}
+			for ; stuffing > 0; stuffing-- {
+				adaptationField = append(adaptationField, 0xFF)
+			}
+		}
+
+		header := []byte{0x47, byte(pID>>8) & 0x1F, byte(pID), *continuityCounter & 0x0F}
+		if isFirst {
+			header[1] |= 0x40
+		}
+		if hasAdaptationField {
+			header[3] |= 0x30
+		} else {
+			header[3] |= 0x10
+		}
+		out = append(out, header...)
+		if hasAdaptationField {
+			out = append(out, byte(len(adaptationField)))
+			out = append(out, adaptationField...)
+		}
+		out = append(out, pes[:payloadSize]...)
+
+		pes = pes[payloadSize:]
+		*continuityCounter = (*continuityCounter + 1) & 0x0F
+		isFirst = false
+	}
+
+	return out
+}
+
+// rewritePMT Changes the video / audio stream types to the SAMPLE-AES ones and adds the needed descriptors
+// Only PMTs that fit in one TS packet are supported, the others are returned as they are
+func rewritePMT(packet []byte, options SampleAESOptions) []byte {
+	adaptationFieldControl := (packet[3] >> 4) & 0x3
+	if adaptationFieldControl&0x1 == 0 {
+		return packet
+	}
+	start := tsHeaderSize
+	if adaptationFieldControl&0x2 != 0 {
+		start += 1 + int(packet[tsHeaderSize])
+	}
+	if start >= tsPacketSize {
+		return packet
+	}
+
+	section := start + 1 + int(packet[start])
+	if section+12 > tsPacketSize || packet[section] != 0x02 {
+		return packet
+	}
+	sectionEnd := section + 3 + (int(packet[section+1]&0x0F)<<8 | int(packet[section+2]))
+	if sectionEnd > tsPacketSize || sectionEnd < section+16 {
+		return packet
+	}
+	esStart := section + 12 + (int(packet[section+10]&0x0F)<<8 | int(packet[section+11]))
+	esEnd := sectionEnd - 4
+
+	newSection := append([]byte{}, packet[section:esStart]...)
+	for pos := esStart; pos+5 <= esEnd; {
+		streamType := packet[pos]
+		pID := int(packet[pos+1]&0x1F)<<8 | int(packet[pos+2])
+		descriptorsEnd := pos + 5 + (int(packet[pos+3]&0x0F)<<8 | int(packet[pos+4]))
+		if descriptorsEnd > esEnd {
+			return packet
+		}
+
+		descriptors := append([]byte{}, packet[pos+5:descriptorsEnd]...)
+		if pID == options.VideoPID && streamType == h264StreamType {
+			streamType = h264SampleAESStreamType
+			descriptors = append(descriptors, privateDataIndicatorDescriptorTag, 4, 'z', 'a', 'v', 'c')
+		} else if pID == options.AudioPID && streamType == adtsStreamType {
+			streamType = adtsSampleAESStreamType
+			descriptors = append(descriptors, privateDataIndicatorDescriptorTag, 4, 'a', 'a', 'c', 'd')
+			descriptors = append(descriptors, getAudioSetupDescriptor(options.AudioConfig)...)
+		}
+
+		newSection = append(newSection, streamType, packet[pos+1], packet[pos+2], 0xF0|byte(len(descriptors)>>8)&0x0F, byte(len(descriptors)))
+		newSection = append(newSection, descriptors...)
+
+		pos = descriptorsEnd
+	}
+
+	// section_length counts from after it to the CRC (included)
+	sectionLength := len(newSection) - 3 + 4
+	newSection[1] = (newSection[1] & 0xF0) | byte(sectionLength>>8)&0x0F
+	newSection[2] = byte(sectionLength)
+	crc := tspacket.CRC32MPEG2(newSection)
+	newSection = append(newSection, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	if section+len(newSection) > tsPacketSize {
+		return packet
+	}
+
+	newPacket := make([]byte, 0, tsPacketSize)
+	newPacket = append(newPacket, packet[:section]...)
+	newPacket = append(newPacket, newSection...)
+	for len(newPacket) < tsPacketSize {
+		newPacket = append(newPacket, 0xFF)
+	}
+
+	return newPacket
+}
+
+// getAudioSetupDescriptor Returns the registration descriptor with the audio setup information of AAC
+func getAudioSetupDescriptor(audioConfig []byte) []byte {
+	descriptor := []byte{registrationDescriptorTag, 0, 'a', 'p', 'a', 'd', 'z', 'a', 'a', 'c', 0, 0, 1, byte(len(audioConfig))}
+	descriptor = append(descriptor, audioConfig...)
+	descriptor[1] = byte(len(descriptor) - 2)
+
+	return descriptor
+}
+
+// GetAudioSpecificConfig Returns the AAC AudioSpecificConfig from a TS packet that starts an ADTS PES (nil if not found)
+func GetAudioSpecificConfig(packet []byte) []byte {
+	if len(packet) < tsPacketSize || packet[0] != 0x47 || packet[1]&0x40 == 0 {
+		return nil
+	}
+
+	adaptationFieldControl := (packet[3] >> 4) & 0x3
+	if adaptationFieldControl&0x1 == 0 {
+		return nil
+	}
+	start := tsHeaderSize
+	if adaptationFieldControl&0x2 != 0 {
+		start += 1 + int(packet[tsHeaderSize])
+	}
+
+	pes := packet[start:]
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || 9+int(pes[8]) > len(pes) {
+		return nil
+	}
+	adts := pes[9+int(pes[8]):]
+	if len(adts) < 7 || adts[0] != 0xFF || adts[1]&0xF0 != 0xF0 {
+		return nil
+	}
+
+	objectType := (adts[2]>>6)&0x3 + 1
+	samplingFrequencyIndex := (adts[2] >> 2) & 0xF
+	channelConfiguration := (adts[2]&0x1)<<2 | (adts[3]>>6)&0x3
+
+	return []byte{objectType<<3 | samplingFrequencyIndex>>1, (samplingFrequencyIndex&0x1)<<7 | channelConfiguration<<3}
+}
@@ -2,15 +2,19 @@ package hls
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"math"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/atomicfile"
 	"github.com/jordicenzano/go-ts-segmenter/uploaders/httpuploader"
 	"github.com/jordicenzano/go-ts-segmenter/uploaders/s3uploader"
+	"github.com/jordicenzano/go-ts-segmenter/uploaders/uploadqueue"
 	"github.com/sirupsen/logrus"
 )
 
@@ -48,12 +52,70 @@ const (
 	HlsOutputModeS3
 )
 
+// ProgramDateTimeFormat Format of the EXT-X-PROGRAM-DATE-TIME tag (ISO 8601 with ms)
+const ProgramDateTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// GapMinVersion Min version of a chunklist with EXT-X-GAP chunks
+const GapMinVersion = 8
+
+// TargetDurationToleranceS Chunks up to this amount longer than an integer duration do not increase the target duration (PCR precision)
+const TargetDurationToleranceS = 0.001
+
 // Chunk Chunk information
 type Chunk struct {
 	IsGrowing bool
 	FileName  string
 	DurationS float64
 	IsDisco   bool
+	IsGap     bool
+
+	// ProgramDateTime Wall clock time of the chunk start (not written if zero)
+	ProgramDateTime time.Time
+
+	// ByteRangeLength If > 0 the chunk is the range [ByteRangeOffset, ByteRangeOffset + ByteRangeLength) of FileName
+	ByteRangeOffset int64
+	ByteRangeLength int64
+
+	// Key Encryption of the chunk (empty method = not encrypted)
+	Key Key
+
+	// InitChunkFileName Init chunk (EXT-X-MAP) used by this chunk, empty = the init chunk set when it was added
+	InitChunkFileName  string
+	InitChunkByteRange string
+
+	// IsNotIndependent The chunk does not start with a random access point (forced cut), EXT-X-INDEPENDENT-SEGMENTS is not written while it is in the chunklist
+	IsNotIndependent bool
+}
+
+// Key Encryption key information (EXT-X-KEY)
+type Key struct {
+	Method string
+	URI    string
+	IV     []byte
+}
+
+func (k *Key) equal(other Key) bool {
+	return k.Method == other.Method && k.URI == other.URI && bytes.Equal(k.IV, other.IV)
+}
+
+func (k *Key) String() string {
+	if k.Method == "" {
+		return "METHOD=NONE"
+	}
+
+	ret := "METHOD=" + k.Method + ",URI=\"" + k.URI + "\""
+	if len(k.IV) > 0 {
+		ret = ret + ",IV=0x" + hex.EncodeToString(k.IV)
+	}
+
+	return ret
+}
+
+// State Chunklist data needed to continue it after a restart
+type State struct {
+	MediaSequence         int64
+	DiscontinuitySequence int64
+	Chunks                []Chunk
 }
 
 // Hls Hls chunklist
@@ -73,6 +135,16 @@ type Hls struct {
 	httpUploader          *httpuploader.HTTPUploader
 	s3Uploader            *s3uploader.S3Uploader
 	isClosed              bool
+	uploadQueue           *uploadqueue.Queue
+	fileSync              bool
+	initChunkByteRange    string
+	isIFramesOnly         bool
+
+	// Longest chunk allowed (live) or added (VOD), the target duration can not decrease
+	maxChunkDurS float64
+
+	// Number of chunks added in every AddChunks call, the sliding window is applied to these groups
+	chunkGroupSizes []int
 }
 
 // New Creates a hls chunklist manifest
@@ -105,11 +177,74 @@ func New(
 		httpUploader,
 		s3Uploader,
 		false,
+		nil,
+		false,
+		"",
+		false,
+		0,
+		make([]int, 0),
 	}
 
 	return h
 }
 
+// SetFileSync Flush the chunklist to disk (fsync) before making it visible
+func (p *Hls) SetFileSync(fileSync bool) {
+	p.fileSync = fileSync
+}
+
+// SetUploadQueue Sets the queue used to upload the chunklist asynchronously (after the previously queued chunks)
+func (p *Hls) SetUploadQueue(uploadQueue *uploadqueue.Queue) {
+	p.uploadQueue = uploadQueue
+}
+
+// SetChunklistFileName Sets the chunklist filename (the chunk paths are relative to it)
+func (p *Hls) SetChunklistFileName(chunklistFileName string) {
+	p.chunklistFileName = chunklistFileName
+}
+
+// SetInitChunkByteRange Sets the position of the init chunk inside its file (length 0 = whole file)
+func (p *Hls) SetInitChunkByteRange(offset int64, length int64) {
+	p.initChunkByteRange = ""
+	if length > 0 {
+		p.initChunkByteRange = getByteRange(offset, length)
+	}
+}
+
+// setChunkInit Sets the current init chunk to the chunks without one
+func (p *Hls) setChunkInit(chunk Chunk) Chunk {
+	if chunk.InitChunkFileName == "" {
+		chunk.InitChunkFileName = p.initChunkDataFileName
+		chunk.InitChunkByteRange = p.initChunkByteRange
+	}
+
+	return chunk
+}
+
+func getByteRange(offset int64, length int64) string {
+	return strconv.FormatInt(length, 10) + "@" + strconv.FormatInt(offset, 10)
+}
+
+// SetIndependentSegments Indicates if all the chunks start with a random access point (EXT-X-INDEPENDENT-SEGMENTS)
+func (p *Hls) SetIndependentSegments(isIndependentSegments bool) {
+	p.isIndependentSegments = isIndependentSegments
+}
+
+func (p *Hls) areChunksIndependent() bool {
+	for _, chunk := range p.chunks {
+		if chunk.IsNotIndependent {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetIFramesOnly Indicates that every chunk is an I-frame (I-frame playlist)
+func (p *Hls) SetIFramesOnly(isIFramesOnly bool) {
+	p.isIFramesOnly = isIFramesOnly
+}
+
 // SetInitChunk Adds a chunk init infomation
 func (p *Hls) SetInitChunk(initChunkFileName string) {
 	p.initChunkDataFileName = initChunkFileName
@@ -141,17 +276,17 @@ func (p *Hls) CloseManifest(saveChunklist bool) error {
 	return ret
 }
 
-// SetHlsVersion Sets manifest version
+// SetHlsVersion Sets manifest version, it is never lowered (the features already used need the highest one)
 func (p *Hls) SetHlsVersion(version int) {
-	p.version = version
+	if version > p.version {
+		p.version = version
+	}
 }
 
+// saveManifestToFile Writes the chunklist to a temp file and renames it, so readers never get a partial chunklist
 func (p *Hls) saveManifestToFile(manifestByte []byte) error {
 	if p.chunklistFileName != "" {
-		err := ioutil.WriteFile(p.chunklistFileName, manifestByte, 0644)
-		if err != nil {
-			return err
-		}
+		return atomicfile.WriteFile(p.chunklistFileName, manifestByte, p.fileSync)
 	}
 
 	return nil
@@ -164,28 +299,56 @@ func (p *Hls) saveManifestExternal(manifestByte []byte, outputType OutputTypes)
 			h["Content-Type"] = "application/vnd.apple.mpegurl"
 		}
 
-		// TODO: Use interfaces
-		if outputType == HlsOutputModeS3 {
-			return p.s3Uploader.UploadData(manifestByte, p.chunklistFileName, h)
+		upload := func() error {
+			// TODO: Use interfaces
+			if outputType == HlsOutputModeS3 {
+				return p.s3Uploader.UploadData(manifestByte, p.chunklistFileName, h)
+			}
+			return p.httpUploader.UploadData(manifestByte, p.chunklistFileName, h)
+		}
+
+		if p.uploadQueue != nil {
+			// Uploaded after all the chunks queued before, so all the referenced chunks are available
+			return p.uploadQueue.Add(uploadqueue.Job{Name: p.chunklistFileName, Upload: upload, WaitPrevious: true})
 		}
-		return p.httpUploader.UploadData(manifestByte, p.chunklistFileName, h)
+		return upload()
 	}
 	return nil
 }
 
 // AddChunk Adds a new chunk
 func (p *Hls) AddChunk(chunkData Chunk, saveChunklist bool) error {
+	return p.AddChunks([]Chunk{chunkData}, saveChunklist)
+}
+
+// AddChunks Adds a group of chunks (ex: the I-frames of a media chunk), in sliding window mode the window size is in groups
+func (p *Hls) AddChunks(chunksData []Chunk, saveChunklist bool) error {
 	ret := error(nil)
 
-	p.chunks = append(p.chunks, chunkData)
+	if len(chunksData) == 0 {
+		return ret
+	}
 
-	if p.manifestType == LiveWindow && len(p.chunks) > p.slidingWindowSize {
-		//Remove first
-		if p.chunks[0].IsDisco {
+	for _, chunk := range chunksData {
+		p.updateTargetDuration(chunk)
+		if chunk.IsGap {
+			p.SetHlsVersion(GapMinVersion)
+		}
+		p.chunks = append(p.chunks, p.setChunkInit(chunk))
+	}
+
+	p.chunkGroupSizes = append(p.chunkGroupSizes, len(chunksData))
 
+	for p.manifestType == LiveWindow && len(p.chunkGroupSizes) > p.slidingWindowSize {
+		//Remove first group
+		for n := 0; n < p.chunkGroupSizes[0]; n++ {
+			if p.chunks[0].IsDisco {
+				p.dseq++
+			}
+			p.chunks = p.chunks[1:]
+			p.mseq++
 		}
-		p.chunks = p.chunks[1:]
-		p.mseq++
+		p.chunkGroupSizes = p.chunkGroupSizes[1:]
 	}
 
 	if saveChunklist {
@@ -195,6 +358,87 @@ func (p *Hls) AddChunk(chunkData Chunk, saveChunklist bool) error {
 	return ret
 }
 
+// SetChunkGap Marks an already added chunk as gap (ex: it could not be delivered) and saves the chunklist
+func (p *Hls) SetChunkGap(fileName string) error {
+	for i := range p.chunks {
+		if p.chunks[i].FileName == fileName {
+			if p.chunks[i].IsGap {
+				return nil
+			}
+			p.chunks[i].IsGap = true
+			p.SetHlsVersion(GapMinVersion)
+
+			return p.saveChunklist()
+		}
+	}
+
+	// Not in the chunklist anymore
+	return nil
+}
+
+// GetState Returns the chunklist state (media sequence, discontinuity sequence and chunks in the window)
+func (p *Hls) GetState() State {
+	chunks := make([]Chunk, len(p.chunks))
+	copy(chunks, p.chunks)
+
+	return State{MediaSequence: p.mseq, DiscontinuitySequence: p.dseq, Chunks: chunks}
+}
+
+// RestoreState Replaces the chunklist state with a previously saved one (it is saved with the next chunk)
+func (p *Hls) RestoreState(state State) {
+	p.mseq = state.MediaSequence
+	p.dseq = state.DiscontinuitySequence
+	p.chunks = make([]Chunk, len(state.Chunks))
+	for i, chunk := range state.Chunks {
+		p.chunks[i] = p.setChunkInit(chunk)
+	}
+	p.chunkGroupSizes = make([]int, len(state.Chunks))
+	for i := range p.chunkGroupSizes {
+		p.chunkGroupSizes[i] = 1
+	}
+	for _, chunk := range state.Chunks {
+		p.updateTargetDuration(chunk)
+		if chunk.IsGap {
+			p.SetHlsVersion(GapMinVersion)
+		}
+	}
+}
+
+// SetMaxChunkDuration Sets the longest chunk duration expected (ex: max segment duration), the target duration covers it
+func (p *Hls) SetMaxChunkDuration(maxChunkDurS float64) {
+	p.maxChunkDurS = math.Max(p.maxChunkDurS, maxChunkDurS)
+}
+
+// GetTargetDuration Returns the EXT-X-TARGETDURATION, the configured target duration or the longest chunk duration, rounded up
+func (p *Hls) GetTargetDuration() int {
+	return getTargetDuration(math.Max(p.targetDurS, p.maxChunkDurS))
+}
+
+func getTargetDuration(durationS float64) int {
+	return int(math.Ceil(durationS - TargetDurationToleranceS))
+}
+
+// updateTargetDuration Every chunk duration must be <= target duration
+// The target duration can not change in live playlists (RFC 8216 6.2.1), only VOD recalculates it with the longest chunk
+func (p *Hls) updateTargetDuration(chunk Chunk) {
+	targetDuration := p.GetTargetDuration()
+	if getTargetDuration(chunk.DurationS) <= targetDuration {
+		return
+	}
+
+	if p.manifestType != Vod {
+		if p.log != nil {
+			p.log.Warn("Chunk ", chunk.FileName, " duration ", chunk.DurationS, "s exceeds the target duration ", targetDuration, "s of the live chunklist")
+		}
+		return
+	}
+
+	p.maxChunkDurS = chunk.DurationS
+	if p.log != nil {
+		p.log.Warn("Chunk ", chunk.FileName, " duration ", chunk.DurationS, "s exceeds the target duration ", targetDuration, "s, updating it to ", p.GetTargetDuration(), "s")
+	}
+}
+
 // addChunk Adds a new chunk
 func (p *Hls) String() string {
 	var buffer bytes.Buffer
@@ -211,22 +455,49 @@ func (p *Hls) String() string {
 		buffer.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
 	}
 
-	buffer.WriteString("#EXT-X-TARGETDURATION:" + fmt.Sprintf("%.0f", p.targetDurS) + "\n")
+	buffer.WriteString("#EXT-X-TARGETDURATION:" + strconv.Itoa(p.GetTargetDuration()) + "\n")
 
-	if p.isIndependentSegments {
+	if p.isIndependentSegments && p.areChunksIndependent() {
 		buffer.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
 	}
 
-	if p.initChunkDataFileName != "" {
-		chunkPath, _ := filepath.Rel(path.Dir(p.chunklistFileName), p.initChunkDataFileName)
-		buffer.WriteString("#EXT-X-MAP:URI=\"" + chunkPath + "\"\n")
+	if p.isIFramesOnly {
+		buffer.WriteString("#EXT-X-I-FRAMES-ONLY\n")
 	}
 
+	// The init chunk can change (stream changes), every EXT-X-MAP applies to the next chunks
+	lastInitChunkFileName := p.initChunkDataFileName
+	lastInitChunkByteRange := p.initChunkByteRange
+	if len(p.chunks) > 0 {
+		lastInitChunkFileName = p.chunks[0].InitChunkFileName
+		lastInitChunkByteRange = p.chunks[0].InitChunkByteRange
+	}
+	p.writeMap(&buffer, lastInitChunkFileName, lastInitChunkByteRange)
+
+	lastKey := Key{}
 	for _, chunk := range p.chunks {
 		if chunk.IsDisco {
 			buffer.WriteString("#EXT-X-DISCONTINUITY\n")
 		}
+		if chunk.InitChunkFileName != lastInitChunkFileName || chunk.InitChunkByteRange != lastInitChunkByteRange {
+			lastInitChunkFileName = chunk.InitChunkFileName
+			lastInitChunkByteRange = chunk.InitChunkByteRange
+			p.writeMap(&buffer, lastInitChunkFileName, lastInitChunkByteRange)
+		}
+		if !chunk.Key.equal(lastKey) {
+			buffer.WriteString("#EXT-X-KEY:" + chunk.Key.String() + "\n")
+			lastKey = chunk.Key
+		}
+		if !chunk.ProgramDateTime.IsZero() {
+			buffer.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + chunk.ProgramDateTime.UTC().Format(ProgramDateTimeFormat) + "\n")
+		}
 		buffer.WriteString("#EXTINF:" + fmt.Sprintf("%.8f", chunk.DurationS) + ",\n")
+		if chunk.IsGap {
+			buffer.WriteString("#EXT-X-GAP\n")
+		}
+		if chunk.ByteRangeLength > 0 {
+			buffer.WriteString("#EXT-X-BYTERANGE:" + getByteRange(chunk.ByteRangeOffset, chunk.ByteRangeLength) + "\n")
+		}
 
 		chunkPath, _ := filepath.Rel(path.Dir(p.chunklistFileName), chunk.FileName)
 		buffer.WriteString(chunkPath + "\n")
@@ -238,3 +509,16 @@ func (p *Hls) String() string {
 
 	return buffer.String()
 }
+
+func (p *Hls) writeMap(buffer *bytes.Buffer, initChunkFileName string, initChunkByteRange string) {
+	if initChunkFileName == "" {
+		return
+	}
+
+	chunkPath, _ := filepath.Rel(path.Dir(p.chunklistFileName), initChunkFileName)
+	if initChunkByteRange != "" {
+		buffer.WriteString("#EXT-X-MAP:URI=\"" + chunkPath + "\",BYTERANGE=\"" + initChunkByteRange + "\"\n")
+	} else {
+		buffer.WriteString("#EXT-X-MAP:URI=\"" + chunkPath + "\"\n")
+	}
+}
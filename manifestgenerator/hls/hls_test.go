@@ -1,3 +1,141 @@
 package hls
 
-//TODO: Add testing
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveManifestToFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls")
+	if err != nil {
+		t.Fatal("Error creating temp dir. Err: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	chunklistFileName := path.Join(dir, "chunklist.m3u8")
+	p := New(nil, LiveWindow, 3, true, 4, 3, chunklistFileName, "", HlsOutputModeFile, nil, nil)
+	p.SetFileSync(true)
+
+	for _, chunkName := range []string{"chunk_00000.ts", "chunk_00001.ts"} {
+		if err := p.AddChunk(Chunk{FileName: path.Join(dir, chunkName), DurationS: 4}, true); err != nil {
+			t.Fatal("Error adding chunk. Err: ", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(chunklistFileName)
+	if err != nil {
+		t.Fatal("Error reading chunklist. Err: ", err)
+	}
+	if string(data) != p.String() {
+		t.Errorf("Chunklist data is different, got %s , expected %s", string(data), p.String())
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Temp files left in the chunklist dir, got %d files, expected %d", len(files), 1)
+	}
+}
+
+func TestProgramDateTime(t *testing.T) {
+	p := New(nil, LiveWindow, 3, true, 4.0, 3, "", "", HlsOutputModeNone, nil, nil)
+
+	pdt := time.Date(2026, 10, 17, 8, 5, 3, 250000000, time.UTC)
+	p.AddChunk(Chunk{FileName: "chunk_00000.ts", DurationS: 4.0, ProgramDateTime: pdt}, false)
+	p.AddChunk(Chunk{FileName: "chunk_00001.ts", DurationS: 4.0, IsDisco: true, ProgramDateTime: pdt.Add(time.Hour)}, false)
+	p.AddChunk(Chunk{FileName: "chunk_00002.ts", DurationS: 4.0}, false)
+
+	manifest := p.String()
+	if !strings.Contains(manifest, "#EXT-X-PROGRAM-DATE-TIME:2026-10-17T08:05:03.250Z\n#EXTINF:4.00000000,\nchunk_00000.ts\n") {
+		t.Error("Wrong program date time of the 1st chunk: ", manifest)
+	}
+	if !strings.Contains(manifest, "#EXT-X-DISCONTINUITY\n#EXT-X-PROGRAM-DATE-TIME:2026-10-17T09:05:03.250Z\n#EXTINF:4.00000000,\nchunk_00001.ts\n") {
+		t.Error("Wrong program date time after discontinuity: ", manifest)
+	}
+	if strings.Count(manifest, "#EXT-X-PROGRAM-DATE-TIME") != 2 {
+		t.Error("Program date time written for a chunk without it: ", manifest)
+	}
+}
+
+func TestTargetDuration(t *testing.T) {
+	p := New(nil, Vod, 3, true, 4.0, 0, "", "", HlsOutputModeNone, nil, nil)
+
+	p.AddChunk(Chunk{FileName: "chunk_00000.ts", DurationS: 4.0000001}, false)
+	if !strings.Contains(p.String(), "#EXT-X-TARGETDURATION:4\n") {
+		t.Error("Wrong target duration: ", p.String())
+	}
+
+	p.AddChunk(Chunk{FileName: "chunk_00001.ts", DurationS: 5.2}, false)
+	if !strings.Contains(p.String(), "#EXT-X-TARGETDURATION:6\n") {
+		t.Error("Wrong VOD target duration after a long chunk: ", p.String())
+	}
+
+	p.AddChunk(Chunk{FileName: "chunk_00002.ts", DurationS: 4.0}, false)
+	if !strings.Contains(p.String(), "#EXT-X-TARGETDURATION:6\n") {
+		t.Error("VOD target duration decreased: ", p.String())
+	}
+
+	// The target duration of a live chunklist can not change
+	live := New(nil, LiveWindow, 3, true, 4.0, 2, "", "", HlsOutputModeNone, nil, nil)
+	live.AddChunk(Chunk{FileName: "chunk_00000.ts", DurationS: 4.0}, false)
+	live.AddChunk(Chunk{FileName: "chunk_00001.ts", DurationS: 5.2}, false)
+	if !strings.Contains(live.String(), "#EXT-X-TARGETDURATION:4\n") {
+		t.Error("Live target duration changed after a long chunk: ", live.String())
+	}
+
+	// Unless it is configured to cover the max chunk duration
+	capped := New(nil, LiveEvent, 3, true, 4.0, 0, "", "", HlsOutputModeNone, nil, nil)
+	capped.SetMaxChunkDuration(5.5)
+	if capped.GetTargetDuration() != 6 {
+		t.Errorf("Wrong target duration with max chunk duration, got: %d, want: %d", capped.GetTargetDuration(), 6)
+	}
+	capped.AddChunk(Chunk{FileName: "chunk_00000.ts", DurationS: 7.5}, false)
+	if capped.GetTargetDuration() != 6 {
+		t.Errorf("Live target duration changed, got: %d, want: %d", capped.GetTargetDuration(), 6)
+	}
+
+	restored := New(nil, Vod, 3, true, 2.5, 0, "", "", HlsOutputModeNone, nil, nil)
+	if restored.GetTargetDuration() != 3 {
+		t.Errorf("Wrong configured target duration, got: %d, want: %d", restored.GetTargetDuration(), 3)
+	}
+	restored.RestoreState(State{0, 0, []Chunk{{FileName: "chunk_00000.ts", DurationS: 7.5}}})
+	if restored.GetTargetDuration() != 8 {
+		t.Errorf("Wrong restored target duration, got: %d, want: %d", restored.GetTargetDuration(), 8)
+	}
+
+	restoredLive := New(nil, LiveWindow, 3, true, 2.5, 2, "", "", HlsOutputModeNone, nil, nil)
+	restoredLive.RestoreState(State{0, 0, []Chunk{{FileName: "chunk_00000.ts", DurationS: 7.5}}})
+	if restoredLive.GetTargetDuration() != 3 {
+		t.Errorf("Wrong restored live target duration, got: %d, want: %d", restoredLive.GetTargetDuration(), 3)
+	}
+}
+
+func TestGapVersion(t *testing.T) {
+	p := New(nil, LiveWindow, 3, true, 4.0, 3, "", "", HlsOutputModeNone, nil, nil)
+
+	p.AddChunk(Chunk{FileName: "chunk_00000.ts", DurationS: 4.0}, false)
+	if !strings.Contains(p.String(), "#EXT-X-VERSION:3\n") {
+		t.Error("Wrong version without gaps: ", p.String())
+	}
+
+	p.AddChunk(Chunk{FileName: "chunk_00001.ts", DurationS: 4.0, IsGap: true}, false)
+	if !strings.Contains(p.String(), "#EXT-X-VERSION:8\n") || !strings.Contains(p.String(), "#EXT-X-GAP\nchunk_00001.ts\n") {
+		t.Error("Wrong version with a gap chunk: ", p.String())
+	}
+
+	// A lower version needed by other features does not lower it
+	p.SetHlsVersion(7)
+	if !strings.Contains(p.String(), "#EXT-X-VERSION:8\n") {
+		t.Error("Version lowered: ", p.String())
+	}
+
+	marked := New(nil, LiveWindow, 3, true, 4.0, 3, "", "", HlsOutputModeNone, nil, nil)
+	marked.AddChunk(Chunk{FileName: "chunk_00000.ts", DurationS: 4.0}, false)
+	marked.SetChunkGap("chunk_00000.ts")
+	if !strings.Contains(marked.String(), "#EXT-X-VERSION:8\n") {
+		t.Error("Wrong version after marking a gap chunk: ", marked.String())
+	}
+}
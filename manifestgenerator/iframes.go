@@ -0,0 +1,158 @@
+package manifestgenerator
+
+import (
+	"errors"
+	"path"
+	"time"
+
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/encryption"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/hls"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/mediachunk"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tspacket"
+)
+
+// iFrameInfo Position of an IDR access unit inside the current chunk
+type iFrameInfo struct {
+	offset int64
+
+	// -1 until the next video access unit starts (or the chunk is closed)
+	length int64
+
+	pcrS float64
+}
+
+// SetIFramePlaylist Generates an I-frame playlist (trick play) next to the chunklist with the byte ranges of the IDR access units
+// The I-frame playlist uses the chunklist type, output and window (in chunks). Empty filename disables it
+// Not compatible with encryption (the byte ranges change when encrypting). The upload queue and file sync options are applied in any order
+func (mg *ManifestGenerator) SetIFramePlaylist(iFramesChunklistFilename string) error {
+	if iFramesChunklistFilename == "" {
+		mg.hlsIFrames = nil
+		return nil
+	}
+	if mg.options.encryption.Method != encryption.MethodNone {
+		return errors.New("I-frame playlists are not compatible with encryption")
+	}
+
+	hlsIFrames := hls.New(
+		mg.options.log,
+		mg.options.manifestType,
+		4,
+		true,
+		mg.options.targetSegmentDurS,
+		mg.options.liveWindowSize+mg.options.lhlsAdvancedChunks,
+		path.Join(mg.options.baseOutPath, iFramesChunklistFilename),
+		"",
+		mg.options.manifestOutputType,
+		mg.options.httpUploader,
+		mg.options.s3Uploader,
+	)
+	hlsIFrames.SetIFramesOnly(true)
+	hlsIFrames.SetUploadQueue(mg.options.uploadQueue)
+	hlsIFrames.SetFileSync(mg.options.fileSync)
+	hlsIFrames.SetMaxChunkDuration(mg.options.maxSegmentDurS)
+
+	mg.hlsIFrames = &hlsIFrames
+
+	return nil
+}
+
+// trackIFrame Records the position of the IDR access units of the current chunk, called before adding a video packet to it
+func (mg *ManifestGenerator) trackIFrame() {
+	if mg.hlsIFrames == nil || !mg.tsPacket.IsPayloadUnitStart() {
+		return
+	}
+
+	chunkSize := int64(0)
+	if len(mg.currentChunks) > 0 {
+		chunkSize = mg.currentChunks[0].GetSize()
+	}
+
+	// A new access unit ends the previous I-frame
+	n := len(mg.currentIFrames)
+	if n > 0 && mg.currentIFrames[n-1].length < 0 {
+		mg.currentIFrames[n-1].length = chunkSize - mg.currentIFrames[n-1].offset
+	}
+
+	if mg.tsPacket.IsRandomAccess(mg.options.videoPID) {
+		offset := chunkSize
+		if n == 0 && mg.options.chunkInitType == ChunkInitStart {
+			// Include the PAT and PMT of the chunk start
+			offset = 0
+		}
+
+		pcrS := mg.tsPacket.GetPCRS()
+		if pcrS < 0 {
+			pcrS = mg.lastPCRS
+		}
+
+		mg.currentIFrames = append(mg.currentIFrames, iFrameInfo{offset, -1, pcrS})
+	}
+}
+
+// hlsAddIFrames Adds the I-frames of a closed chunk to the I-frame playlist
+func (mg *ManifestGenerator) hlsAddIFrames(chunk *mediachunk.Chunk, startTimeS float64, durationS float64, isDisco bool, isGap bool, programDateTime time.Time) {
+	iFrames := mg.currentIFrames
+	mg.currentIFrames = nil
+
+	if mg.hlsIFrames == nil || len(iFrames) == 0 {
+		return
+	}
+
+	// Single file output: The offsets are relative to the chunk start
+	chunkOffset, _ := chunk.GetByteRange()
+	endS := startTimeS + durationS
+
+	hlsChunks := make([]hls.Chunk, 0, len(iFrames))
+	for i, iFrame := range iFrames {
+		length := iFrame.length
+		if length < 0 {
+			length = chunk.GetSize() - iFrame.offset
+		}
+
+		nextS := endS
+		if i+1 < len(iFrames) {
+			nextS = iFrames[i+1].pcrS
+		}
+		iFrameDurationS := getElapsedS(iFrame.pcrS, nextS)
+		if iFrameDurationS <= 0 && len(hlsChunks) > 0 {
+			// The last chunk ends at the last PCR received, so its last I-frame can start at the chunk end
+			iFrameDurationS = hlsChunks[len(hlsChunks)-1].DurationS
+		}
+
+		iFrameProgramDateTime := time.Time{}
+		if !programDateTime.IsZero() {
+			iFrameProgramDateTime = programDateTime.Add(time.Duration(getElapsedS(startTimeS, iFrame.pcrS) * float64(time.Second)))
+		}
+
+		hlsChunks = append(hlsChunks, hls.Chunk{
+			IsGrowing:       false,
+			FileName:        chunk.GetFilename(),
+			DurationS:       iFrameDurationS,
+			IsDisco:         isDisco && i == 0,
+			IsGap:           isGap,
+			ProgramDateTime: iFrameProgramDateTime,
+			ByteRangeOffset: chunkOffset + iFrame.offset,
+			ByteRangeLength: length,
+		})
+	}
+
+	err := mg.hlsIFrames.AddChunks(hlsChunks, true)
+	if err != nil {
+		mg.options.log.Error("Error generating / saving the I-frame chunklists. Err: ", err)
+		mg.addDeliveryError(err)
+	}
+}
+
+// getElapsedS Returns the time between 2 PCRs (handling the PCR rollover)
+func getElapsedS(fromS float64, toS float64) float64 {
+	if fromS < 0 || toS < 0 {
+		return 0
+	}
+
+	elapsedS := toS - fromS
+	if elapsedS < 0 {
+		elapsedS += tspacket.MaxPCRSValue
+	}
+
+	return elapsedS
+}
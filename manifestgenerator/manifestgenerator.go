@@ -2,13 +2,21 @@ package manifestgenerator
 
 import (
 	"fmt"
+	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/encryption"
 	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/hls"
 	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/mediachunk"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tsanalyzer"
 	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tspacket"
 	"github.com/jordicenzano/go-ts-segmenter/uploaders/httpuploader"
 	"github.com/jordicenzano/go-ts-segmenter/uploaders/s3uploader"
+	"github.com/jordicenzano/go-ts-segmenter/uploaders/uploadqueue"
 	"github.com/sirupsen/logrus"
 )
 
@@ -46,6 +54,32 @@ const (
 	ChunkInitFileName = "init"
 )
 
+// FailedSegmentPolicies indicates what to do in the chunklist with the segments that could not be delivered
+type FailedSegmentPolicies int
+
+const (
+	// FailedSegmentList Lists the failed segment as any other segment
+	FailedSegmentList FailedSegmentPolicies = iota
+
+	// FailedSegmentSkip Does not list the failed segment, the next one is marked as discontinuity
+	FailedSegmentSkip
+
+	// FailedSegmentGap Lists the failed segment with the gap tag
+	FailedSegmentGap
+)
+
+// SegmentDeliveryResult Final delivery result of a segment
+type SegmentDeliveryResult struct {
+	FileName  string
+	Index     uint64
+	DurationS float64
+	IsInit    bool
+	Err       error
+}
+
+// SegmentDeliveryCallback Called after each segment is closed with its final delivery result
+type SegmentDeliveryCallback func(result SegmentDeliveryResult)
+
 const (
 	// ChunkLengthToleranceS Tolerance calculating chunk length
 	ChunkLengthToleranceS = 0.25
@@ -77,21 +111,43 @@ const (
 )
 
 type options struct {
-	log                *logrus.Logger
-	chunkOutputType    mediachunk.OutputTypes
-	manifestOutputType hls.OutputTypes
-	baseOutPath        string
-	chunkBaseFilename  string
-	targetSegmentDurS  float64
-	chunkInitType      ChunkInitTypes
-	autoPIDs           bool
-	videoPID           int
-	audioPID           int
-	manifestType       hls.ManifestTypes
-	liveWindowSize     int
-	lhlsAdvancedChunks int
-	httpUploader       *httpuploader.HTTPUploader
-	s3Uploader         *s3uploader.S3Uploader
+	log                 *logrus.Logger
+	chunkOutputType     mediachunk.OutputTypes
+	manifestOutputType  hls.OutputTypes
+	baseOutPath         string
+	chunkBaseFilename   string
+	targetSegmentDurS   float64
+	chunkInitType       ChunkInitTypes
+	autoPIDs            bool
+	videoPID            int
+	audioPID            int
+	manifestType        hls.ManifestTypes
+	liveWindowSize      int
+	lhlsAdvancedChunks  int
+	httpUploader        *httpuploader.HTTPUploader
+	s3Uploader          *s3uploader.S3Uploader
+	failedSegmentPolicy FailedSegmentPolicies
+	deliveryCallback    SegmentDeliveryCallback
+	uploadQueue         *uploadqueue.Queue
+	fileSync            bool
+	naming              NamingOptions
+	stateFileName       string
+	programDateTime     bool
+	pdtReference        time.Time
+	encryption          EncryptionOptions
+	maxSegmentDurS      float64
+	programNumber       int
+	syncLockPackets     int
+	keepM2TSTimestamps  bool
+}
+
+// NamingOptions Filename templates, the empty ones keep the default names. The init template needs $Number$
+type NamingOptions struct {
+	ChunkTemplate     string
+	InitTemplate      string
+	ChunklistTemplate string
+	RenditionName     string
+	TimeSource        mediachunk.TimeSources
 }
 
 // ManifestGenerator Creates the manifest and chunks the media
@@ -99,15 +155,26 @@ type ManifestGenerator struct {
 	options options
 
 	// Internal parsing data
-	isInSync        bool
-	bytesToNextSync int
-	detectedPMTID   int
+	isInSync      bool
+	detectedPMTID int
+
+	// Program of the PMT (only its PMT sections are parsed, other programs can share the PMT PID)
+	detectedProgramNumber int
+
+	// Input packet size detected (188, 192 M2TS or 204 DVB, 0 = none) and input packet data received
+	inputPacketSize int
+	inputPacket     []byte
+
+	// Data received while looking for the sync and number of times the sync was lost
+	syncBuf    []byte
+	syncLosses uint64
 
 	// Current TS packet data
 	tsPacket tspacket.TsPacket
 
-	// Time counters
+	// Time counters (chunkStartPTS is the PTS of the 1st packet of the last chunk created, used for $Time$)
 	chunkStartTimeS float64
+	chunkStartPTS   int64
 	lastPCRS        float64
 
 	// Packet counter
@@ -121,15 +188,89 @@ type ManifestGenerator struct {
 	initChunk *mediachunk.Chunk
 	initState initStates
 
-	// Packets used to save PAT and PMT (We know we'll break TS CC). Only used in ChunkInitStart mode
+	// Packets used to save PAT and PMT (their CC is rewritten when added to the chunks). Only used in ChunkInitStart mode
 	tsInitPATPacket tspacket.TsPacket
 	tsInitPMTPacket tspacket.TsPacket
 
+	// Stream changes: last PAT received, PMT version of the current init data, number of init chunks created and last change ignored (LHLS)
+	tsLastPATPacket     tspacket.TsPacket
+	pmtVersion          int
+	initChunkIndex      uint64
+	ignoredStreamChange string
+
 	//Hls generator
 	hlsChunklist hls.Hls
 
 	//initialChunkCreation Flag tha indicates the first chunk[s] has been created
 	fistChunkCreated bool
+
+	// Next chunk added to the chunklist will be marked as discontinuity (used when skipping failed chunks)
+	nextChunkIsDisco bool
+
+	// Delivery errors not returned to the caller yet
+	deliveryErr error
+
+	// Delivery results received from the upload queue workers
+	asyncResults *asyncDeliveryResults
+
+	// Program date time mapping (PCR in seconds -> wall clock), recalculated after discontinuities
+	pdtRefPCRS   float64
+	pdtRefTime   time.Time
+	pdtRefOffset time.Duration
+
+	// File where all the chunks are appended (mediachunk.ChunkOutputModeFileSingle)
+	singleFile *mediachunk.SingleFile
+
+	// I-frame playlist (nil if disabled) and I-frames of the current chunk
+	hlsIFrames     *hls.Hls
+	currentIFrames []iFrameInfo
+
+	// Encryption: AAC config (SAMPLE-AES), last key published and keys of the chunks in process
+	audioConfig       []byte
+	publishedKeyIndex int64
+	chunkKeys         map[uint64]hls.Key
+
+	// Forced cuts: last video PCR received, last IDR PCR (GOP duration), current chunk does not start with an IDR
+	lastVideoPCRS         float64
+	lastIDRPCRS           float64
+	chunkIsNotIndependent bool
+	gopStats              GOPStats
+
+	// PSI sections rejected so far (bad length, syntax or CRC)
+	psiErrors uint64
+
+	// Streams (language, codec, descriptors) of the last PMT received
+	pmtStreams []tspacket.PMTStream
+
+	// Input CC tracking by PID and next CC of the PAT / PMT packets added to the chunks (ChunkInitStart)
+	continuity  map[int]*pidContinuity
+	psiOutputCC map[int]uint8
+
+	// Input TS error analysis (nil if disabled)
+	analyzer *tsanalyzer.Analyzer
+}
+
+// asyncDeliveryResults Delivery results from the upload queue workers, processed later in the parsing goroutine
+type asyncDeliveryResults struct {
+	mutex   sync.Mutex
+	results []SegmentDeliveryResult
+}
+
+func (a *asyncDeliveryResults) add(result SegmentDeliveryResult) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.results = append(a.results, result)
+}
+
+func (a *asyncDeliveryResults) popAll() []SegmentDeliveryResult {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	results := a.results
+	a.results = nil
+
+	return results
 }
 
 // New Creates a chunklistgenerator instance
@@ -175,12 +316,30 @@ func New(
 			lhlsAdvancedChunks,
 			httpUploader,
 			s3Uploader,
+			FailedSegmentList,
+			nil,
+			nil,
+			false,
+			NamingOptions{},
+			"",
+			false,
+			time.Time{},
+			EncryptionOptions{},
+			0,
+			-1,
+			tspacket.DefaultSyncLockPackets,
+			false,
 		},
 		false,
-		0,
 		-1,
+		-1,
+		0,
+		make([]byte, 0, tspacket.TsRSPacketSize),
+		nil,
+		0,
 		tspacket.New(tspacket.TsDefaultPacketSize),
 		-1.0,
+		-1,
 		-1.0,
 		0,
 		nil,
@@ -189,6 +348,10 @@ func New(
 		InitNotIni,
 		tspacket.New(tspacket.TsDefaultPacketSize),
 		tspacket.New(tspacket.TsDefaultPacketSize),
+		tspacket.New(tspacket.TsDefaultPacketSize),
+		-1,
+		0,
+		"",
 		hls.New(
 			log,
 			manifestType,
@@ -203,29 +366,228 @@ func New(
 			s3Uploader,
 		),
 		false,
+		false,
+		nil,
+		&asyncDeliveryResults{},
+		-1.0,
+		time.Time{},
+		0,
+		nil,
+		nil,
+		nil,
+		nil,
+		-1,
+		make(map[uint64]hls.Key),
+		-1.0,
+		-1.0,
+		false,
+		GOPStats{},
+		0,
+		nil,
+		make(map[int]*pidContinuity),
+		make(map[int]uint8),
+		nil,
 	}
 
 	return mg
 }
 
-func (mg *ManifestGenerator) resync(buf []byte) []byte {
-	mg.isInSync = false
+// SetNamingOptions Sets the filename templates (see mediachunk.ExpandTemplate) used for the chunks, init chunk and chunklist
+// The paths are relative to the base output path and can contain directories
+func (mg *ManifestGenerator) SetNamingOptions(naming NamingOptions) error {
+	for _, template := range []string{naming.ChunkTemplate, naming.InitTemplate, naming.ChunklistTemplate} {
+		err := mediachunk.ValidateTemplate(template)
+		if err != nil {
+			return err
+		}
+	}
+	if naming.InitTemplate != "" && !mediachunk.TemplateHasNumber(naming.InitTemplate) {
+		// A stream change creates a new init chunk, it can not overwrite the one used by the chunks in the chunklist
+		return fmt.Errorf("The init template needs $Number$: %s", naming.InitTemplate)
+	}
+	mg.options.naming = naming
 
-	start := 0
-	for {
-		if start < len(buf) {
-			if buf[start] == 0x47 {
-				mg.isInSync = true
-				break
-			} else {
-				start++
+	if naming.ChunklistTemplate != "" {
+		chunklistFileName := path.Join(mg.options.baseOutPath, mediachunk.ExpandTemplate(naming.ChunklistTemplate, mediachunk.TemplateVars{Number: 0, Time: 0, WallClock: time.Now(), Rendition: naming.RenditionName}))
+		if mg.options.manifestOutputType == hls.HlsOutputModeFile {
+			err := os.MkdirAll(path.Dir(chunklistFileName), 0744)
+			if err != nil {
+				return err
 			}
-		} else {
-			break
 		}
+		mg.hlsChunklist.SetChunklistFileName(chunklistFileName)
+	}
+
+	return nil
+}
+
+// SetProgramDateTime Adds the program date time to each chunk in the chunklist
+// If reference is zero the wall clock when the 1st chunk is received is used as the stream start time, if not reference is used
+func (mg *ManifestGenerator) SetProgramDateTime(enabled bool, reference time.Time) {
+	mg.options.programDateTime = enabled
+	mg.options.pdtReference = reference
+}
+
+// SetFileSync Flush the chunks and chunklists to disk (fsync) before making them visible (file output)
+func (mg *ManifestGenerator) SetFileSync(fileSync bool) {
+	mg.options.fileSync = fileSync
+	mg.hlsChunklist.SetFileSync(fileSync)
+	if mg.hlsIFrames != nil {
+		mg.hlsIFrames.SetFileSync(fileSync)
+	}
+}
+
+// SetUploadQueue Sets the queue used to upload the chunks (HTTP regular and S3) and the chunklist asynchronously
+// In this mode the delivery results are reported in the following AddData / Close calls
+func (mg *ManifestGenerator) SetUploadQueue(uploadQueue *uploadqueue.Queue) {
+	mg.options.uploadQueue = uploadQueue
+	mg.hlsChunklist.SetUploadQueue(uploadQueue)
+	if mg.hlsIFrames != nil {
+		mg.hlsIFrames.SetUploadQueue(uploadQueue)
+	}
+}
+
+// SetFailedSegmentPolicy Sets what to do in the chunklist with the segments that could not be delivered.
+// In LHLS mode the chunks are announced before they are delivered, so the policy is not applied.
+// With an upload queue the chunks are listed before they are delivered, so the failed ones are marked as gap
+func (mg *ManifestGenerator) SetFailedSegmentPolicy(policy FailedSegmentPolicies) {
+	mg.options.failedSegmentPolicy = policy
+}
+
+// SetSegmentDeliveryCallback Sets the function called with the final delivery result of each segment
+func (mg *ManifestGenerator) SetSegmentDeliveryCallback(callback SegmentDeliveryCallback) {
+	mg.options.deliveryCallback = callback
+}
+
+// GetPMTStreams Returns the streams of the last PMT received with their language, codec and descriptors (nil if no PMT yet)
+func (mg *ManifestGenerator) GetPMTStreams() []tspacket.PMTStream {
+	return mg.pmtStreams
+}
+
+// GetStream Returns the PMT info of the stream pID (language, codec), false if it is not in the last PMT received
+func (mg *ManifestGenerator) GetStream(pID int) (tspacket.PMTStream, bool) {
+	for _, stream := range mg.pmtStreams {
+		if int(stream.PID) == pID {
+			return stream, true
+		}
+	}
+
+	return tspacket.PMTStream{}, false
+}
+
+// SetSyncLockPackets Sets the number of consecutive sync bytes (at packet size spacing) needed to lock to the TS, tspacket.DefaultSyncLockPackets by default
+func (mg *ManifestGenerator) SetSyncLockPackets(syncLockPackets int) {
+	if syncLockPackets < 1 {
+		syncLockPackets = 1
+	}
+	mg.options.syncLockPackets = syncLockPackets
+}
+
+// GetSyncLosses Returns the number of times the TS sync was lost
+func (mg *ManifestGenerator) GetSyncLosses() uint64 {
+	return mg.syncLosses
+}
+
+// SetKeepM2TSTimestamps Keeps the M2TS header (arrival timestamp) of the input packets in the chunks (192 bytes packets)
+// By default it is removed, it is not compatible with SAMPLE-AES encryption
+func (mg *ManifestGenerator) SetKeepM2TSTimestamps(keep bool) {
+	if keep && mg.options.encryption.Method == encryption.MethodSampleAES {
+		mg.options.log.Warn("M2TS timestamps can not be kept with SAMPLE-AES encryption, ignored")
+		keep = false
+	}
+	mg.options.keepM2TSTimestamps = keep
+}
+
+// GetInputPacketSize Returns the input packet size detected (188, 192 M2TS or 204 DVB), 0 if not in sync yet
+func (mg *ManifestGenerator) GetInputPacketSize() int {
+	return mg.inputPacketSize
+}
+
+// resync Looks for syncLockPackets consecutive sync bytes in the data received out of sync, detecting the packet size
+// It returns the data from the sync, nil if not locked yet (the data that can still contain the sync is kept)
+func (mg *ManifestGenerator) resync(buf []byte) []byte {
+	mg.syncBuf = append(mg.syncBuf, buf...)
+
+	start, packetSize, locked := tspacket.DetectSync(mg.syncBuf, mg.options.syncLockPackets)
+	if start < 0 {
+		start = len(mg.syncBuf)
+	}
+	if !locked && mg.isStreamStartPacket() {
+		packetSize = tspacket.TsDefaultPacketSize
+		locked = true
+	}
+	if start > 0 {
+		mg.options.log.Debug("Discarded ", start, " bytes looking for the TS sync")
+		if mg.analyzer != nil {
+			mg.analyzer.AddSkippedBytes(start)
+		}
+	}
+
+	if !locked {
+		mg.syncBuf = append(mg.syncBuf[:0], mg.syncBuf[start:]...)
+		return nil
+	}
+
+	if packetSize != mg.inputPacketSize {
+		mg.options.log.Info("Detected input packet size: ", packetSize)
+	}
+	mg.inputPacketSize = packetSize
+	mg.inputPacket = mg.inputPacket[:0]
+	mg.isInSync = true
+	ret := mg.syncBuf[start:]
+	mg.syncBuf = nil
+
+	return ret
+}
+
+// isStreamStartPacket The stream is expected to start with a packet, a 188 bytes packet is trusted if the data received does not contradict it (not enough data to confirm it)
+func (mg *ManifestGenerator) isStreamStartPacket() bool {
+	if mg.processedPackets > 0 || mg.syncLosses > 0 || len(mg.syncBuf) < tspacket.TsDefaultPacketSize {
+		return false
+	}
+
+	pos, locked := tspacket.FindSync(mg.syncBuf, tspacket.TsDefaultPacketSize, mg.options.syncLockPackets)
+	return pos == 0 && !locked
+}
+
+// syncLost The packet does not start with the sync byte, the sync is searched again from the next byte
+func (mg *ManifestGenerator) syncLost() {
+	mg.isInSync = false
+	mg.syncLosses++
+	mg.options.log.Warn("Lost TS sync after ", mg.processedPackets, " packets. Total sync losses: ", mg.syncLosses)
+	if mg.analyzer != nil {
+		mg.analyzer.AddSyncLoss()
 	}
 
-	return buf[start:]
+	mg.syncBuf = append(mg.syncBuf[:0], mg.inputPacket[1:]...)
+	mg.inputPacket = mg.inputPacket[:0]
+	mg.tsPacket.Reset()
+}
+
+// getM2TSHeader Returns the M2TS header of the current packet if it has to be kept in the chunks, nil otherwise
+func (mg *ManifestGenerator) getM2TSHeader() []byte {
+	if !mg.options.keepM2TSTimestamps || mg.options.encryption.Method == encryption.MethodSampleAES {
+		return nil
+	}
+	if mg.inputPacketSize != tspacket.TsM2TSPacketSize || len(mg.inputPacket) < tspacket.M2TSHeaderSize {
+		return nil
+	}
+	return mg.inputPacket[:tspacket.M2TSHeaderSize]
+}
+
+// addPacketsToChunk Adds TS packets to the chunk, with the M2TS header of the current packet if needed
+func (mg *ManifestGenerator) addPacketsToChunk(chunk *mediachunk.Chunk, packets []byte) error {
+	header := mg.getM2TSHeader()
+	if header == nil {
+		return chunk.AddData(packets)
+	}
+
+	buf := make([]byte, 0, len(packets)/tspacket.TsDefaultPacketSize*tspacket.TsM2TSPacketSize)
+	for pos := 0; pos+tspacket.TsDefaultPacketSize <= len(packets); pos += tspacket.TsDefaultPacketSize {
+		buf = append(buf, header...)
+		buf = append(buf, packets[pos:pos+tspacket.TsDefaultPacketSize]...)
+	}
+	return chunk.AddData(buf)
 }
 
 func min(a, b int) int {
@@ -251,15 +613,19 @@ func (mg *ManifestGenerator) isSavingMediaPacket() bool {
 		}
 	}
 
-	return ret
+	return ret && mg.isEncryptionReady()
 }
 
-func (mg *ManifestGenerator) saveInitPacket(tableType packetTableTypes) bool {
+func (mg *ManifestGenerator) saveInitPacket(tableType packetTableTypes, packet *tspacket.TsPacket) bool {
+	if !mg.isEncryptionReady() {
+		return false
+	}
+
 	if mg.options.chunkInitType == ChunkInit {
-		return mg.addPacketToInitChunk(tableType)
+		return mg.addPacketToInitChunk(tableType, packet)
 	} else if mg.options.chunkInitType == ChunkInitStart {
 		if tableType == PatTable || tableType == PmtTable {
-			return mg.saveInitChunkPacket(tableType)
+			return mg.saveInitChunkPacket(tableType, packet)
 		}
 
 		return false
@@ -269,24 +635,54 @@ func (mg *ManifestGenerator) saveInitPacket(tableType packetTableTypes) bool {
 }
 
 func (mg *ManifestGenerator) processPacket(forceChunk bool) bool {
-	if !mg.tsPacket.Parse(mg.detectedPMTID) {
+	if !mg.tsPacket.Parse(mg.detectedPMTID, mg.detectedProgramNumber) {
 		return false
 	}
 
+	isDuplicate := mg.checkContinuity()
+	if mg.analyzer != nil {
+		mg.analyzer.AddPacket(&mg.tsPacket, mg.inputPacketSize)
+	}
+	if isDuplicate {
+		mg.debugPacket("SKIPPED DUPLICATED PACKET: ")
+		return true
+	}
+
+	if psiErrors := mg.tsPacket.GetPSIErrors(); psiErrors != mg.psiErrors {
+		mg.options.log.Warn("Rejected PSI section (bad length, syntax or CRC) in PID ", mg.tsPacket.GetPID(), ". Total rejected: ", psiErrors)
+		mg.psiErrors = psiErrors
+	}
+
 	// Detect video & audio PIDs
 	if mg.options.autoPIDs {
-		pmtID := mg.tsPacket.GetPATdata()
+		pmtID, programNumber := mg.getProgramPMTPID()
+		if pmtID >= 0 && mg.detectedPMTID >= 0 && pmtID != mg.detectedPMTID {
+			if !mg.restartInit("PMT PID changed from " + strconv.Itoa(mg.detectedPMTID) + " to " + strconv.Itoa(pmtID)) {
+				pmtID = -1
+			}
+		}
 		if pmtID >= 0 {
 			mg.detectedPMTID = pmtID
+			mg.detectedProgramNumber = programNumber
+			mg.tsLastPATPacket.CopyFrom(&mg.tsPacket)
 
 			// Save PAT
-			mg.saveInitPacket(PatTable)
+			mg.saveInitPacket(PatTable, &mg.tsPacket)
 
 			mg.options.log.Debug("Detected PAT. PMT ID: ", pmtID)
 		}
 
 		valid, Videoh264, AudioADTS, Other := mg.tsPacket.GetPMTdata()
+		isPMTUpdate := valid && mg.pmtVersion >= 0 && mg.tsPacket.GetPMTVersion() != mg.pmtVersion
+		if isPMTUpdate {
+			if !mg.restartInit("PMT version changed from " + strconv.Itoa(mg.pmtVersion) + " to " + strconv.Itoa(mg.tsPacket.GetPMTVersion())) {
+				valid = false
+			}
+		}
 		if valid {
+			mg.pmtVersion = mg.tsPacket.GetPMTVersion()
+			mg.pmtStreams = append([]tspacket.PMTStream(nil), mg.tsPacket.GetPMTStreams()...)
+
 			if len(Videoh264) > 0 {
 				mg.options.videoPID = int(Videoh264[0])
 			}
@@ -294,10 +690,15 @@ func (mg *ManifestGenerator) processPacket(forceChunk bool) bool {
 				mg.options.audioPID = int(AudioADTS[0])
 			}
 
+			if isPMTUpdate {
+				// The new init data starts with the last PAT received
+				mg.saveInitPacket(PatTable, &mg.tsLastPATPacket)
+			}
+
 			// Save PMT
-			mg.saveInitPacket(PmtTable)
+			mg.saveInitPacket(PmtTable, &mg.tsPacket)
 
-			mg.options.log.Debug("Detected PMT. VideoIDs: ", Videoh264, "AudiosIDs: ", AudioADTS, "Other: ", Other)
+			mg.options.log.Debug("Detected PMT. VideoIDs: ", Videoh264, "AudiosIDs: ", AudioADTS, "Other: ", Other, "Streams: ", mg.pmtStreams)
 		}
 	}
 
@@ -307,10 +708,11 @@ func (mg *ManifestGenerator) processPacket(forceChunk bool) bool {
 			// Detect if we need to chunk it
 			// It will chunk if detect an IDR point with PCR data
 			if mg.tsPacket.IsRandomAccess(mg.options.videoPID) == true {
-				mg.options.log.Debug("VIDEO: ", mg.tsPacket.String())
+				mg.debugPacket("VIDEO: ")
 				pcrS := mg.tsPacket.GetPCRS()
 				if pcrS >= 0 {
 					mg.lastPCRS = pcrS
+					mg.checkGOPDuration(pcrS)
 
 					if mg.chunkStartTimeS < 0 && pcrS >= 0 {
 						mg.chunkStartTimeS = pcrS
@@ -322,33 +724,46 @@ func (mg *ManifestGenerator) processPacket(forceChunk bool) bool {
 						mg.chunkStartTimeS = nextInitialPCRS
 					}
 				}
+			} else {
+				mg.checkForcedCut()
 			}
+			mg.trackIFrame()
 			mg.addPacketToChunk()
 
 		} else {
-			mg.options.log.Debug("SKIPPED VIDEO PACKET, not init: ", mg.tsPacket.String())
+			mg.debugPacket("SKIPPED VIDEO PACKET, not init: ")
 		}
 	} else if pID == mg.options.audioPID {
+		if mg.audioConfig == nil && mg.options.encryption.Method == encryption.MethodSampleAES {
+			mg.audioConfig = encryption.GetAudioSpecificConfig(mg.tsPacket.GetBuffer())
+		}
 		if mg.isSavingMediaPacket() {
 			mg.addPacketToChunk()
-			mg.options.log.Debug("AUDIO: ", mg.tsPacket.String())
+			mg.debugPacket("AUDIO: ")
 		} else {
-			mg.options.log.Debug("SKIPPED AUDIO PACKET, not init: ", mg.tsPacket.String())
+			mg.debugPacket("SKIPPED AUDIO PACKET, not init: ")
 		}
 	} else if pID >= 0 {
-		mg.options.log.Debug("OTHER: ", mg.tsPacket.String())
+		mg.debugPacket("OTHER: ")
 	} else {
-		fmt.Println("OUT OF SYNC!!!")
+		mg.options.log.Warn("Invalid TS packet, out of sync")
 		return false
 	}
 
 	return true
 }
 
+// debugPacket Logs the current packet, the packet string is only generated if debug logging is enabled (it allocates)
+func (mg *ManifestGenerator) debugPacket(msg string) {
+	if mg.options.log.IsLevelEnabled(logrus.DebugLevel) {
+		mg.options.log.Debug(msg, mg.tsPacket.String())
+	}
+}
+
 func (mg *ManifestGenerator) addPacketToChunk() {
 
 	if mg.currentChunks == nil {
-		mg.createChunk(false)
+		mg.createChunk(false, mg.chunkStartTimeS)
 	}
 
 	if len(mg.currentChunks) > 0 {
@@ -357,32 +772,37 @@ func (mg *ManifestGenerator) addPacketToChunk() {
 		if mg.options.chunkInitType == ChunkInitStart && mg.currentChunks[0].IsEmpty() {
 			// Save PAT and PMT first if available
 			if mg.initState == InitsavedPMT {
-				mg.currentChunks[0].AddData(mg.tsInitPATPacket.GetBuffer())
-				mg.currentChunks[0].AddData(mg.tsInitPMTPacket.GetBuffer())
+				err := mg.addInitPSIToChunk(&mg.currentChunks[0], mg.tsInitPATPacket.GetPSIBuffer())
+				if err == nil {
+					err = mg.addInitPSIToChunk(&mg.currentChunks[0], mg.tsInitPMTPacket.GetPSIBuffer())
+				}
+				if err != nil {
+					panic(err)
+				}
 			}
 		}
 
-		err := mg.currentChunks[0].AddData(mg.tsPacket.GetBuffer())
+		err := mg.addPacketsToChunk(&mg.currentChunks[0], mg.tsPacket.GetBuffer())
 		if err != nil {
 			panic(err)
 		}
 	}
 }
 
-func (mg *ManifestGenerator) saveInitChunkPacket(tableType packetTableTypes) bool {
+func (mg *ManifestGenerator) saveInitChunkPacket(tableType packetTableTypes, packet *tspacket.TsPacket) bool {
 	ret := false
 
 	if tableType == PatTable {
 		if mg.initState == InitNotIni {
 			// Save PAT
-			mg.tsInitPATPacket = tspacket.CloneFrom(mg.tsPacket)
+			mg.tsInitPATPacket = tspacket.CloneFrom(*packet)
 			mg.initState = InitsavedPAT
 			ret = true
 		}
 	} else if tableType == PmtTable {
 		if mg.initState == InitsavedPAT {
 			// Save PMT
-			mg.tsInitPMTPacket = tspacket.CloneFrom(mg.tsPacket)
+			mg.tsInitPMTPacket = tspacket.CloneFrom(*packet)
 			mg.initState = InitsavedPMT
 			ret = true
 		}
@@ -391,15 +811,15 @@ func (mg *ManifestGenerator) saveInitChunkPacket(tableType packetTableTypes) boo
 	return ret
 }
 
-func (mg *ManifestGenerator) addPacketToInitChunk(tableType packetTableTypes) bool {
+func (mg *ManifestGenerator) addPacketToInitChunk(tableType packetTableTypes, packet *tspacket.TsPacket) bool {
 	ret := false
 	saveData := false
 
 	if tableType == PatTable {
-		if mg.initState == InitNotIni { // We only save the 1st PAT PMT appeareance, so no dynamic updates are allowed
+		if mg.initState == InitNotIni { // We only save the 1st PAT PMT appeareance, the updates restart the init (see restartInit)
 			if mg.initChunk == nil {
 				// Create init chunk
-				mg.createChunk(true)
+				mg.createChunk(true, mg.chunkStartTimeS)
 			}
 			saveData = true
 		}
@@ -410,7 +830,7 @@ func (mg *ManifestGenerator) addPacketToInitChunk(tableType packetTableTypes) bo
 	}
 
 	if saveData {
-		err := mg.initChunk.AddData(mg.tsPacket.GetBuffer())
+		err := mg.addPacketsToChunk(mg.initChunk, packet.GetPSIBuffer())
 		if err != nil {
 			panic(err)
 		}
@@ -429,15 +849,174 @@ func (mg *ManifestGenerator) addPacketToInitChunk(tableType packetTableTypes) bo
 	return ret
 }
 
+// restartInit The stream changed (PIDs, codecs): closes the current chunk and saves the next PAT and PMT as new init data
+// The next chunk starts with a discontinuity and uses the new init chunk (EXT-X-MAP)
+// Returns false if the change can not be applied (LHLS), then the current PIDs and init data have to be kept
+func (mg *ManifestGenerator) restartInit(reason string) bool {
+	if mg.options.lhlsAdvancedChunks > 0 {
+		// The advanced chunks are already in the chunklist with the current init data
+		if reason != mg.ignoredStreamChange {
+			mg.options.log.Warn("Stream change ignored in LHLS mode, keeping the current streams: ", reason)
+			mg.ignoredStreamChange = reason
+		}
+		return false
+	}
+
+	mg.options.log.Warn("Stream change, restarting init data with discontinuity: ", reason)
+
+	if len(mg.currentChunks) > 0 {
+		mg.closeChunk(false, getElapsedS(mg.chunkStartTimeS, mg.lastVideoPCRS), false)
+		mg.saveState()
+	}
+	mg.currentChunks = nil
+	mg.chunkStartTimeS = -1
+	mg.lastIDRPCRS = -1
+	mg.nextChunkIsDisco = true
+
+	mg.initState = InitNotIni
+	mg.initChunkIndex++
+	mg.pmtVersion = -1
+	mg.options.videoPID = -1
+	mg.options.audioPID = -1
+	mg.audioConfig = nil
+
+	return true
+}
+
 func (mg *ManifestGenerator) hlsClose() {
-	mg.hlsChunklist.CloseManifest(true)
+	err := mg.hlsChunklist.CloseManifest(true)
+	if err == nil && mg.hlsIFrames != nil {
+		err = mg.hlsIFrames.CloseManifest(true)
+	}
+	if err != nil {
+		mg.options.log.Error("Error closing / saving the chunklists. Err: ", err)
+		mg.addDeliveryError(err)
+	}
 }
 
-func (mg *ManifestGenerator) hlsAddChunk(isGrowing bool, fileName string, durationS float64, isDisco bool) {
+func (mg *ManifestGenerator) hlsAddChunk(chunk hls.Chunk) {
 
-	err := mg.hlsChunklist.AddChunk(hls.Chunk{IsGrowing: isGrowing, FileName: fileName, DurationS: durationS, IsDisco: isDisco}, true)
+	err := mg.hlsChunklist.AddChunk(chunk, true)
 	if err != nil {
 		mg.options.log.Error("Error generating / saving the chunklists. Err: ", err)
+		mg.addDeliveryError(err)
+	}
+}
+
+func (mg *ManifestGenerator) hlsAddClosedChunk(chunk *mediachunk.Chunk, durationS float64, deliveryErr error, startTimeS float64) {
+	isNotIndependent := mg.chunkIsNotIndependent
+	mg.chunkIsNotIndependent = false
+
+	if deliveryErr != nil && mg.options.failedSegmentPolicy == FailedSegmentSkip {
+		mg.options.log.Warn("Skipping failed chunk from the chunklist: ", chunk.GetFilename())
+		mg.nextChunkIsDisco = true
+		mg.currentIFrames = nil
+		return
+	}
+
+	isGap := deliveryErr != nil && mg.options.failedSegmentPolicy == FailedSegmentGap
+	programDateTime := mg.getProgramDateTime(startTimeS, chunk.GetCreatedAt(), mg.nextChunkIsDisco)
+	mg.hlsAddIFrames(chunk, startTimeS, durationS, mg.nextChunkIsDisco, isGap, programDateTime)
+
+	byteRangeOffset, byteRangeLength := chunk.GetByteRange()
+	mg.hlsAddChunk(hls.Chunk{
+		IsGrowing:        false,
+		FileName:         chunk.GetFilename(),
+		DurationS:        durationS,
+		IsDisco:          mg.nextChunkIsDisco,
+		IsGap:            isGap,
+		ProgramDateTime:  programDateTime,
+		ByteRangeOffset:  byteRangeOffset,
+		ByteRangeLength:  byteRangeLength,
+		Key:              mg.chunkKeys[chunk.GetIndex()],
+		IsNotIndependent: isNotIndependent,
+	})
+	mg.nextChunkIsDisco = false
+}
+
+// getProgramDateTime Returns the wall clock time of a chunk start (zero if disabled)
+// The PCR is mapped to wall clock at the 1st chunk and after every discontinuity
+func (mg *ManifestGenerator) getProgramDateTime(startTimeS float64, createdAt time.Time, isDisco bool) time.Time {
+	if !mg.options.programDateTime {
+		return time.Time{}
+	}
+
+	if mg.pdtRefTime.IsZero() && !mg.options.pdtReference.IsZero() {
+		// Keep the offset between the reference and the wall clock for the next mappings
+		mg.pdtRefOffset = mg.options.pdtReference.Sub(createdAt)
+	}
+	if startTimeS < 0 {
+		// Start PCR unknown
+		return createdAt.Add(mg.pdtRefOffset)
+	}
+
+	if mg.pdtRefTime.IsZero() || isDisco {
+		mg.pdtRefPCRS = startTimeS
+		mg.pdtRefTime = createdAt.Add(mg.pdtRefOffset)
+	}
+
+	elapsedS := startTimeS - mg.pdtRefPCRS
+	if elapsedS < 0 {
+		// PCR rollover
+		elapsedS += tspacket.MaxPCRSValue
+	}
+
+	return mg.pdtRefTime.Add(time.Duration(elapsedS * float64(time.Second)))
+}
+
+func (mg *ManifestGenerator) addDeliveryError(err error) {
+	if mg.deliveryErr == nil {
+		mg.deliveryErr = err
+	}
+}
+
+func (mg *ManifestGenerator) reportDelivery(result SegmentDeliveryResult) {
+	if result.Err != nil {
+		mg.addDeliveryError(result.Err)
+	}
+
+	if mg.options.deliveryCallback != nil {
+		mg.options.deliveryCallback(result)
+	}
+}
+
+// closeMediaChunk Closes the chunk and reports its delivery result.
+// It returns the delivery error, always nil if the result will be known later (async upload)
+func (mg *ManifestGenerator) closeMediaChunk(chunk *mediachunk.Chunk, durationS float64, isInit bool) error {
+	result := SegmentDeliveryResult{FileName: chunk.GetFilename(), Index: chunk.GetIndex(), DurationS: durationS, IsInit: isInit, Err: nil}
+
+	if chunk.IsUploadAsync() {
+		asyncResults := mg.asyncResults
+		chunk.SetOnUploadDone(func(err error) {
+			asyncResult := result
+			asyncResult.Err = err
+			asyncResults.add(asyncResult)
+		})
+
+		// The result (even if the job is rejected) is reported by the callback
+		chunk.Close(durationS)
+		return nil
+	}
+
+	result.Err = chunk.Close(durationS)
+	mg.reportDelivery(result)
+
+	return result.Err
+}
+
+// processAsyncDeliveries Reports the delivery results received from the upload queue
+func (mg *ManifestGenerator) processAsyncDeliveries() {
+	for _, result := range mg.asyncResults.popAll() {
+		mg.reportDelivery(result)
+
+		// The chunk is already in the chunklist, the best we can do is mark it as gap
+		if result.Err != nil && !result.IsInit && mg.options.failedSegmentPolicy != FailedSegmentList {
+			err := mg.hlsChunklist.SetChunkGap(result.FileName)
+			if err != nil {
+				mg.options.log.Error("Error generating / saving the chunklists. Err: ", err)
+				mg.addDeliveryError(err)
+			}
+		}
 	}
 }
 
@@ -448,17 +1027,24 @@ func (mg *ManifestGenerator) closeChunk(isInit bool, chunkDurationS float64, isF
 		if mg.currentChunks != nil && len(mg.currentChunks) > 0 {
 			currentChunk := mg.currentChunks[0]
 
-			currentChunk.Close(chunkDurationS)
+			err := mg.closeMediaChunk(&currentChunk, chunkDurationS, false)
 
 			//NO LHLS
 			if mg.options.lhlsAdvancedChunks <= 0 {
-				mg.hlsAddChunk(false, currentChunk.GetFilename(), chunkDurationS, false)
+				mg.hlsAddClosedChunk(&currentChunk, chunkDurationS, err, mg.chunkStartTimeS)
 				if mg.options.manifestType == hls.Vod {
 					if isFinalChunk {
 						mg.hlsClose()
 					}
 				}
+			} else {
+				// LHLS chunks are advertised with the target duration before they are created
+				if chunkDurationS-hls.TargetDurationToleranceS > float64(mg.hlsChunklist.GetTargetDuration()) {
+					mg.options.log.Warn("LHLS chunk ", currentChunk.GetFilename(), " duration ", chunkDurationS, "s exceeds the advertised target duration ", mg.hlsChunklist.GetTargetDuration(), "s")
+				}
+				mg.hlsAddIFrames(&currentChunk, mg.chunkStartTimeS, chunkDurationS, false, false, time.Time{})
 			}
+			delete(mg.chunkKeys, currentChunk.GetIndex())
 
 			if len(mg.currentChunks) > 1 {
 				// Remove 1st element
@@ -472,13 +1058,20 @@ func (mg *ManifestGenerator) closeChunk(isInit bool, chunkDurationS float64, isF
 		}
 	} else {
 		if mg.initChunk != nil {
-			mg.initChunk.Close(-1)
+			mg.closeMediaChunk(mg.initChunk, -1, true)
 
 			mg.hlsChunklist.SetInitChunk(mg.initChunk.GetFilename())
+			mg.hlsChunklist.SetInitChunkByteRange(mg.initChunk.GetByteRange())
 
 			// We need to update version 7 for map chunks
 			mg.hlsChunklist.SetHlsVersion(7)
 
+			if mg.hlsIFrames != nil {
+				mg.hlsIFrames.SetInitChunk(mg.initChunk.GetFilename())
+				mg.hlsIFrames.SetInitChunkByteRange(mg.initChunk.GetByteRange())
+				mg.hlsIFrames.SetHlsVersion(7)
+			}
+
 			mg.initChunk = nil
 		}
 	}
@@ -486,7 +1079,34 @@ func (mg *ManifestGenerator) closeChunk(isInit bool, chunkDurationS float64, isF
 	return
 }
 
-func (mg *ManifestGenerator) createChunk(isInit bool) {
+// getSingleFile Returns the file where all the chunks are appended, it is created with the 1st chunk
+// Name: base path + chunks template (with number 0) or chunks base filename (without trailing "_") + extension
+// If it can not be created it is retried with the next chunk
+func (mg *ManifestGenerator) getSingleFile() (*mediachunk.SingleFile, error) {
+	if mg.options.chunkOutputType != mediachunk.ChunkOutputModeFileSingle {
+		return nil, nil
+	}
+
+	if mg.singleFile == nil {
+		fileName := strings.TrimSuffix(mg.options.chunkBaseFilename, "_") + ChunkFileExtensionDefault
+		if mg.options.naming.ChunkTemplate != "" {
+			fileName = mediachunk.ExpandTemplate(mg.options.naming.ChunkTemplate, mediachunk.TemplateVars{Number: 0, Time: 0, WallClock: time.Now(), Rendition: mg.options.naming.RenditionName})
+		}
+
+		singleFile, err := mediachunk.NewSingleFile(path.Join(mg.options.baseOutPath, fileName), mg.options.fileSync)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating single file %s. Err: %v", fileName, err)
+		}
+		mg.singleFile = singleFile
+
+		// Needed for EXT-X-BYTERANGE
+		mg.hlsChunklist.SetHlsVersion(4)
+	}
+
+	return mg.singleFile, nil
+}
+
+func (mg *ManifestGenerator) createChunk(isInit bool, startTimeS float64) {
 	// Close current
 	if isInit {
 		chunkInitOptions := mediachunk.Options{
@@ -501,15 +1121,16 @@ func (mg *ManifestGenerator) createChunk(isInit bool) {
 			ChunkBaseFilename:  ChunkInitFileName,
 			HTTPUploader:       mg.options.httpUploader,
 			S3Uploader:         mg.options.s3Uploader,
+			FileSync:           mg.options.fileSync,
+			UploadQueue:        mg.options.uploadQueue,
+			FilenameTemplate:   mg.options.naming.InitTemplate,
+			RenditionName:      mg.options.naming.RenditionName,
+			TimeSource:         mg.options.naming.TimeSource,
+			StartPTS:           mg.chunkStartPTS,
 		}
 
-		newChunk := mediachunk.New(0, chunkInitOptions)
+		newChunk := mg.newChunk(mg.initChunkIndex, chunkInitOptions, true)
 		mg.initChunk = &newChunk
-
-		err := mg.initChunk.InitializeChunk()
-		if err != nil {
-			panic(err)
-		}
 	} else {
 		chunksToCreate := 1
 		if mg.fistChunkCreated == false && mg.options.lhlsAdvancedChunks > 0 {
@@ -517,6 +1138,9 @@ func (mg *ManifestGenerator) createChunk(isInit bool) {
 			mg.fistChunkCreated = true
 		}
 
+		// The chunk is created with its 1st packet
+		mg.chunkStartPTS = mg.tsPacket.GetPTS()
+
 		n := 0
 		for n < chunksToCreate {
 			chunkOptions := mediachunk.Options{
@@ -530,22 +1154,36 @@ func (mg *ManifestGenerator) createChunk(isInit bool) {
 				BasePath:           mg.options.baseOutPath,
 				ChunkBaseFilename:  mg.options.chunkBaseFilename,
 				HTTPUploader:       mg.options.httpUploader,
-				S3Uploader:         mg.options.s3Uploader}
+				S3Uploader:         mg.options.s3Uploader,
+				FileSync:           mg.options.fileSync,
+				UploadQueue:        mg.options.uploadQueue,
+				FilenameTemplate:   mg.options.naming.ChunkTemplate,
+				RenditionName:      mg.options.naming.RenditionName,
+				TimeSource:         mg.options.naming.TimeSource,
+				StartPTS:           -1}
+
+			// Advanced chunks (LHLS) start time is estimated
+			chunkStartTimeS := -1.0
+			if startTimeS >= 0 {
+				chunkStartTimeS = startTimeS + float64(len(mg.currentChunks))*mg.options.targetSegmentDurS
+			}
+			if mg.chunkStartPTS >= 0 {
+				estimatedDurationTicks := int64(float64(len(mg.currentChunks)) * mg.options.targetSegmentDurS * mediachunk.TemplateTimescale)
+				chunkOptions.StartPTS = (mg.chunkStartPTS + estimatedDurationTicks) % tspacket.MaxPTSValue
+			}
 
 			if mg.options.lhlsAdvancedChunks > 0 {
 				chunkOptions.LHLS = true
 			}
 
-			newChunk := mediachunk.New(mg.currentChunkIndex+uint64(len(mg.currentChunks)), chunkOptions)
-
-			err := newChunk.InitializeChunk()
-			if err != nil {
-				panic(err)
-			}
+			chunkIndex := mg.currentChunkIndex + uint64(len(mg.currentChunks))
+			newChunk := mg.newChunk(chunkIndex, chunkOptions, false)
 
 			// Add the advanced chunk to the manifest with target dur
 			if mg.options.lhlsAdvancedChunks > 0 {
-				mg.hlsAddChunk(true, newChunk.GetFilename(), mg.options.targetSegmentDurS, false)
+				programDateTime := mg.getProgramDateTime(chunkStartTimeS, newChunk.GetCreatedAt(), mg.nextChunkIsDisco)
+				mg.hlsAddChunk(hls.Chunk{IsGrowing: true, FileName: newChunk.GetFilename(), DurationS: mg.options.targetSegmentDurS, IsDisco: mg.nextChunkIsDisco, IsGap: false, ProgramDateTime: programDateTime, Key: mg.chunkKeys[chunkIndex]})
+				mg.nextChunkIsDisco = false
 			}
 
 			mg.currentChunks = append(mg.currentChunks, newChunk)
@@ -556,6 +1194,37 @@ func (mg *ManifestGenerator) createChunk(isInit bool) {
 	return
 }
 
+// newChunk Creates and initializes a chunk, if that fails the chunk is marked as failed (nothing is written)
+func (mg *ManifestGenerator) newChunk(index uint64, options mediachunk.Options, isInit bool) mediachunk.Chunk {
+	singleFile, err := mg.getSingleFile()
+	options.SingleFile = singleFile
+	if err != nil {
+		options.OutputType = mediachunk.ChunkOutputModeNone
+	} else {
+		encryptorIndex := index
+		if isInit {
+			encryptorIndex = 0
+		}
+		options.Encryptor, err = mg.createEncryptor(encryptorIndex, isInit)
+	}
+
+	chunk := mediachunk.New(index, options)
+	if err == nil {
+		err = chunk.InitializeChunk()
+	}
+	if err != nil {
+		mg.failChunk(&chunk, err)
+	}
+
+	return chunk
+}
+
+// failChunk The chunk could not be created, its data is discarded and the error is reported when it is closed (see failedSegmentPolicy)
+func (mg *ManifestGenerator) failChunk(chunk *mediachunk.Chunk, err error) {
+	mg.options.log.Error("Error creating chunk ", chunk.GetFilename(), ". Err: ", err)
+	chunk.SetFailed(err)
+}
+
 // Creates chunk and returns the initial time for the next chunk
 func (mg *ManifestGenerator) nextChunk(currentPCRS float64, lastInitialPCRS float64, maxPCRs float64, isFinalChunk bool) (chunkDurationS float64, nextInitialPCRS float64) {
 	chunkDurationS = -1.0
@@ -573,54 +1242,100 @@ func (mg *ManifestGenerator) nextChunk(currentPCRS float64, lastInitialPCRS floa
 
 	mg.closeChunk(false, chunkDurationS, isFinalChunk)
 	if !isFinalChunk {
-		mg.createChunk(false)
+		mg.createChunk(false, nextInitialPCRS)
 	}
 
+	mg.saveState()
+
 	return
 }
 
 // Close Closes manigest processing saving last data and last chunk
-func (mg *ManifestGenerator) Close() {
+// It returns the 1st delivery error found (if any)
+func (mg *ManifestGenerator) Close() error {
+	// At the end of the stream there can be less packets than needed to lock
+	if !mg.isInSync && len(mg.syncBuf) > 0 {
+		if mg.inputPacketSize == 0 {
+			mg.inputPacketSize = tspacket.TsDefaultPacketSize
+		}
+		offset := tspacket.GetSyncOffset(mg.inputPacketSize)
+		if pos, found := tspacket.FindSync(mg.syncBuf, mg.inputPacketSize, 1); found && pos >= offset {
+			buf := mg.syncBuf[pos-offset:]
+			mg.syncBuf = nil
+			mg.isInSync = true
+			mg.inputPacket = mg.inputPacket[:0]
+			mg.addData(buf)
+		}
+	}
+
 	//Generate last chunk
 	mg.nextChunk(mg.lastPCRS, mg.chunkStartTimeS, tspacket.MaxPCRSValue, true)
+
+	if mg.singleFile != nil {
+		err := mg.singleFile.Close()
+		if err != nil {
+			mg.options.log.Error("Error closing ", mg.singleFile.GetFilename(), ". Err: ", err)
+			mg.addDeliveryError(err)
+		}
+	}
+
+	if mg.options.uploadQueue != nil {
+		mg.options.uploadQueue.Flush()
+		mg.processAsyncDeliveries()
+
+		// Possible chunklist updates
+		mg.options.uploadQueue.Flush()
+	}
+
+	return mg.popDeliveryError()
 }
 
 // AddData current chunk
-func (mg *ManifestGenerator) AddData(buf []byte) {
-	if !mg.isInSync {
-		buf = mg.resync(buf)
+// It returns the 1st delivery error (chunks or chunklist) found while processing this data (if any)
+func (mg *ManifestGenerator) AddData(buf []byte) error {
+	mg.processAsyncDeliveries()
 
-		if len(buf) > 0 {
-			mg.bytesToNextSync = tspacket.TsDefaultPacketSize
-		}
-	}
+	mg.addData(buf)
 
-	if len(buf) > 0 {
-		addedSize := min(len(buf), mg.bytesToNextSync)
-		mg.tsPacket.AddData(buf[:addedSize])
+	return mg.popDeliveryError()
+}
 
-		mg.bytesToNextSync = mg.bytesToNextSync - addedSize
+func (mg *ManifestGenerator) popDeliveryError() error {
+	err := mg.deliveryErr
+	mg.deliveryErr = nil
 
-		buf = buf[addedSize:]
-	}
+	return err
+}
 
-	if mg.bytesToNextSync <= 0 {
-		// Process packet
-		if mg.processPacket(false) == false {
-			mg.isInSync = false
-		} else {
-			mg.bytesToNextSync = tspacket.TsDefaultPacketSize
-			mg.processedPackets++
-			mg.tsPacket.Reset()
+func (mg *ManifestGenerator) addData(buf []byte) {
+	for len(buf) > 0 {
+		if !mg.isInSync {
+			buf = mg.resync(buf)
+			if !mg.isInSync {
+				return
+			}
 		}
-	}
 
-	if len(buf) > 0 {
-		// Still data to process
-		mg.AddData(buf[:])
-	}
+		addedSize := min(len(buf), mg.inputPacketSize-len(mg.inputPacket))
+		mg.inputPacket = append(mg.inputPacket, buf[:addedSize]...)
+		buf = buf[addedSize:]
 
-	return
+		if len(mg.inputPacket) == mg.inputPacketSize {
+			// Process packet, without the M2TS header or the Reed-Solomon bytes
+			offset := tspacket.GetSyncOffset(mg.inputPacketSize)
+			mg.tsPacket.AddData(mg.inputPacket[offset : offset+tspacket.TsDefaultPacketSize])
+			if mg.processPacket(false) == false {
+				// The bytes after the 1st byte of the input packet can contain the sync
+				mg.syncLost()
+				buf = append(mg.syncBuf, buf...)
+				mg.syncBuf = nil
+			} else {
+				mg.processedPackets++
+				mg.tsPacket.Reset()
+				mg.inputPacket = mg.inputPacket[:0]
+			}
+		}
+	}
 }
 
 func (mg ManifestGenerator) getNumProcessedPackets() uint64 {
@@ -2,15 +2,32 @@ package manifestgenerator
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/encryption"
 	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/hls"
 	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/mediachunk"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tspacket"
+	"github.com/jordicenzano/go-ts-segmenter/uploaders/httpuploader"
+	"github.com/jordicenzano/go-ts-segmenter/uploaders/uploadqueue"
+	"github.com/sirupsen/logrus"
 )
 
 func parseHexString(h string) []byte {
@@ -494,3 +511,1313 @@ chunk_00004.ts
 		t.Errorf("Manifest data is different, got %s , expected %s", manifestStr, xpectedmanifestStr)
 	}
 }
+
+func TestManifestGeneratorDeliveryErrorSkipSegment(t *testing.T) {
+	pathResults := "../results/DeliveryErrorSkipSegment"
+	chunklistFile := "chunklist.m3u8"
+	clearResultsDir(pathResults)
+
+	// Server that rejects the 2nd chunk
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		if strings.HasSuffix(req.URL.Path, "chunk_00001.ts") {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		rw.Write([]byte(`OK`))
+	}
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := httpuploader.New(nil, false, u.Scheme, u.Host, 3, 1)
+
+	f, err := os.Open("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+
+	mediaSourceReader := bufio.NewReader(f)
+	buf := make([]byte, 0, 4*1024) //4KB Buffers
+
+	mg := New(nil, mediachunk.ChunkOutputModeHTTPRegular, hls.HlsOutputModeFile, pathResults, "chunk_", chunklistFile, 4.0, ChunkInitStart, true, -1, -1, hls.Vod, 3, 0, &up, nil)
+	mg.SetFailedSegmentPolicy(FailedSegmentSkip)
+
+	results := []SegmentDeliveryResult{}
+	mg.SetSegmentDeliveryCallback(func(result SegmentDeliveryResult) {
+		results = append(results, result)
+	})
+
+	numDeliveryErrors := 0
+	for {
+		n, err := mediaSourceReader.Read(buf[:cap(buf)])
+		buf = buf[:n]
+		if n == 0 {
+			if err == nil {
+				continue
+			}
+			if err == io.EOF {
+				break
+			}
+		} else {
+			if mg.AddData(buf) != nil {
+				numDeliveryErrors++
+			}
+		}
+		// process buf
+		if err != nil && err != io.EOF {
+			panic("Error reading test file")
+		}
+	}
+	if mg.Close() != nil {
+		numDeliveryErrors++
+	}
+
+	if numDeliveryErrors != 1 {
+		t.Errorf("Delivery errors number is incorrect, got: %d, want: %d.", numDeliveryErrors, 1)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("Delivery results number is incorrect, got: %d, want: %d.", len(results), 3)
+	}
+	for i, result := range results {
+		if result.Index != uint64(i) {
+			t.Errorf("Delivery result index is incorrect, got: %d, want: %d.", result.Index, i)
+		}
+		if (result.Err != nil) != (i == 1) {
+			t.Errorf("Delivery result error is incorrect for chunk %d, got: %v", i, result.Err)
+		}
+	}
+
+	// Check HLS chunklist
+	manifestByte, err := ioutil.ReadFile(path.Join(pathResults, chunklistFile))
+	if err != nil {
+		t.Errorf("Error reading HLS chunklist data!, Err: %v", err)
+	}
+
+	manifestStr := string(manifestByte)
+	xpectedmanifestStr := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-DISCONTINUITY-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-TARGETDURATION:4
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXTINF:4.00000000,
+chunk_00000.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:2.00000000,
+chunk_00002.ts
+#EXT-X-ENDLIST
+`
+	if manifestStr != xpectedmanifestStr {
+		t.Errorf("Manifest data is different, got %s , expected %s", manifestStr, xpectedmanifestStr)
+	}
+}
+
+func TestManifestGeneratorUploadQueueOrder(t *testing.T) {
+	pathResults := "../results/UploadQueueOrder"
+	chunklistFile := "chunklist.m3u8"
+
+	var mutex sync.Mutex
+	receivedChunks := map[string]bool{}
+	numChunklists := 0
+
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		fileName := path.Base(req.URL.Path)
+		if fileName != chunklistFile {
+			receivedChunks[fileName] = true
+		} else {
+			numChunklists++
+			// All the referenced chunks must be already uploaded
+			for _, line := range strings.Split(string(body), "\n") {
+				if line != "" && !strings.HasPrefix(line, "#") && !receivedChunks[line] {
+					t.Errorf("Chunklist references a chunk not uploaded yet: %s", line)
+				}
+			}
+		}
+		rw.Write([]byte(`OK`))
+	}
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := httpuploader.New(nil, false, u.Scheme, u.Host, 3, 1)
+	queue := uploadqueue.New(nil, 4, 10, uploadqueue.OverflowBlock)
+
+	buf, err := ioutil.ReadFile("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+
+	mg := New(nil, mediachunk.ChunkOutputModeHTTPRegular, hls.HlsOutputModeHTTP, pathResults, "chunk_", chunklistFile, 4.0, ChunkInitStart, true, -1, -1, hls.Vod, 3, 0, &up, nil)
+	mg.SetUploadQueue(queue)
+
+	numDelivered := 0
+	mg.SetSegmentDeliveryCallback(func(result SegmentDeliveryResult) {
+		if result.Err == nil {
+			numDelivered++
+		}
+	})
+
+	if err := mg.AddData(buf); err != nil {
+		t.Error("Error adding data. Err: ", err)
+	}
+	if err := mg.Close(); err != nil {
+		t.Error("Error closing. Err: ", err)
+	}
+	queue.Close()
+
+	if numDelivered != 3 {
+		t.Errorf("Delivered chunks number is incorrect, got: %d, want: %d.", numDelivered, 3)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(receivedChunks) != 3 || numChunklists != 4 {
+		t.Errorf("Uploads number is incorrect, got: %d chunks and %d chunklists, want: %d chunks and %d chunklists.", len(receivedChunks), numChunklists, 3, 4)
+	}
+}
+
+func TestManifestGeneratorNamingTemplates(t *testing.T) {
+	pathResults := "../results/NamingTemplates"
+	clearResultsDir(pathResults)
+
+	f, err := os.Open("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+
+	mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	err = mg.SetNamingOptions(NamingOptions{
+		ChunkTemplate:     "$Rendition$/media/chunk_$Number%08d$.ts",
+		InitTemplate:      "$Rendition$/media/init_$Rendition$_$Number$.ts",
+		ChunklistTemplate: "$Rendition$/chunklist_$Rendition$.m3u8",
+		RenditionName:     "720p",
+		TimeSource:        mediachunk.TimeSourcePTS,
+	})
+	if err != nil {
+		t.Fatal("Error setting naming options. Err: ", err)
+	}
+
+	mediaSourceReader := bufio.NewReader(f)
+	buf := make([]byte, 4*1024)
+	for {
+		n, err := mediaSourceReader.Read(buf)
+		if n > 0 {
+			mg.AddData(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	mg.Close()
+
+	for _, name := range []string{"init_720p_0.ts", "chunk_00000000.ts", "chunk_00000001.ts", "chunk_00000002.ts"} {
+		if _, err := os.Stat(path.Join(pathResults, "720p", "media", name)); err != nil {
+			t.Error("Error checking file ", name, ". Err: ", err)
+		}
+	}
+
+	chunklist, err := ioutil.ReadFile(path.Join(pathResults, "720p", "chunklist_720p.m3u8"))
+	if err != nil {
+		t.Fatal("Error reading chunklist. Err: ", err)
+	}
+	if !strings.Contains(string(chunklist), "#EXT-X-MAP:URI=\"media/init_720p_0.ts\"\n") || !strings.Contains(string(chunklist), "\nmedia/chunk_00000001.ts\n") {
+		t.Error("Wrong chunk paths in the chunklist: ", string(chunklist))
+	}
+
+	if err := mg.SetNamingOptions(NamingOptions{ChunkTemplate: "chunk_$Unknown$.ts"}); err == nil {
+		t.Error("Expected error for unknown template identifier")
+	}
+	if err := mg.SetNamingOptions(NamingOptions{InitTemplate: "init_$Rendition$.ts"}); err == nil {
+		t.Error("Expected error for init template without number")
+	}
+}
+
+func TestManifestGeneratorNamingTemplateTime(t *testing.T) {
+	pathResults := "../results/NamingTemplateTime"
+	clearResultsDir(pathResults)
+
+	data, err := ioutil.ReadFile("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+
+	// PTS of the video IDRs with PCR (where the chunks are cut)
+	idrPTSs := map[string]bool{}
+	packet := tspacket.New(tspacket.TsDefaultPacketSize)
+	for pos := 0; pos+tspacket.TsDefaultPacketSize <= len(data); pos += tspacket.TsDefaultPacketSize {
+		packet.Reset()
+		packet.AddData(data[pos : pos+tspacket.TsDefaultPacketSize])
+		packet.Parse(-1, -1)
+		if packet.IsRandomAccess(0x100) && packet.GetPCRS() >= 0 && packet.GetPTS() >= 0 {
+			idrPTSs[strconv.FormatInt(packet.GetPTS(), 10)] = true
+		}
+	}
+
+	mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	err = mg.SetNamingOptions(NamingOptions{ChunkTemplate: "chunk_$Number$_$Time$.ts", TimeSource: mediachunk.TimeSourcePTS})
+	if err != nil {
+		t.Fatal("Error setting naming options. Err: ", err)
+	}
+	mg.AddData(data)
+	mg.Close()
+
+	// The 1st chunk starts with the 1st media packet, the rest with an IDR
+	chunks := mg.hlsChunklist.GetState().Chunks
+	if len(chunks) != 3 {
+		t.Fatalf("Wrong number of chunks, got: %d, want: %d", len(chunks), 3)
+	}
+	for _, chunk := range chunks[1:] {
+		parts := strings.Split(strings.TrimSuffix(path.Base(chunk.FileName), ".ts"), "_")
+		if len(parts) != 3 || !idrPTSs[parts[2]] {
+			t.Errorf("Chunk %s time is not the PTS of an IDR, IDR PTSs: %v", chunk.FileName, idrPTSs)
+		}
+	}
+}
+
+func TestManifestGeneratorResumeState(t *testing.T) {
+	pathResults := "../results/ResumeState"
+	clearResultsDir(pathResults)
+	stateFileName := path.Join(pathResults, "state.json")
+
+	// Same input twice simulating a restart
+	for run := 0; run < 2; run++ {
+		f, err := os.Open("../fixture/testSmall.ts")
+		if err != nil {
+			panic("Error opening test file")
+		}
+
+		mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkNoIni, true, -1, -1, hls.LiveWindow, 4, 0, nil, nil)
+		if err := mg.SetStateFile(stateFileName); err != nil {
+			t.Fatal("Error setting state file. Err: ", err)
+		}
+
+		mediaSourceReader := bufio.NewReader(f)
+		buf := make([]byte, 4*1024)
+		for {
+			n, err := mediaSourceReader.Read(buf)
+			if n > 0 {
+				mg.AddData(buf[:n])
+			}
+			if err == io.EOF {
+				break
+			}
+		}
+		mg.Close()
+		f.Close()
+	}
+
+	for _, name := range []string{"chunk_00002.ts", "chunk_00003.ts", "chunk_00005.ts"} {
+		if _, err := os.Stat(path.Join(pathResults, name)); err != nil {
+			t.Error("Error checking file ", name, ". Err: ", err)
+		}
+	}
+
+	chunklist, err := ioutil.ReadFile(path.Join(pathResults, "chunklist.m3u8"))
+	if err != nil {
+		t.Fatal("Error reading chunklist. Err: ", err)
+	}
+	chunklistStr := string(chunklist)
+	if !strings.Contains(chunklistStr, "#EXT-X-MEDIA-SEQUENCE:2\n") {
+		t.Error("Wrong media sequence in the chunklist: ", chunklistStr)
+	}
+	if !strings.Contains(chunklistStr, "chunk_00002.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:") || strings.Count(chunklistStr, "#EXT-X-DISCONTINUITY\n") != 1 {
+		t.Error("Expected one discontinuity after the restart: ", chunklistStr)
+	}
+	if !strings.HasSuffix(chunklistStr, "chunk_00005.ts\n") {
+		t.Error("Wrong last chunk in the chunklist: ", chunklistStr)
+	}
+}
+
+func TestManifestGeneratorResumeStateInit(t *testing.T) {
+	pathResults := "../results/ResumeStateInit"
+	clearResultsDir(pathResults)
+	stateFileName := path.Join(pathResults, "state.json")
+
+	// Same input twice simulating a restart
+	for run := 0; run < 2; run++ {
+		data, err := ioutil.ReadFile("../fixture/testSmall.ts")
+		if err != nil {
+			panic("Error opening test file")
+		}
+
+		mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.LiveWindow, 4, 0, nil, nil)
+		if err := mg.SetStateFile(stateFileName); err != nil {
+			t.Fatal("Error setting state file. Err: ", err)
+		}
+		mg.AddData(data)
+		mg.Close()
+	}
+
+	// The chunks before the restart keep their init chunk
+	for _, name := range []string{"init00000.ts", "init00001.ts"} {
+		if _, err := os.Stat(path.Join(pathResults, name)); err != nil {
+			t.Error("Error checking file ", name, ". Err: ", err)
+		}
+	}
+
+	chunklist, err := ioutil.ReadFile(path.Join(pathResults, "chunklist.m3u8"))
+	if err != nil {
+		t.Fatal("Error reading chunklist. Err: ", err)
+	}
+	chunklistStr := string(chunklist)
+	if !strings.Contains(chunklistStr, "#EXT-X-MAP:URI=\"init00000.ts\"\n") || !strings.Contains(chunklistStr, "#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init00001.ts\"\n") {
+		t.Error("Wrong init chunks in the chunklist: ", chunklistStr)
+	}
+}
+
+func TestManifestGeneratorProgramDateTime(t *testing.T) {
+	pathResults := "../results/ProgramDateTime"
+	clearResultsDir(pathResults)
+
+	f, err := os.Open("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+	defer f.Close()
+
+	mg := New(nil, mediachunk.ChunkOutputModeNone, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkNoIni, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	reference := time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)
+	mg.SetProgramDateTime(true, reference)
+
+	mediaSourceReader := bufio.NewReader(f)
+	buf := make([]byte, 4*1024)
+	for {
+		n, err := mediaSourceReader.Read(buf)
+		if n > 0 {
+			mg.AddData(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	mg.Close()
+
+	// The 1st chunk starts at the reference, the next ones follow the PCR
+	chunks := mg.hlsChunklist.GetState().Chunks
+	if len(chunks) != 3 {
+		t.Fatalf("Wrong number of chunks, got: %d, want: %d", len(chunks), 3)
+	}
+	expectedPDT := reference
+	for _, chunk := range chunks {
+		if chunk.ProgramDateTime.Sub(expectedPDT).Round(time.Millisecond) != 0 {
+			t.Errorf("Wrong program date time for %s, got: %v, want: %v", chunk.FileName, chunk.ProgramDateTime, expectedPDT)
+		}
+		expectedPDT = expectedPDT.Add(time.Duration(chunk.DurationS * float64(time.Second)))
+	}
+
+	chunklist, err := ioutil.ReadFile(path.Join(pathResults, "chunklist.m3u8"))
+	if err != nil || !strings.Contains(string(chunklist), "#EXT-X-PROGRAM-DATE-TIME:2026-10-17T08:00:00.000Z\n") {
+		t.Error("Program date time not found in the chunklist: ", string(chunklist), err)
+	}
+}
+
+func TestManifestGeneratorSingleFileByteRange(t *testing.T) {
+	pathResults := "../results/SingleFileByteRange"
+	clearResultsDir(pathResults)
+
+	f, err := os.Open("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+	defer f.Close()
+
+	mg := New(nil, mediachunk.ChunkOutputModeFileSingle, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+
+	mediaSourceReader := bufio.NewReader(f)
+	buf := make([]byte, 4*1024)
+	for {
+		n, err := mediaSourceReader.Read(buf)
+		if n > 0 {
+			mg.AddData(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if err := mg.Close(); err != nil {
+		t.Error("Error closing. Err: ", err)
+	}
+
+	fi, err := os.Stat(path.Join(pathResults, "chunk.ts"))
+	if err != nil || fi.Size() != 376+103024+108288+114680 {
+		t.Errorf("Wrong single file, got: %v, want %d bytes. Err: %v", fi, 376+103024+108288+114680, err)
+	}
+
+	chunklist, err := ioutil.ReadFile(path.Join(pathResults, "chunklist.m3u8"))
+	if err != nil {
+		t.Fatal("Error reading chunklist. Err: ", err)
+	}
+	expectedLines := []string{
+		"#EXT-X-MAP:URI=\"chunk.ts\",BYTERANGE=\"376@0\"\n",
+		"#EXT-X-BYTERANGE:103024@376\nchunk.ts\n",
+		"#EXT-X-BYTERANGE:108288@103400\nchunk.ts\n",
+		"#EXT-X-BYTERANGE:114680@211688\nchunk.ts\n",
+	}
+	for _, expectedLine := range expectedLines {
+		if !strings.Contains(string(chunklist), expectedLine) {
+			t.Errorf("Expected %q in the chunklist: %s", expectedLine, string(chunklist))
+		}
+	}
+}
+
+func TestManifestGeneratorSingleFileError(t *testing.T) {
+	pathResults := "../results/SingleFileError"
+	clearResultsDir(pathResults)
+
+	f, err := os.Open("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+	defer f.Close()
+
+	// The single file can not be created (a directory with the same name exists)
+	os.MkdirAll(path.Join(pathResults, "chunk.ts"), 0744)
+
+	mg := New(nil, mediachunk.ChunkOutputModeFileSingle, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	mg.SetFailedSegmentPolicy(FailedSegmentSkip)
+
+	numDeliveryErrors := 0
+	mediaSourceReader := bufio.NewReader(f)
+	buf := make([]byte, 4*1024)
+	for {
+		n, err := mediaSourceReader.Read(buf)
+		if n > 0 && mg.AddData(buf[:n]) != nil {
+			numDeliveryErrors++
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if mg.Close() != nil {
+		numDeliveryErrors++
+	}
+
+	if numDeliveryErrors == 0 {
+		t.Error("Expected delivery errors")
+	}
+	if len(mg.hlsChunklist.GetState().Chunks) != 0 {
+		t.Errorf("Wrong number of chunks, got: %d, want: %d", len(mg.hlsChunklist.GetState().Chunks), 0)
+	}
+}
+
+func TestManifestGeneratorIFramePlaylist(t *testing.T) {
+	pathResults := "../results/IFramePlaylist"
+	clearResultsDir(pathResults)
+
+	f, err := os.Open("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+	defer f.Close()
+
+	mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkInitStart, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	if err := mg.SetIFramePlaylist("chunklist_iframes.m3u8"); err != nil {
+		t.Fatal("Error setting the I-frame playlist. Err: ", err)
+	}
+
+	mediaSourceReader := bufio.NewReader(f)
+	buf := make([]byte, 4*1024)
+	for {
+		n, err := mediaSourceReader.Read(buf)
+		if n > 0 {
+			mg.AddData(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	mg.Close()
+
+	chunklist, err := ioutil.ReadFile(path.Join(pathResults, "chunklist_iframes.m3u8"))
+	if err != nil {
+		t.Fatal("Error reading I-frame chunklist. Err: ", err)
+	}
+	if !strings.Contains(string(chunklist), "#EXT-X-I-FRAMES-ONLY\n") || !strings.HasSuffix(string(chunklist), "#EXT-X-ENDLIST\n") {
+		t.Error("Wrong I-frame chunklist: ", string(chunklist))
+	}
+
+	iFrames := mg.hlsIFrames.GetState().Chunks
+	if len(iFrames) < 3 {
+		t.Fatalf("Wrong number of I-frames, got: %d, want at least: %d", len(iFrames), 3)
+	}
+
+	packetSize := int64(tspacket.TsDefaultPacketSize)
+	totalDurationS := 0.0
+	for _, iFrame := range iFrames {
+		totalDurationS += iFrame.DurationS
+
+		data, err := ioutil.ReadFile(iFrame.FileName)
+		if err != nil {
+			t.Fatal("Error reading chunk. Err: ", err)
+		}
+		if iFrame.ByteRangeLength <= 0 || iFrame.ByteRangeOffset+iFrame.ByteRangeLength > int64(len(data)) || iFrame.ByteRangeOffset%packetSize != 0 || iFrame.ByteRangeLength%packetSize != 0 {
+			t.Errorf("Wrong I-frame byte range %d@%d in %s (%d bytes)", iFrame.ByteRangeLength, iFrame.ByteRangeOffset, iFrame.FileName, len(data))
+			continue
+		}
+
+		// The range starts with the chunk PAT or with the IDR packet
+		packet := tspacket.New(tspacket.TsDefaultPacketSize)
+		packet.AddData(data[iFrame.ByteRangeOffset : iFrame.ByteRangeOffset+packetSize])
+		packet.Parse(-1, -1)
+		if !(iFrame.ByteRangeOffset == 0 && packet.GetPID() == 0) && !packet.IsRandomAccess(packet.GetPID()) {
+			t.Errorf("I-frame range %d@%d in %s does not start with PAT or IDR: %s", iFrame.ByteRangeLength, iFrame.ByteRangeOffset, iFrame.FileName, packet.String())
+		}
+	}
+
+	chunksDurationS := 0.0
+	for _, chunk := range mg.hlsChunklist.GetState().Chunks {
+		chunksDurationS += chunk.DurationS
+	}
+	if totalDurationS < chunksDurationS-0.001 {
+		t.Errorf("Wrong I-frames total duration, got: %f, want: %f", totalDurationS, chunksDurationS)
+	}
+}
+
+func TestManifestGeneratorEncryptionAES128(t *testing.T) {
+	pathResults := "../results/EncryptionAES128"
+	clearResultsDir(pathResults)
+
+	f, err := os.Open("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+	defer f.Close()
+
+	pathResultsClear := path.Join(pathResults, "clear")
+	pathResultsEncrypted := path.Join(pathResults, "encrypted")
+	os.MkdirAll(pathResultsClear, 0744)
+	os.MkdirAll(pathResultsEncrypted, 0744)
+
+	mgClear := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResultsClear, "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResultsEncrypted, "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	err = mg.SetEncryption(EncryptionOptions{encryption.MethodAES128, encryption.NewRandomKeyProvider("key_", "https://keys.example.com/"), 2})
+	if err != nil {
+		t.Fatal("Error setting encryption. Err: ", err)
+	}
+
+	mediaSourceReader := bufio.NewReader(f)
+	buf := make([]byte, 4*1024)
+	for {
+		n, err := mediaSourceReader.Read(buf)
+		if n > 0 {
+			mgClear.AddData(buf[:n])
+			mg.AddData(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	mgClear.Close()
+	if err := mg.Close(); err != nil {
+		t.Error("Error closing. Err: ", err)
+	}
+
+	chunklist, err := ioutil.ReadFile(path.Join(pathResultsEncrypted, "chunklist.m3u8"))
+	if err != nil {
+		t.Fatal("Error reading chunklist. Err: ", err)
+	}
+	expectedLines := []string{
+		"#EXT-X-VERSION:7\n",
+		"#EXT-X-MAP:URI=\"init00000.ts\"\n",
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"https://keys.example.com/key_00000.key\",IV=0x00000000000000000000000000000000\n#EXTINF",
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"https://keys.example.com/key_00000.key\",IV=0x00000000000000000000000000000001\n#EXTINF",
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"https://keys.example.com/key_00001.key\",IV=0x00000000000000000000000000000002\n#EXTINF",
+	}
+	for _, expectedLine := range expectedLines {
+		if !strings.Contains(string(chunklist), expectedLine) {
+			t.Errorf("Expected %q in the chunklist: %s", expectedLine, string(chunklist))
+		}
+	}
+
+	initClear, _ := ioutil.ReadFile(path.Join(pathResultsClear, "init00000.ts"))
+	initEncrypted, _ := ioutil.ReadFile(path.Join(pathResultsEncrypted, "init00000.ts"))
+	if len(initClear) == 0 || string(initClear) != string(initEncrypted) {
+		t.Error("The init chunk should not be encrypted")
+	}
+
+	chunks := mgClear.hlsChunklist.GetState().Chunks
+	if len(chunks) != 3 {
+		t.Fatalf("Wrong number of chunks, got: %d, want: %d", len(chunks), 3)
+	}
+	for i, chunk := range chunks {
+		fileName := path.Base(chunk.FileName)
+		clear, _ := ioutil.ReadFile(path.Join(pathResultsClear, fileName))
+		encrypted, _ := ioutil.ReadFile(path.Join(pathResultsEncrypted, fileName))
+		key, err := ioutil.ReadFile(path.Join(pathResultsEncrypted, fmt.Sprintf("key_%05d.key", i/2)))
+		if err != nil || len(key) != encryption.KeySize {
+			t.Fatal("Error reading key. Err: ", err)
+		}
+		if len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 {
+			t.Fatalf("Wrong encrypted chunk %s size %d", fileName, len(encrypted))
+		}
+
+		block, _ := aes.NewCipher(key)
+		iv := make([]byte, aes.BlockSize)
+		iv[15] = byte(i)
+		decrypted := make([]byte, len(encrypted))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+		decrypted = decrypted[:len(decrypted)-int(decrypted[len(decrypted)-1])]
+
+		if string(decrypted) != string(clear) {
+			t.Errorf("Decrypted chunk %s does not match the clear one", fileName)
+		}
+	}
+}
+
+type failingKeyProvider struct {
+	encryption.KeyProvider
+	failKeyIndex uint64
+}
+
+func (p failingKeyProvider) GetKey(keyIndex uint64) (encryption.Key, error) {
+	if keyIndex == p.failKeyIndex {
+		return encryption.Key{}, errors.New("Key server not available")
+	}
+	return p.KeyProvider.GetKey(keyIndex)
+}
+
+func TestManifestGeneratorEncryptionKeyError(t *testing.T) {
+	pathResults := "../results/EncryptionKeyError"
+	clearResultsDir(pathResults)
+
+	f, err := os.Open("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+	defer f.Close()
+
+	mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	mg.SetFailedSegmentPolicy(FailedSegmentSkip)
+	err = mg.SetEncryption(EncryptionOptions{encryption.MethodAES128, failingKeyProvider{encryption.NewRandomKeyProvider("key_", ""), 1}, 1})
+	if err != nil {
+		t.Fatal("Error setting encryption. Err: ", err)
+	}
+
+	numDeliveryErrors := 0
+	mediaSourceReader := bufio.NewReader(f)
+	buf := make([]byte, 4*1024)
+	for {
+		n, err := mediaSourceReader.Read(buf)
+		if n > 0 && mg.AddData(buf[:n]) != nil {
+			numDeliveryErrors++
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if mg.Close() != nil {
+		numDeliveryErrors++
+	}
+
+	if numDeliveryErrors != 1 {
+		t.Errorf("Delivery errors number is incorrect, got: %d, want: %d.", numDeliveryErrors, 1)
+	}
+
+	chunks := mg.hlsChunklist.GetState().Chunks
+	if len(chunks) != 2 {
+		t.Fatalf("Wrong number of chunks, got: %d, want: %d", len(chunks), 2)
+	}
+	for _, chunk := range chunks {
+		if path.Base(chunk.FileName) == "chunk_00001.ts" {
+			t.Error("The chunk without key should not be in the chunklist")
+		}
+	}
+	if _, err := os.Stat(path.Join(pathResults, "chunk_00001.ts")); !os.IsNotExist(err) {
+		t.Error("The chunk without key should not be saved. Err: ", err)
+	}
+}
+
+func TestManifestGeneratorEncryptionOptionsOrder(t *testing.T) {
+	keyProvider := encryption.NewRandomKeyProvider("key_", "")
+
+	// The incompatible options are rejected in any order
+	mg := New(nil, mediachunk.ChunkOutputModeNone, hls.HlsOutputModeNone, "", "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	if err := mg.SetIFramePlaylist("chunklist_iframes.m3u8"); err != nil {
+		t.Fatal("Error setting the I-frame playlist. Err: ", err)
+	}
+	if err := mg.SetEncryption(EncryptionOptions{encryption.MethodAES128, keyProvider, 0}); err == nil {
+		t.Error("Expected error setting encryption with I-frame playlist")
+	}
+
+	mg = New(nil, mediachunk.ChunkOutputModeNone, hls.HlsOutputModeNone, "", "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	if err := mg.SetEncryption(EncryptionOptions{encryption.MethodAES128, keyProvider, 0}); err != nil {
+		t.Fatal("Error setting encryption. Err: ", err)
+	}
+	if err := mg.SetIFramePlaylist("chunklist_iframes.m3u8"); err == nil || mg.hlsIFrames != nil {
+		t.Error("Expected error setting I-frame playlist with encryption")
+	}
+
+	// SAMPLE-AES disables the M2TS timestamps in any order
+	mg = New(nil, mediachunk.ChunkOutputModeNone, hls.HlsOutputModeNone, "", "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	mg.SetKeepM2TSTimestamps(true)
+	if err := mg.SetEncryption(EncryptionOptions{encryption.MethodSampleAES, keyProvider, 0}); err != nil {
+		t.Fatal("Error setting encryption. Err: ", err)
+	}
+	if mg.options.keepM2TSTimestamps {
+		t.Error("M2TS timestamps kept with SAMPLE-AES encryption")
+	}
+}
+
+func TestManifestGeneratorEncryptionSampleAES(t *testing.T) {
+	pathResults := "../results/EncryptionSampleAES"
+	clearResultsDir(pathResults)
+
+	f, err := os.Open("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+	defer f.Close()
+
+	mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	err = mg.SetEncryption(EncryptionOptions{encryption.MethodSampleAES, encryption.NewRandomKeyProvider("key_", ""), 0})
+	if err != nil {
+		t.Fatal("Error setting encryption. Err: ", err)
+	}
+
+	mediaSourceReader := bufio.NewReader(f)
+	buf := make([]byte, 4*1024)
+	for {
+		n, err := mediaSourceReader.Read(buf)
+		if n > 0 {
+			mg.AddData(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if err := mg.Close(); err != nil {
+		t.Error("Error closing. Err: ", err)
+	}
+
+	chunklist, _ := ioutil.ReadFile(path.Join(pathResults, "chunklist.m3u8"))
+	if strings.Count(string(chunklist), "#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"key_00000.key\"") != 3 {
+		t.Errorf("Expected 3 SAMPLE-AES keys in the chunklist: %s", string(chunklist))
+	}
+
+	// The init chunk PMT signals the SAMPLE-AES streams
+	initChunk, _ := ioutil.ReadFile(path.Join(pathResults, "init00000.ts"))
+	if len(initChunk) != 2*tspacket.TsDefaultPacketSize || !strings.Contains(string(initChunk), "zavc") {
+		t.Errorf("Wrong SAMPLE-AES init chunk: %x", initChunk)
+	}
+
+	// The chunks are still valid TS
+	for _, chunk := range mg.hlsChunklist.GetState().Chunks {
+		data, _ := ioutil.ReadFile(chunk.FileName)
+		if len(data) == 0 || len(data)%tspacket.TsDefaultPacketSize != 0 {
+			t.Fatalf("Wrong chunk %s size %d", chunk.FileName, len(data))
+		}
+		for pos := 0; pos < len(data); pos += tspacket.TsDefaultPacketSize {
+			if data[pos] != 0x47 {
+				t.Fatalf("Lost sync in chunk %s at %d", chunk.FileName, pos)
+			}
+		}
+	}
+}
+
+func TestManifestGeneratorMaxSegmentDuration(t *testing.T) {
+	pathResults := "../results/MaxSegmentDuration"
+	clearResultsDir(pathResults)
+
+	f, err := os.Open("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+	defer f.Close()
+
+	mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 1.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	mg.SetMaxSegmentDuration(1.5)
+
+	mediaSourceReader := bufio.NewReader(f)
+	buf := make([]byte, 4*1024)
+	for {
+		n, err := mediaSourceReader.Read(buf)
+		if n > 0 {
+			mg.AddData(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if err := mg.Close(); err != nil {
+		t.Error("Error closing. Err: ", err)
+	}
+
+	gopStats := mg.GetGOPStats()
+	if gopStats.ForcedCuts == 0 || gopStats.MaxGOPDurationS <= 1.5 {
+		t.Fatalf("Expected forced cuts, got: %v", gopStats)
+	}
+
+	chunklist, _ := ioutil.ReadFile(path.Join(pathResults, "chunklist.m3u8"))
+	if strings.Contains(string(chunklist), "#EXT-X-INDEPENDENT-SEGMENTS") || !strings.Contains(string(chunklist), "#EXT-X-TARGETDURATION:2\n") {
+		t.Error("Wrong chunklist with forced cuts: ", string(chunklist))
+	}
+
+	notIndependent := uint64(0)
+	for _, chunk := range mg.hlsChunklist.GetState().Chunks {
+		if chunk.DurationS > 1.5+0.1 {
+			t.Errorf("Chunk %s duration %f longer than the max segment duration", chunk.FileName, chunk.DurationS)
+		}
+		if chunk.IsNotIndependent {
+			notIndependent++
+		}
+
+		// The forced cuts start at a video access unit
+		data, _ := ioutil.ReadFile(chunk.FileName)
+		packet := tspacket.New(tspacket.TsDefaultPacketSize)
+		packet.AddData(data[:tspacket.TsDefaultPacketSize])
+		packet.Parse(-1, -1)
+		if chunk.IsNotIndependent && !packet.IsPayloadUnitStart() {
+			t.Errorf("Chunk %s does not start with an access unit: %s", chunk.FileName, packet.String())
+		}
+	}
+	if notIndependent != gopStats.ForcedCuts {
+		t.Errorf("Wrong not independent chunks, got: %d, want: %d", notIndependent, gopStats.ForcedCuts)
+	}
+}
+
+// createPMTUpdate Returns the stream followed by itself with a new PMT version (PMT PID 0x1000)
+func createPMTUpdate(data []byte) []byte {
+	packetSize := tspacket.TsDefaultPacketSize
+	updated := append([]byte{}, data...)
+	for pos := 0; pos+packetSize <= len(updated); pos += packetSize {
+		packet := updated[pos : pos+packetSize]
+		if (int(packet[1]&0x1F)<<8|int(packet[2])) == 0x1000 && packet[1]&0x40 != 0 {
+			section := 5 + int(packet[4])
+			packet[section+5] = (packet[section+5] & 0xC1) | ((packet[section+5] + 2) & 0x3E)
+			sectionEnd := section + 3 + (int(packet[section+1]&0x0F)<<8 | int(packet[section+2]))
+			crc := tspacket.CRC32MPEG2(packet[section : sectionEnd-4])
+			packet[sectionEnd-4], packet[sectionEnd-3], packet[sectionEnd-2], packet[sectionEnd-1] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+		}
+	}
+
+	return append(append([]byte{}, data...), updated...)
+}
+
+func TestManifestGeneratorPMTUpdate(t *testing.T) {
+	pathResults := "../results/PMTUpdate"
+	clearResultsDir(pathResults)
+
+	data, err := ioutil.ReadFile("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+	packetSize := tspacket.TsDefaultPacketSize
+	data = createPMTUpdate(data)
+
+	mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	for pos := 0; pos < len(data); pos += 4 * 1024 {
+		end := pos + 4*1024
+		if end > len(data) {
+			end = len(data)
+		}
+		mg.AddData(data[pos:end])
+	}
+	if err := mg.Close(); err != nil {
+		t.Error("Error closing. Err: ", err)
+	}
+
+	for _, initFileName := range []string{"init00000.ts", "init00001.ts"} {
+		fi, err := os.Stat(path.Join(pathResults, initFileName))
+		if err != nil || fi.Size() != int64(2*packetSize) {
+			t.Errorf("Wrong init chunk %s: %v. Err: %v", initFileName, fi, err)
+		}
+	}
+
+	chunklist, _ := ioutil.ReadFile(path.Join(pathResults, "chunklist.m3u8"))
+	if strings.Count(string(chunklist), "#EXT-X-MAP:") != 2 || strings.Count(string(chunklist), "#EXT-X-DISCONTINUITY\n") != 1 {
+		t.Fatal("Wrong chunklist after the PMT update: ", string(chunklist))
+	}
+	expectedLines := []string{
+		"#EXT-X-MAP:URI=\"init00000.ts\"\n#EXTINF:4.00000000,\nchunk_00000.ts\n",
+		"chunk_00002.ts\n#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init00001.ts\"\n#EXTINF:4.00000000,\nchunk_00003.ts\n",
+	}
+	for _, expectedLine := range expectedLines {
+		if !strings.Contains(string(chunklist), expectedLine) {
+			t.Errorf("Expected %q in the chunklist: %s", expectedLine, string(chunklist))
+		}
+	}
+}
+
+func TestManifestGeneratorPMTUpdateLHLS(t *testing.T) {
+	pathResults := "../results/PMTUpdateLHLS"
+	clearResultsDir(pathResults)
+
+	data, err := ioutil.ReadFile("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+	data = createPMTUpdate(data)
+
+	mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkInitStart, true, -1, -1, hls.LiveEvent, 3, 3, nil, nil)
+	pmtVersion := -1
+	for pos := 0; pos < len(data); pos += 4 * 1024 {
+		end := pos + 4*1024
+		if end > len(data) {
+			end = len(data)
+		}
+		mg.AddData(data[pos:end])
+		if pmtVersion < 0 {
+			pmtVersion = mg.pmtVersion
+		}
+	}
+	mg.Close()
+
+	// The advanced chunks are already announced, the stream change is not applied
+	if mg.pmtVersion != pmtVersion || mg.initChunkIndex != 0 || mg.options.videoPID != 0x100 || mg.options.audioPID != 0x101 {
+		t.Errorf("Stream change applied in LHLS mode, got PMT version: %d (want %d), init index: %d, video PID: %d, audio PID: %d", mg.pmtVersion, pmtVersion, mg.initChunkIndex, mg.options.videoPID, mg.options.audioPID)
+	}
+
+	chunklist, _ := ioutil.ReadFile(path.Join(pathResults, "chunklist.m3u8"))
+	if strings.Contains(string(chunklist), "#EXT-X-DISCONTINUITY\n") {
+		t.Error("Unexpected discontinuity in LHLS mode: ", string(chunklist))
+	}
+}
+
+// createMPTS Creates a 2 programs TS from a single program one: program 2 is a copy of program 1 with PIDs + 0x800
+func createMPTS(data []byte) []byte {
+	packetSize := tspacket.TsDefaultPacketSize
+	mpts := make([]byte, 0, 2*len(data))
+	for pos := 0; pos+packetSize <= len(data); pos += packetSize {
+		packet := append([]byte{}, data[pos:pos+packetSize]...)
+		pID := int(packet[1]&0x1F)<<8 | int(packet[2])
+
+		if pID == 0 {
+			// PAT with programs 1 (PMT 0x1000) and 2 (PMT 0x1800)
+			section := []byte{0x00, 0xB0, 0x11, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xF0, 0x00, 0x00, 0x02, 0xF8, 0x00}
+			crc := tspacket.CRC32MPEG2(section)
+			section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+			pat := append(append([]byte{}, packet[:4]...), 0)
+			pat = append(pat, section...)
+			for len(pat) < packetSize {
+				pat = append(pat, 0xFF)
+			}
+			mpts = append(mpts, pat...)
+			continue
+		}
+		mpts = append(mpts, packet...)
+
+		program2 := append([]byte{}, packet...)
+		program2[1] = (program2[1] & 0xE0) | byte((pID+0x800)>>8)&0x1F
+		program2[2] = byte(pID + 0x800)
+		if pID == 0x1000 && packet[1]&0x40 != 0 {
+			// PMT: program number, PCR PID and elementary PIDs
+			section := 5 + int(packet[4])
+			sectionEnd := section + 3 + (int(packet[section+1]&0x0F)<<8 | int(packet[section+2]))
+			program2[section+3], program2[section+4] = 0x00, 0x02
+			program2[section+8] += 0x08
+			esPos := section + 12 + (int(packet[section+10]&0x0F)<<8 | int(packet[section+11]))
+			for esPos+5 <= sectionEnd-4 {
+				program2[esPos+1] += 0x08
+				esPos += 5 + (int(packet[esPos+3]&0x0F)<<8 | int(packet[esPos+4]))
+			}
+			crc := tspacket.CRC32MPEG2(program2[section : sectionEnd-4])
+			program2[sectionEnd-4], program2[sectionEnd-3], program2[sectionEnd-2], program2[sectionEnd-1] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+		}
+		mpts = append(mpts, program2...)
+	}
+
+	return mpts
+}
+
+func TestManifestGeneratorMultiProgram(t *testing.T) {
+	pathResults := "../results/MultiProgram"
+	clearResultsDir(pathResults)
+
+	data, err := ioutil.ReadFile("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+	data = createMPTS(data)
+
+	mp := NewMultiProgram(nil, func(programNumber int) (*ManifestGenerator, error) {
+		programPath := path.Join(pathResults, fmt.Sprintf("program_%d", programNumber))
+		os.MkdirAll(programPath, 0744)
+		mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, programPath, "chunk_", "chunklist.m3u8", 4.0, ChunkInit, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+		return &mg, nil
+	})
+	for pos := 0; pos < len(data); pos += 4 * 1024 {
+		end := pos + 4*1024
+		if end > len(data) {
+			end = len(data)
+		}
+		mp.AddData(data[pos:end])
+	}
+	if err := mp.Close(); err != nil {
+		t.Error("Error closing. Err: ", err)
+	}
+
+	if programNumbers := mp.GetProgramNumbers(); len(programNumbers) != 2 || programNumbers[0] != 1 || programNumbers[1] != 2 {
+		t.Fatalf("Wrong programs, got: %v", programNumbers)
+	}
+
+	for programNumber, pIDs := range map[int][]int{1: {0x100, 0x101}, 2: {0x900, 0x901}} {
+		programPath := path.Join(pathResults, fmt.Sprintf("program_%d", programNumber))
+
+		// The init PAT only has the program
+		initChunk, err := ioutil.ReadFile(path.Join(programPath, "init00000.ts"))
+		if err != nil || len(initChunk) != 2*tspacket.TsDefaultPacketSize {
+			t.Fatalf("Wrong init chunk of program %d. Err: %v", programNumber, err)
+		}
+		packet := tspacket.New(tspacket.TsDefaultPacketSize)
+		packet.AddData(initChunk[:tspacket.TsDefaultPacketSize])
+		packet.Parse(-1, -1)
+		if programs := packet.GetPATPrograms(); len(programs) != 1 || programs[0].ProgramNumber != programNumber {
+			t.Errorf("Wrong init PAT of program %d, got: %v", programNumber, programs)
+		}
+
+		mg := mp.GetManifestGenerator(programNumber)
+		video, videoFound := mg.GetStream(pIDs[0])
+		audio, audioFound := mg.GetStream(pIDs[1])
+		if !videoFound || video.Codec != tspacket.CodecH264 || !audioFound || audio.Codec != tspacket.CodecAAC || len(mg.GetPMTStreams()) != 2 {
+			t.Errorf("Wrong PMT streams of program %d, got: %v", programNumber, mg.GetPMTStreams())
+		}
+
+		chunks := mp.GetManifestGenerator(programNumber).hlsChunklist.GetState().Chunks
+		if len(chunks) != 3 {
+			t.Fatalf("Wrong number of chunks of program %d, got: %d, want: %d", programNumber, len(chunks), 3)
+		}
+		for _, chunk := range chunks {
+			chunkData, _ := ioutil.ReadFile(chunk.FileName)
+			for pos := 0; pos+tspacket.TsDefaultPacketSize <= len(chunkData); pos += tspacket.TsDefaultPacketSize {
+				pID := int(chunkData[pos+1]&0x1F)<<8 | int(chunkData[pos+2])
+				if pID != pIDs[0] && pID != pIDs[1] {
+					t.Fatalf("PID %d of other program in %s", pID, chunk.FileName)
+				}
+			}
+		}
+	}
+}
+
+func TestManifestGeneratorContinuity(t *testing.T) {
+	pathResults := "../results/Continuity"
+	clearResultsDir(pathResults)
+
+	data, err := ioutil.ReadFile("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+
+	// Video (0x100): 2 packets lost and 1 duplicated
+	packetSize := tspacket.TsDefaultPacketSize
+	input := make([]byte, 0, len(data)+packetSize)
+	videoPackets := 0
+	for pos := 0; pos+packetSize <= len(data); pos += packetSize {
+		packet := data[pos : pos+packetSize]
+		if (int(packet[1]&0x1F)<<8 | int(packet[2])) == 0x100 {
+			videoPackets++
+			if videoPackets == 100 || videoPackets == 101 {
+				continue
+			}
+			if videoPackets == 200 {
+				input = append(input, packet...)
+			}
+		}
+		input = append(input, packet...)
+	}
+
+	mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkInitStart, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+	mg.SetAnalysis(true)
+	mg.AddData(input)
+	if err := mg.Close(); err != nil {
+		t.Error("Error closing. Err: ", err)
+	}
+
+	// A packet can be duplicated once
+	if report := mg.GetAnalysisReport(); report.Packets != uint64(len(input)/packetSize) || report.Priority1.CCErrors != 1 || report.Priority1.PATErrors != 0 {
+		t.Errorf("Wrong analysis report, got: %+v", report)
+	}
+
+	stats := mg.GetContinuityStats()
+	if video := stats[0x100]; video.Gaps != 1 || video.LostPackets != 2 || video.Duplicates != 1 || video.Packets != uint64(videoPackets-1) {
+		t.Errorf("Wrong video continuity stats, got: %+v", video)
+	}
+	for _, pID := range []int{0, 0x1000, 0x101} {
+		if stats[pID].Packets == 0 || stats[pID].Gaps != 0 || stats[pID].Duplicates != 0 {
+			t.Errorf("Wrong continuity stats of PID %d, got: %+v", pID, stats[pID])
+		}
+	}
+
+	// The PAT and PMT added to the chunks continue the CC of the previous chunk
+	chunks := mg.hlsChunklist.GetState().Chunks
+	if len(chunks) != 3 {
+		t.Fatalf("Wrong number of chunks, got: %d, want: %d", len(chunks), 3)
+	}
+	for i, chunk := range chunks {
+		chunkData, _ := ioutil.ReadFile(chunk.FileName)
+		if len(chunkData) < 2*packetSize {
+			t.Fatalf("Wrong chunk %s", chunk.FileName)
+		}
+		for n, pID := range []int{0, 0x1000} {
+			packet := chunkData[n*packetSize : (n+1)*packetSize]
+			if (int(packet[1]&0x1F)<<8|int(packet[2])) != pID || int(packet[3]&0x0F) != i {
+				t.Errorf("Wrong PSI packet %d of chunk %s, got header: %x", n, chunk.FileName, packet[:4])
+			}
+		}
+
+		// The duplicated packet is not written
+		lastVideoCC := -1
+		for pos := 0; pos+packetSize <= len(chunkData); pos += packetSize {
+			packet := chunkData[pos : pos+packetSize]
+			if (int(packet[1]&0x1F)<<8|int(packet[2])) != 0x100 || packet[3]&0x10 == 0 {
+				continue
+			}
+			if int(packet[3]&0x0F) == lastVideoCC {
+				t.Errorf("Duplicated video packet in chunk %s at %d", chunk.FileName, pos)
+			}
+			lastVideoCC = int(packet[3] & 0x0F)
+		}
+	}
+}
+
+func TestManifestGeneratorResyncFalseSync(t *testing.T) {
+	pathResults := "../results/ResyncFalseSync"
+	clearResultsDir(pathResults)
+
+	data, err := ioutil.ReadFile("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+
+	// Garbage with sync bytes at packet spacing (not enough to lock) in the middle of the stream
+	packetSize := tspacket.TsDefaultPacketSize
+	splitPos := 100 * packetSize
+	garbage := make([]byte, 2*packetSize+50)
+	garbage[10] = 0x47
+	garbage[10+packetSize] = 0x47
+	garbage[30] = 0x47
+
+	input := make([]byte, 0, len(data)+len(garbage))
+	input = append(input, data[:splitPos]...)
+	input = append(input, garbage...)
+	input = append(input, data[splitPos:]...)
+
+	mg := New(nil, mediachunk.ChunkOutputModeNone, hls.HlsOutputModeNone, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkNoIni, false, -1, -1, hls.LiveWindow, 3, 0, nil, nil)
+
+	// Small writes to lock across buffers
+	for pos := 0; pos < len(input); pos += 100 {
+		mg.AddData(input[pos:min(pos+100, len(input))])
+	}
+	mg.Close()
+
+	if mg.GetSyncLosses() != 1 {
+		t.Errorf("Sync losses are incorrect, got: %d, want: %d", mg.GetSyncLosses(), 1)
+	}
+
+	xpectednumProcPackets := uint64(len(data) / packetSize)
+	if procPckts := mg.getNumProcessedPackets(); procPckts != xpectednumProcPackets {
+		t.Errorf("Processed packet number is incorrect, got: %d, want: %d.", procPckts, xpectednumProcPackets)
+	}
+}
+
+func TestManifestGeneratorPacketSizes(t *testing.T) {
+	data, err := ioutil.ReadFile("../fixture/testSmall.ts")
+	if err != nil {
+		panic("Error opening test file")
+	}
+
+	packetSize := tspacket.TsDefaultPacketSize
+	m2ts := []byte{}
+	rs := []byte{}
+	for pos := 0; pos+packetSize <= len(data); pos += packetSize {
+		m2ts = append(append(m2ts, 0x40, 0, byte(pos>>8), byte(pos)), data[pos:pos+packetSize]...)
+		rs = append(append(rs, data[pos:pos+packetSize]...), make([]byte, tspacket.TsRSPacketSize-packetSize)...)
+	}
+
+	segment := func(name string, input []byte, keepM2TSTimestamps bool) (*ManifestGenerator, [][]byte) {
+		pathResults := "../results/PacketSizes" + name
+		clearResultsDir(pathResults)
+
+		mg := New(nil, mediachunk.ChunkOutputModeFile, hls.HlsOutputModeFile, pathResults, "chunk_", "chunklist.m3u8", 4.0, ChunkInitStart, true, -1, -1, hls.Vod, 3, 0, nil, nil)
+		mg.SetKeepM2TSTimestamps(keepM2TSTimestamps)
+		// Small writes to detect the size across buffers
+		for pos := 0; pos < len(input); pos += 100 {
+			mg.AddData(input[pos:min(pos+100, len(input))])
+		}
+		if err := mg.Close(); err != nil {
+			t.Error("Error closing. Err: ", err)
+		}
+
+		chunks := [][]byte{}
+		for _, chunk := range mg.hlsChunklist.GetState().Chunks {
+			chunkData, _ := ioutil.ReadFile(chunk.FileName)
+			chunks = append(chunks, chunkData)
+		}
+		return &mg, chunks
+	}
+
+	_, expected := segment("188", data, false)
+	if len(expected) != 3 {
+		t.Fatalf("Wrong number of chunks, got: %d, want: %d", len(expected), 3)
+	}
+
+	for _, input := range []struct {
+		name string
+		data []byte
+		size int
+	}{{"192", m2ts, tspacket.TsM2TSPacketSize}, {"204", rs, tspacket.TsRSPacketSize}} {
+		mg, chunks := segment(input.name, input.data, false)
+		if mg.GetInputPacketSize() != input.size || mg.GetSyncLosses() != 0 || mg.getNumProcessedPackets() != uint64(len(data)/packetSize) {
+			t.Errorf("Wrong input processing of %s, got size: %d, sync losses: %d, packets: %d", input.name, mg.GetInputPacketSize(), mg.GetSyncLosses(), mg.getNumProcessedPackets())
+		}
+		if len(chunks) != len(expected) {
+			t.Fatalf("Wrong number of chunks of %s, got: %d, want: %d", input.name, len(chunks), len(expected))
+		}
+		for i := range chunks {
+			if !bytes.Equal(chunks[i], expected[i]) {
+				t.Errorf("Chunk %d of %s is not correct", i, input.name)
+			}
+		}
+	}
+
+	// The M2TS header is kept in all the packets, the PAT and PMT added get the one of the 1st media packet
+	_, chunks := segment("192Timestamps", m2ts, true)
+	for i := range chunks {
+		if len(chunks[i]) != len(expected[i])/packetSize*tspacket.TsM2TSPacketSize {
+			t.Fatalf("Wrong size of chunk %d with M2TS timestamps, got: %d", i, len(chunks[i]))
+		}
+		for pos := 0; pos < len(chunks[i]); pos += tspacket.TsM2TSPacketSize {
+			packet := chunks[i][pos : pos+tspacket.TsM2TSPacketSize]
+			if packet[0] != 0x40 || !bytes.Equal(packet[tspacket.M2TSHeaderSize:], expected[i][pos/tspacket.TsM2TSPacketSize*packetSize:][:packetSize]) {
+				t.Fatalf("Wrong packet in chunk %d with M2TS timestamps, pos: %d", i, pos)
+			}
+		}
+	}
+}
+
+func BenchmarkManifestGeneratorAddData(b *testing.B) {
+	data, err := ioutil.ReadFile("../fixture/testSmall.ts")
+	if err != nil {
+		b.Fatal("Error opening test file. Err: ", err)
+	}
+	numPackets := len(data) / tspacket.TsDefaultPacketSize
+
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	log.SetLevel(logrus.WarnLevel)
+	mg := New(log, mediachunk.ChunkOutputModeNone, hls.HlsOutputModeNone, "../results/Benchmark", "chunk_", "chunklist.m3u8", 4.0, ChunkNoIni, true, -1, -1, hls.LiveWindow, 3, 0, nil, nil)
+
+	// 1 packet per op (allocs/op = allocs per packet), the PCRs jump back at the end of the file (no chunks output)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for n := 0; n < b.N; n++ {
+		pos := (n % numPackets) * tspacket.TsDefaultPacketSize
+		mg.AddData(data[pos : pos+tspacket.TsDefaultPacketSize])
+	}
+	elapsedS := time.Since(start).Seconds()
+	b.ReportMetric(float64(b.N)/elapsedS, "packets/s")
+	b.ReportMetric(float64(b.N*tspacket.TsDefaultPacketSize*8)/elapsedS/1e6, "Mbps")
+}
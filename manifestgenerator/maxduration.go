@@ -0,0 +1,75 @@
+package manifestgenerator
+
+import (
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tspacket"
+)
+
+// GOPStats Encoder GOP vs target duration information
+type GOPStats struct {
+	// MaxGOPDurationS Longest time between 2 IDRs received
+	MaxGOPDurationS float64
+
+	// ForcedCuts Number of chunks cut without IDR because the max segment duration was reached
+	ForcedCuts uint64
+}
+
+// SetMaxSegmentDuration If there is no IDR before maxSegmentDurS the chunk is cut at the next video access unit (0 = disabled)
+// The chunks that do not start with an IDR are marked as not independent. The live chunklists target duration covers it
+func (mg *ManifestGenerator) SetMaxSegmentDuration(maxSegmentDurS float64) {
+	mg.options.maxSegmentDurS = maxSegmentDurS
+	mg.hlsChunklist.SetMaxChunkDuration(maxSegmentDurS)
+	if mg.hlsIFrames != nil {
+		mg.hlsIFrames.SetMaxChunkDuration(maxSegmentDurS)
+	}
+}
+
+// GetGOPStats Returns the GOP information, useful to detect encoders with a GOP longer than the target duration
+func (mg *ManifestGenerator) GetGOPStats() GOPStats {
+	return mg.gopStats
+}
+
+// checkGOPDuration Called for every IDR with PCR
+func (mg *ManifestGenerator) checkGOPDuration(idrPCRS float64) {
+	if mg.lastIDRPCRS >= 0 {
+		gopDurationS := getElapsedS(mg.lastIDRPCRS, idrPCRS)
+		if gopDurationS > mg.gopStats.MaxGOPDurationS {
+			if gopDurationS > mg.options.targetSegmentDurS+ChunkLengthToleranceS {
+				mg.options.log.Warn("GOP duration ", gopDurationS, "s is longer than the target duration ", mg.options.targetSegmentDurS, "s, the chunks will be longer than the target")
+			}
+			mg.gopStats.MaxGOPDurationS = gopDurationS
+		}
+	}
+
+	mg.lastIDRPCRS = idrPCRS
+	mg.lastVideoPCRS = idrPCRS
+}
+
+// checkForcedCut Called for every video packet that is not an IDR, it cuts the chunk at the start of an access unit if it reached the max duration
+func (mg *ManifestGenerator) checkForcedCut() {
+	pcrS := mg.tsPacket.GetPCRS()
+	if pcrS >= 0 {
+		mg.lastVideoPCRS = pcrS
+	}
+
+	if mg.options.maxSegmentDurS <= 0 || mg.chunkStartTimeS < 0 || mg.lastVideoPCRS < 0 || !mg.tsPacket.IsPayloadUnitStart() {
+		return
+	}
+
+	durS := getElapsedS(mg.chunkStartTimeS, mg.lastVideoPCRS)
+	if durS < mg.options.maxSegmentDurS {
+		return
+	}
+
+	mg.gopStats.ForcedCuts++
+	mg.options.log.Warn("Forced chunk cut without IDR after ", durS, "s (max segment duration ", mg.options.maxSegmentDurS, "s)")
+
+	mg.lastPCRS = mg.lastVideoPCRS
+	_, nextInitialPCRS := mg.nextChunk(mg.lastVideoPCRS, mg.chunkStartTimeS, tspacket.MaxPCRSValue, false)
+	mg.chunkStartTimeS = nextInitialPCRS
+
+	mg.chunkIsNotIndependent = true
+	if mg.options.lhlsAdvancedChunks > 0 {
+		// LHLS chunks are in the chunklist before knowing how they start
+		mg.hlsChunklist.SetIndependentSegments(false)
+	}
+}
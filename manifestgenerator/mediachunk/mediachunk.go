@@ -12,8 +12,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/atomicfile"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/encryption"
 	"github.com/jordicenzano/go-ts-segmenter/uploaders/httpuploader"
 	"github.com/jordicenzano/go-ts-segmenter/uploaders/s3uploader"
+	"github.com/jordicenzano/go-ts-segmenter/uploaders/uploadqueue"
 	"github.com/sirupsen/logrus"
 )
 
@@ -35,6 +38,14 @@ const (
 
 	// ChunkOutputModeS3 chunks to S3
 	ChunkOutputModeS3
+
+	// ChunkOutputModeFileSingle Appends all the chunks to a single file (byte range)
+	ChunkOutputModeFileSingle
+)
+
+const (
+	// PartialPrefix Prefix of the files that are being written (NON LHLS)
+	PartialPrefix = ".partial_"
 )
 
 // Options Chunking options
@@ -50,12 +61,40 @@ type Options struct {
 	ChunkBaseFilename  string
 	HTTPUploader       *httpuploader.HTTPUploader
 	S3Uploader         *s3uploader.S3Uploader
+
+	// FileSync Flush the file data to disk (fsync) before making it visible
+	FileSync bool
+
+	// UploadQueue If set the HTTP regular and S3 uploads are done asynchronously
+	UploadQueue *uploadqueue.Queue
+
+	// OnUploadDone Called (from the upload queue worker) with the final result of an asynchronous upload
+	OnUploadDone func(err error)
+
+	// FilenameTemplate If set the filename (relative to BasePath) is created from it instead of ChunkBaseFilename + number + FileExtension (see ExpandTemplate)
+	FilenameTemplate string
+
+	// RenditionName Value of $Rendition$ in FilenameTemplate
+	RenditionName string
+
+	// TimeSource Value used for $Time$ in FilenameTemplate
+	TimeSource TimeSources
+
+	// StartPTS PTS (90KHz) of the 1st packet of the chunk used for $Time$ (TimeSourcePTS), negative if unknown
+	StartPTS int64
+
+	// SingleFile File where the chunk is appended (ChunkOutputModeFileSingle), the chunk filename is the SingleFile one
+	SingleFile *SingleFile
+
+	// Encryptor If set the data is encrypted before writing / sending it
+	Encryptor encryption.Encryptor
 }
 
 // Chunk Chunk class
 type Chunk struct {
 	// Used by HTTP chunked based
-	httpWriteChan chan<- []byte
+	httpWriteChan  chan<- []byte
+	httpResultChan <-chan error
 
 	// Used by file chunk write
 	fileWriter     *bufio.Writer
@@ -70,16 +109,30 @@ type Chunk struct {
 	// Used by NON chunk transfer HTTP
 	tmpFilename string
 
+	// Used by NON LHLS file output, the data is written here and renamed to filename when the chunk is closed
+	partialFilename string
+
 	// Bytes received
 	totalBytes int
 
 	// Epoch time when we received first byte for this chunk
 	createdAt int64
+
+	// Position of the chunk inside the SingleFile (-1 if no data yet)
+	byteRangeOffset int64
+
+	// Error that prevented creating the chunk, its data is discarded (nil if OK)
+	failedErr error
 }
 
 // New Creates a chunk instance
 func New(index uint64, options Options) Chunk {
-	c := Chunk{nil, nil, nil, options, index, "", "", "", 0, time.Now().UnixNano()}
+	c := Chunk{nil, nil, nil, nil, options, index, "", "", "", "", 0, time.Now().UnixNano(), -1, nil}
+
+	if options.OutputType == ChunkOutputModeFileSingle {
+		c.filename = options.SingleFile.GetFilename()
+		return c
+	}
 
 	c.filename = c.createFilename(options.BasePath, options.ChunkBaseFilename, index, options.FileNumberLength, options.FileExtension, "")
 	if options.GhostPrefix != "" {
@@ -108,6 +161,12 @@ func (c *Chunk) initializeChunkTempFile() error {
 }
 
 func (c *Chunk) initializeChunkFile() error {
+	// The filename template can contain directories
+	err := os.MkdirAll(path.Dir(c.filename), 0744)
+	if err != nil {
+		return err
+	}
+
 	if c.filenameGhost != "" {
 		// Create ghost file
 		exists, _ := fileExists(c.filenameGhost)
@@ -123,8 +182,15 @@ func (c *Chunk) initializeChunkFile() error {
 		// Create media file
 		exists, _ := fileExists(c.filename)
 		if !exists {
+			writeFilename := c.filename
+			if !c.options.LHLS {
+				// Readers will only see the complete file
+				c.partialFilename = createPartialFilename(c.filename)
+				writeFilename = c.partialFilename
+			}
+
 			var err error
-			c.fileDescriptor, err = os.Create(c.filename)
+			c.fileDescriptor, err = os.Create(writeFilename)
 			if err != nil {
 				return err
 			}
@@ -137,7 +203,7 @@ func (c *Chunk) initializeChunkFile() error {
 }
 
 func (c *Chunk) initializeChunkHTTPChunkedTransfer() error {
-	c.httpWriteChan = c.options.HTTPUploader.UploadChunkedTransfer(c.filename, c.getChunkHeaders(-1))
+	c.httpWriteChan, c.httpResultChan = c.options.HTTPUploader.UploadChunkedTransfer(c.filename, c.getChunkHeaders(-1))
 
 	return nil
 }
@@ -156,7 +222,23 @@ func (c *Chunk) InitializeChunk() error {
 	return ret
 }
 
-func (c *Chunk) closeChunkFile() {
+func (c *Chunk) closeChunkFile() error {
+	ret := error(nil)
+
+	if c.fileWriter != nil {
+		if c.options.FileSync {
+			ret = c.fileDescriptor.Sync()
+		}
+		errClose := c.fileDescriptor.Close()
+		if ret == nil {
+			ret = errClose
+		}
+
+		if c.partialFilename != "" && ret == nil {
+			ret = atomicfile.Rename(c.partialFilename, c.filename, c.options.FileSync)
+		}
+	}
+
 	if c.filenameGhost != "" {
 		exists, _ := fileExists(c.filenameGhost)
 		if exists {
@@ -164,49 +246,141 @@ func (c *Chunk) closeChunkFile() {
 		}
 	}
 
-	if c.fileWriter != nil {
-		c.fileDescriptor.Close()
-	}
+	return ret
 }
 
-func (c *Chunk) closeChunkTmpFileExternal(outputType OutputTypes, durationS float64) {
+func (c *Chunk) closeChunkTmpFileExternal(outputType OutputTypes, durationS float64) error {
 	if c.fileWriter != nil {
 		c.fileDescriptor.Sync()
 		c.fileDescriptor.Close()
 	}
 
+	if c.options.UploadQueue != nil {
+		return c.options.UploadQueue.Add(uploadqueue.Job{
+			Name: c.filename,
+			Upload: func() error {
+				return c.uploadTmpFileExternal(outputType, durationS)
+			},
+			WaitPrevious: false,
+			OnDone:       c.options.OnUploadDone,
+			Discard:      c.deleteTmpFile,
+		})
+	}
+
+	return c.uploadTmpFileExternal(outputType, durationS)
+}
+
+func (c *Chunk) uploadTmpFileExternal(outputType OutputTypes, durationS float64) error {
+	ret := error(nil)
+
 	if c.tmpFilename != "" {
 		h := c.getChunkHeaders(durationS)
 		if outputType == ChunkOutputModeS3 {
-			c.options.S3Uploader.UploadLocalFile(c.tmpFilename, c.filename, h)
+			ret = c.options.S3Uploader.UploadLocalFile(c.tmpFilename, c.filename, h)
 		} else {
-			c.options.HTTPUploader.UploadLocalFile(c.tmpFilename, c.filename, h)
+			ret = c.options.HTTPUploader.UploadLocalFile(c.tmpFilename, c.filename, h)
 		}
 	}
 
-	// Delete temp file
+	c.deleteTmpFile()
+
+	return ret
+}
+
+func (c *Chunk) deleteTmpFile() {
 	exists, _ := fileExists(c.tmpFilename)
 	if exists {
 		os.Remove(c.tmpFilename)
 	}
 }
 
-func (c *Chunk) closeChunkHTTPChunkedTransfer() {
+// SetFailed Marks the chunk as failed (it could not be created or encrypted), the data received is discarded and Close returns err
+func (c *Chunk) SetFailed(err error) {
+	c.failedErr = err
+}
+
+// closeFailedChunk Removes what was created of a failed chunk
+func (c *Chunk) closeFailedChunk() error {
+	if c.fileDescriptor != nil {
+		c.fileDescriptor.Close()
+	}
+	if c.httpWriteChan != nil {
+		close(c.httpWriteChan)
+		<-c.httpResultChan
+	}
+	for _, fileName := range []string{c.partialFilename, c.tmpFilename, c.filenameGhost} {
+		if fileName == "" {
+			continue
+		}
+		exists, _ := fileExists(fileName)
+		if exists {
+			os.Remove(fileName)
+		}
+	}
+
+	return c.failedErr
+}
+
+// SetOnUploadDone Sets the function called with the final result of an asynchronous upload
+func (c *Chunk) SetOnUploadDone(onUploadDone func(err error)) {
+	c.options.OnUploadDone = onUploadDone
+}
+
+// IsUploadAsync Indicates if the delivery result will be reported later by OnUploadDone (instead of returned by Close)
+func (c *Chunk) IsUploadAsync() bool {
+	return c.failedErr == nil && c.options.UploadQueue != nil && (c.options.OutputType == ChunkOutputModeHTTPRegular || c.options.OutputType == ChunkOutputModeS3)
+}
+
+func (c *Chunk) closeChunkHTTPChunkedTransfer() error {
+	ret := error(nil)
+
 	if c.httpWriteChan != nil {
 		close(c.httpWriteChan)
+
+		// Wait for the upload result
+		ret = <-c.httpResultChan
 	}
+
+	return ret
 }
 
-//Close Closes chunk
-func (c *Chunk) Close(durationS float64) {
+//Close Closes chunk, it returns the delivery error (if any)
+func (c *Chunk) Close(durationS float64) error {
+	ret := error(nil)
+
 	c.options.Log.Debug("Closing chunk ", c.filename)
+	if c.failedErr != nil {
+		return c.closeFailedChunk()
+	}
+
+	errEncryption := error(nil)
+	if c.options.Encryptor != nil {
+		// Last encrypted data
+		var buf []byte
+		buf, errEncryption = c.options.Encryptor.Close()
+		if errEncryption == nil {
+			errEncryption = c.writeData(buf)
+		}
+	}
+
 	if c.options.OutputType == ChunkOutputModeFile {
-		c.closeChunkFile()
+		ret = c.closeChunkFile()
 	} else if c.options.OutputType == ChunkOutputModeHTTPChunkedTransfer {
-		c.closeChunkHTTPChunkedTransfer()
+		ret = c.closeChunkHTTPChunkedTransfer()
 	} else if c.options.OutputType == ChunkOutputModeHTTPRegular || c.options.OutputType == ChunkOutputModeS3 {
-		c.closeChunkTmpFileExternal(c.options.OutputType, durationS)
+		ret = c.closeChunkTmpFileExternal(c.options.OutputType, durationS)
+	} else if c.options.OutputType == ChunkOutputModeFileSingle {
+		ret = c.options.SingleFile.Flush()
 	}
+	if ret == nil {
+		ret = errEncryption
+	}
+
+	if ret != nil {
+		c.options.Log.Error("Error closing chunk ", c.filename, ". Err: ", ret)
+	}
+
+	return ret
 }
 
 func (c *Chunk) getChunkHeaders(durationS float64) map[string]string {
@@ -253,18 +427,55 @@ func (c *Chunk) addDataChunkHTTP(buf []byte) error {
 	return nil
 }
 
+func (c *Chunk) addDataChunkSingleFile(buf []byte) error {
+	offset, err := c.options.SingleFile.Write(buf)
+	if c.byteRangeOffset < 0 {
+		c.byteRangeOffset = offset
+	}
+
+	return err
+}
+
 //AddData Add data to chunk and flush it
 func (c *Chunk) AddData(buf []byte) error {
 	ret := error(nil)
 
-	c.options.Log.Debug("Adding data to chunk ", c.filename)
+	if c.failedErr != nil {
+		// Discarded, the error is returned when closing
+		c.totalBytes = c.totalBytes + len(buf)
+		return ret
+	}
+
+	if c.options.Log.IsLevelEnabled(logrus.DebugLevel) {
+		c.options.Log.Debug("Adding data to chunk ", c.filename)
+	}
+
+	data := buf
+	if c.options.Encryptor != nil {
+		data, ret = c.options.Encryptor.Encrypt(buf)
+	}
+	if ret == nil {
+		ret = c.writeData(data)
+	}
+	c.totalBytes = c.totalBytes + len(buf)
+
+	return ret
+}
+
+func (c *Chunk) writeData(buf []byte) error {
+	ret := error(nil)
+
+	if len(buf) == 0 {
+		return ret
+	}
 
 	if c.options.OutputType == ChunkOutputModeFile || c.options.OutputType == ChunkOutputModeHTTPRegular || c.options.OutputType == ChunkOutputModeS3 {
 		ret = c.addDataChunkFile(buf)
 	} else if c.options.OutputType == ChunkOutputModeHTTPChunkedTransfer {
 		ret = c.addDataChunkHTTP(buf)
+	} else if c.options.OutputType == ChunkOutputModeFileSingle {
+		ret = c.addDataChunkSingleFile(buf)
 	}
-	c.totalBytes = c.totalBytes + len(buf)
 
 	return ret
 }
@@ -279,6 +490,25 @@ func (c *Chunk) IsEmpty() bool {
 	return ret
 }
 
+// GetSize Returns the bytes added to the chunk
+func (c *Chunk) GetSize() int64 {
+	return int64(c.totalBytes)
+}
+
+// GetByteRange Returns the position and size of the chunk inside the SingleFile (ChunkOutputModeFileSingle)
+func (c *Chunk) GetByteRange() (offset int64, length int64) {
+	if c.byteRangeOffset < 0 {
+		return 0, 0
+	}
+
+	return c.byteRangeOffset, int64(c.totalBytes)
+}
+
+// GetCreatedAt Returns the time when the chunk was created (1st byte received)
+func (c *Chunk) GetCreatedAt() time.Time {
+	return time.Unix(0, c.createdAt)
+}
+
 //GetFilename Returns the filename
 func (c *Chunk) GetFilename() string {
 	return c.filename
@@ -300,6 +530,11 @@ func fileExists(filePath string) (bool, error) {
 	return true, err
 }
 
+// createPartialFilename Returns a hidden filename in the same dir (to be able to rename it atomically)
+func createPartialFilename(filename string) string {
+	return path.Join(path.Dir(filename), PartialPrefix+path.Base(filename))
+}
+
 func padNumberWithZero(value uint64, numZeros int) string {
 	format := "%0" + strconv.Itoa(numZeros) + "d"
 	return fmt.Sprintf(format, value)
@@ -313,12 +548,28 @@ func (c *Chunk) createFilename(
 	fileExtension string,
 	ghostPrefix string,
 ) string {
-	ret := ""
+	name := chunkBaseFilename + padNumberWithZero(index, fileNumberLength) + fileExtension
+	if c.options.FilenameTemplate != "" {
+		name = ExpandTemplate(c.options.FilenameTemplate, c.getTemplateVars(index))
+	}
+
+	ret := path.Join(basePath, name)
 	if ghostPrefix != "" {
-		ret = path.Join(basePath, ghostPrefix+chunkBaseFilename+padNumberWithZero(index, fileNumberLength)+fileExtension)
-	} else {
-		ret = path.Join(basePath, chunkBaseFilename+padNumberWithZero(index, fileNumberLength)+fileExtension)
+		ret = path.Join(path.Dir(ret), ghostPrefix+path.Base(ret))
 	}
 
 	return ret
 }
+
+func (c *Chunk) getTemplateVars(index uint64) TemplateVars {
+	wallClock := time.Unix(0, c.createdAt)
+
+	vars := TemplateVars{Number: index, Time: 0, WallClock: wallClock, Rendition: c.options.RenditionName}
+	if c.options.TimeSource == TimeSourceWallClock {
+		vars.Time = uint64(wallClock.UnixNano() / int64(time.Millisecond))
+	} else if c.options.StartPTS > 0 {
+		vars.Time = uint64(c.options.StartPTS)
+	}
+
+	return vars
+}
@@ -1,3 +1,151 @@
 package mediachunk
 
-//TODO: Add testing
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jordicenzano/go-ts-segmenter/uploaders/uploadqueue"
+	"github.com/sirupsen/logrus"
+)
+
+func createTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mediachunk")
+	if err != nil {
+		t.Fatal("Error creating temp dir. Err: ", err)
+	}
+	return dir
+}
+
+func TestChunkFileAtomicWrite(t *testing.T) {
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+
+	c := New(1, Options{OutputType: ChunkOutputModeFile, LHLS: false, FileNumberLength: 5, GhostPrefix: ".growing_", FileExtension: ".ts", BasePath: dir, ChunkBaseFilename: "chunk_", FileSync: true})
+	if err := c.InitializeChunk(); err != nil {
+		t.Fatal("Error initializing chunk. Err: ", err)
+	}
+	c.addDataChunkFile([]byte("ABCDE"))
+
+	finalFilename := path.Join(dir, "chunk_00001.ts")
+	if exists, _ := fileExists(finalFilename); exists {
+		t.Error("Chunk file visible before closing it")
+	}
+	if exists, _ := fileExists(path.Join(dir, PartialPrefix+"chunk_00001.ts")); !exists {
+		t.Error("Partial chunk file not found while writing")
+	}
+
+	if err := c.closeChunkFile(); err != nil {
+		t.Fatal("Error closing chunk. Err: ", err)
+	}
+
+	data, err := ioutil.ReadFile(finalFilename)
+	if err != nil || string(data) != "ABCDE" {
+		t.Errorf("Wrong chunk data, got: %s, want: %s. Err: %v", string(data), "ABCDE", err)
+	}
+	if exists, _ := fileExists(path.Join(dir, PartialPrefix+"chunk_00001.ts")); exists {
+		t.Error("Partial chunk file still present after closing")
+	}
+	if exists, _ := fileExists(path.Join(dir, ".growing_chunk_00001.ts")); exists {
+		t.Error("Ghost chunk file still present after closing")
+	}
+}
+
+func TestChunkFileLHLSGrowing(t *testing.T) {
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+
+	c := New(2, Options{OutputType: ChunkOutputModeFile, LHLS: true, FileNumberLength: 5, GhostPrefix: ".growing_", FileExtension: ".ts", BasePath: dir, ChunkBaseFilename: "chunk_"})
+	if err := c.InitializeChunk(); err != nil {
+		t.Fatal("Error initializing chunk. Err: ", err)
+	}
+	c.addDataChunkFile([]byte("ABCDE"))
+
+	// LHLS chunks are visible while growing
+	data, err := ioutil.ReadFile(path.Join(dir, "chunk_00002.ts"))
+	if err != nil || string(data) != "ABCDE" {
+		t.Errorf("Wrong growing chunk data, got: %s, want: %s. Err: %v", string(data), "ABCDE", err)
+	}
+
+	if err := c.closeChunkFile(); err != nil {
+		t.Fatal("Error closing chunk. Err: ", err)
+	}
+}
+
+func TestChunkTmpFileDeletedWhenRejected(t *testing.T) {
+	q := uploadqueue.New(nil, 1, 1, uploadqueue.OverflowBlock)
+	q.Close()
+
+	c := New(3, Options{Log: logrus.New(), OutputType: ChunkOutputModeHTTPRegular, FileNumberLength: 5, FileExtension: ".ts", ChunkBaseFilename: "chunk_", UploadQueue: q})
+	if err := c.InitializeChunk(); err != nil {
+		t.Fatal("Error initializing chunk. Err: ", err)
+	}
+	c.AddData([]byte("ABCDE"))
+
+	if err := c.Close(1); err != uploadqueue.ErrQueueClosed {
+		t.Errorf("Expected queue closed error, got: %v", err)
+	}
+	if exists, _ := fileExists(c.tmpFilename); exists {
+		t.Error("Temp file of the rejected upload still present")
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	vars := TemplateVars{Number: 123456, Time: 900000, WallClock: time.Date(2026, 10, 17, 8, 5, 3, 0, time.UTC), Rendition: "720p"}
+
+	tests := map[string]string{
+		"chunk_$Number$.ts":                              "chunk_123456.ts",
+		"chunk_$Number%08d$.ts":                          "chunk_00123456.ts",
+		"chunk_$Number%03d$.ts":                          "chunk_123456.ts",
+		"$Rendition$/chunk_$Time$.ts":                    "720p/chunk_900000.ts",
+		"$Year$/$Month$/$Day$/$Hour$$Minute$$Second$.ts": "2026/10/17/080503.ts",
+		"price$$_$Number$.ts":                            "price$_123456.ts",
+	}
+	for template, want := range tests {
+		if err := ValidateTemplate(template); err != nil {
+			t.Errorf("Template %s not valid. Err: %v", template, err)
+		}
+		if got := ExpandTemplate(template, vars); got != want {
+			t.Errorf("Wrong expanded template %s, got: %s, want: %s", template, got, want)
+		}
+	}
+
+	for _, template := range []string{"chunk_$Unknown$.ts", "chunk_$Number.ts", "$Rendition%02d$.ts", "chunk_$1$_$Number$.ts", "$Number$_$Time.ts"} {
+		if err := ValidateTemplate(template); err == nil {
+			t.Errorf("Template %s should not be valid", template)
+		}
+	}
+
+	if !TemplateHasNumber("init_$Number%03d$.ts") || TemplateHasNumber("init_$Rendition$_$$Number.ts") {
+		t.Error("Wrong $Number$ detection")
+	}
+}
+
+func TestChunkFileTemplate(t *testing.T) {
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+
+	c := New(100000, Options{OutputType: ChunkOutputModeFile, LHLS: false, GhostPrefix: ".growing_", BasePath: dir, FilenameTemplate: "$Rendition$/$Year$/chunk_$Number%07d$_$Time$.ts", RenditionName: "low", TimeSource: TimeSourcePTS, StartPTS: 225000})
+	wantFilename := path.Join(dir, "low", strconv.Itoa(time.Now().UTC().Year()), "chunk_0100000_225000.ts")
+	if c.GetFilename() != wantFilename {
+		t.Errorf("Wrong filename, got: %s, want: %s", c.GetFilename(), wantFilename)
+	}
+
+	if err := c.InitializeChunk(); err != nil {
+		t.Fatal("Error initializing chunk. Err: ", err)
+	}
+	if exists, _ := fileExists(path.Join(path.Dir(wantFilename), ".growing_"+path.Base(wantFilename))); !exists {
+		t.Error("Ghost chunk file not found in the template directory")
+	}
+	c.addDataChunkFile([]byte("ABCDE"))
+	if err := c.closeChunkFile(); err != nil {
+		t.Fatal("Error closing chunk. Err: ", err)
+	}
+
+	if exists, _ := fileExists(wantFilename); !exists {
+		t.Error("Chunk file not found: ", wantFilename)
+	}
+}
@@ -0,0 +1,77 @@
+package mediachunk
+
+import (
+	"bufio"
+	"os"
+	"path"
+)
+
+// SingleFile File where all the chunks are appended (ChunkOutputModeFileSingle)
+type SingleFile struct {
+	filename       string
+	fileDescriptor *os.File
+	fileWriter     *bufio.Writer
+	fileSync       bool
+
+	// Bytes in the file (next write offset)
+	size int64
+}
+
+// NewSingleFile Opens (or creates) the file, the data is appended to the current content
+func NewSingleFile(filename string, fileSync bool) (*SingleFile, error) {
+	err := os.MkdirAll(path.Dir(filename), 0744)
+	if err != nil {
+		return nil, err
+	}
+
+	fileDescriptor, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := fileDescriptor.Stat()
+	if err != nil {
+		fileDescriptor.Close()
+		return nil, err
+	}
+
+	s := SingleFile{filename, fileDescriptor, bufio.NewWriter(fileDescriptor), fileSync, fi.Size()}
+
+	return &s, nil
+}
+
+// GetFilename Returns the filename
+func (s *SingleFile) GetFilename() string {
+	return s.filename
+}
+
+// Write Appends the data and returns the offset where it was written
+func (s *SingleFile) Write(buf []byte) (int64, error) {
+	offset := s.size
+
+	n, err := s.fileWriter.Write(buf)
+	s.size = s.size + int64(n)
+
+	return offset, err
+}
+
+// Flush Writes the buffered data to the file (and to disk if fileSync), called when a chunk is complete
+func (s *SingleFile) Flush() error {
+	err := s.fileWriter.Flush()
+	if err == nil && s.fileSync {
+		err = s.fileDescriptor.Sync()
+	}
+
+	return err
+}
+
+// Close Flushes and closes the file
+func (s *SingleFile) Close() error {
+	err := s.Flush()
+	errClose := s.fileDescriptor.Close()
+	if err == nil {
+		err = errClose
+	}
+
+	return err
+}
@@ -0,0 +1,116 @@
+package mediachunk
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeSources indicates the value used for $Time$ in the filename templates
+type TimeSources int
+
+const (
+	// TimeSourcePTS $Time$ is the PTS of the 1st packet of the chunk (the IDR if it starts with video) in 90KHz ticks
+	TimeSourcePTS TimeSources = iota
+
+	// TimeSourceWallClock $Time$ is the chunk creation wall clock time in ms since epoch
+	TimeSourceWallClock
+)
+
+const (
+	// TemplateTimescale Timescale of $Time$ when the source is the PTS
+	TemplateTimescale = 90000
+)
+
+// TemplateVars Values used to expand the filename templates
+type TemplateVars struct {
+	Number    uint64
+	Time      uint64
+	WallClock time.Time
+	Rendition string
+}
+
+// Supported identifiers:
+// $Number$, $Number%0Nd$: Chunk index (optionally zero padded to N digits)
+// $Time$, $Time%0Nd$: Chunk start time (see TimeSources)
+// $Year$, $Month$, $Day$, $Hour$, $Minute$, $Second$: Wall clock UTC date (zero padded)
+// $Rendition$: Rendition name
+// $$: Literal $
+var templateIdentifierRegexp = regexp.MustCompile(`\$([A-Za-z]*)(%0?[0-9]*d)?\$`)
+
+// ValidateTemplate Returns an error if the template contains unknown identifiers or $ that are not part of an identifier
+func ValidateTemplate(template string) error {
+	if strings.Contains(templateIdentifierRegexp.ReplaceAllString(template, ""), "$") {
+		return errors.New("Stray $ (use $$ for a literal $) in template " + template)
+	}
+
+	for _, match := range templateIdentifierRegexp.FindAllStringSubmatch(template, -1) {
+		identifier := match[1]
+		format := match[2]
+		switch identifier {
+		case "Number", "Time":
+		case "", "Year", "Month", "Day", "Hour", "Minute", "Second", "Rendition":
+			if format != "" {
+				return errors.New("Identifier " + match[0] + " does not accept format in template " + template)
+			}
+		default:
+			return errors.New("Unknown identifier " + match[0] + " in template " + template)
+		}
+	}
+
+	return nil
+}
+
+// TemplateHasNumber Returns true if the template contains $Number$ (so every chunk gets a different name)
+func TemplateHasNumber(template string) bool {
+	for _, match := range templateIdentifierRegexp.FindAllStringSubmatch(template, -1) {
+		if match[1] == "Number" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExpandTemplate Replaces the template identifiers with the values from vars
+// The template has to be validated before with ValidateTemplate, unknown identifiers are left as they are
+func ExpandTemplate(template string, vars TemplateVars) string {
+	wallClock := vars.WallClock.UTC()
+
+	return templateIdentifierRegexp.ReplaceAllStringFunc(template, func(match string) string {
+		submatch := templateIdentifierRegexp.FindStringSubmatch(match)
+		identifier := submatch[1]
+		format := submatch[2]
+		if format == "" {
+			format = "%d"
+		}
+
+		switch identifier {
+		case "":
+			return "$"
+		case "Number":
+			return fmt.Sprintf(format, vars.Number)
+		case "Time":
+			return fmt.Sprintf(format, vars.Time)
+		case "Year":
+			return strconv.Itoa(wallClock.Year())
+		case "Month":
+			return fmt.Sprintf("%02d", int(wallClock.Month()))
+		case "Day":
+			return fmt.Sprintf("%02d", wallClock.Day())
+		case "Hour":
+			return fmt.Sprintf("%02d", wallClock.Hour())
+		case "Minute":
+			return fmt.Sprintf("%02d", wallClock.Minute())
+		case "Second":
+			return fmt.Sprintf("%02d", wallClock.Second())
+		case "Rendition":
+			return vars.Rendition
+		}
+
+		return match
+	})
+}
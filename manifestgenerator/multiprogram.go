@@ -0,0 +1,176 @@
+package manifestgenerator
+
+import (
+	"sort"
+
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tspacket"
+	"github.com/sirupsen/logrus"
+)
+
+// SetProgramNumber Selects the program to process in a multi program TS (MPTS), -1 = the 1st program of the PAT
+// The PAT saved in the output only contains the selected program
+func (mg *ManifestGenerator) SetProgramNumber(programNumber int) {
+	mg.options.programNumber = programNumber
+}
+
+// getProgramPMTPID Returns the PMT PID and the number of the selected program if the current packet is a PAT (-1 if not PAT or program not found)
+func (mg *ManifestGenerator) getProgramPMTPID() (int, int) {
+	programs := mg.tsPacket.GetPATPrograms()
+	if len(programs) == 0 {
+		return -1, -1
+	}
+
+	programNumber := mg.options.programNumber
+	if programNumber < 0 {
+		programNumber = programs[0].ProgramNumber
+	}
+
+	if len(programs) > 1 || programs[0].ProgramNumber != programNumber {
+		if !mg.tsPacket.FilterPATProgram(programNumber) {
+			mg.options.log.Debug("Program ", programNumber, " not found in PAT: ", programs)
+			return -1, -1
+		}
+	}
+
+	return mg.tsPacket.GetPATdata(), programNumber
+}
+
+// ProgramFactory Creates the manifest generator of a program, the programs with error are not processed
+type ProgramFactory func(programNumber int) (*ManifestGenerator, error)
+
+// MultiProgram Splits a multi program TS (MPTS), every program found in the PAT is processed by its own manifest generator
+type MultiProgram struct {
+	log     *logrus.Logger
+	factory ProgramFactory
+
+	generators map[int]*ManifestGenerator
+	discarded  map[int]bool
+
+	// Incomplete TS packet data used to find the PAT, and input packet size (0 = not in sync)
+	pending    []byte
+	packetSize int
+	tsPacket   tspacket.TsPacket
+}
+
+// NewMultiProgram Creates a multi program splitter
+func NewMultiProgram(log *logrus.Logger, factory ProgramFactory) MultiProgram {
+	if log == nil {
+		log = logrus.New()
+		log.SetLevel(logrus.DebugLevel)
+	}
+
+	return MultiProgram{log, factory, make(map[int]*ManifestGenerator), make(map[int]bool), nil, 0, tspacket.New(tspacket.TsDefaultPacketSize)}
+}
+
+// AddData Processes the TS data, the new programs in the PAT create their manifest generator
+// It returns the 1st delivery error found (if any)
+func (m *MultiProgram) AddData(buf []byte) error {
+	m.findPrograms(buf)
+
+	ret := error(nil)
+	for _, programNumber := range m.GetProgramNumbers() {
+		err := m.generators[programNumber].AddData(buf)
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+
+	return ret
+}
+
+// Close Closes all the programs
+// It returns the 1st delivery error found (if any)
+func (m *MultiProgram) Close() error {
+	ret := error(nil)
+	for _, programNumber := range m.GetProgramNumbers() {
+		err := m.generators[programNumber].Close()
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+
+	return ret
+}
+
+// GetProgramNumbers Returns the programs being processed (sorted)
+func (m *MultiProgram) GetProgramNumbers() []int {
+	programNumbers := make([]int, 0, len(m.generators))
+	for programNumber := range m.generators {
+		programNumbers = append(programNumbers, programNumber)
+	}
+	sort.Ints(programNumbers)
+
+	return programNumbers
+}
+
+// GetManifestGenerator Returns the manifest generator of a program (nil if not found)
+func (m *MultiProgram) GetManifestGenerator(programNumber int) *ManifestGenerator {
+	return m.generators[programNumber]
+}
+
+// findPrograms Looks for PAT packets in the data
+func (m *MultiProgram) findPrograms(buf []byte) {
+	m.pending = append(m.pending, buf...)
+
+	pos := 0
+	for pos < len(m.pending) {
+		if m.packetSize == 0 {
+			// Resync
+			start, packetSize, locked := tspacket.DetectSync(m.pending[pos:], tspacket.DefaultSyncLockPackets)
+			if start < 0 {
+				pos = len(m.pending)
+				break
+			}
+			pos += start
+			if !locked {
+				break
+			}
+			m.packetSize = packetSize
+		}
+		if pos+m.packetSize > len(m.pending) {
+			break
+		}
+
+		offset := tspacket.GetSyncOffset(m.packetSize)
+		packet := m.pending[pos+offset : pos+offset+tspacket.TsDefaultPacketSize]
+		if packet[0] != 0x47 {
+			m.packetSize = 0
+			pos++
+			continue
+		}
+		pos += m.packetSize
+
+		if uint16(packet[1]&0x1F)<<8|uint16(packet[2]) != tspacket.PATPID {
+			continue
+		}
+
+		m.tsPacket.Reset()
+		m.tsPacket.AddData(packet)
+		if !m.tsPacket.Parse(-1, -1) {
+			continue
+		}
+		for _, program := range m.tsPacket.GetPATPrograms() {
+			m.addProgram(program.ProgramNumber)
+		}
+	}
+
+	m.pending = append(m.pending[:0], m.pending[pos:]...)
+}
+
+func (m *MultiProgram) addProgram(programNumber int) {
+	if m.generators[programNumber] != nil || m.discarded[programNumber] {
+		return
+	}
+
+	mg, err := m.factory(programNumber)
+	if err != nil {
+		m.log.Error("Error creating the manifest generator of program ", programNumber, ", it will not be processed. Err: ", err)
+		m.discarded[programNumber] = true
+		return
+	}
+
+	mg.SetProgramNumber(programNumber)
+	m.generators[programNumber] = mg
+
+	m.log.Info("Detected program ", programNumber)
+}
@@ -0,0 +1,81 @@
+package manifestgenerator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/atomicfile"
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/hls"
+)
+
+// State Generator data persisted to continue the numbering and the chunklist after a restart
+// NextInitChunkIndex avoids overwriting the init chunk referenced by the restored chunklist
+type State struct {
+	NextChunkIndex     uint64
+	NextInitChunkIndex uint64
+	Chunklist          hls.State
+}
+
+// SetStateFile Sets the file used to persist the state, if it exists the state is restored from it
+// The first chunk after a restore is marked as discontinuity
+func (mg *ManifestGenerator) SetStateFile(stateFileName string) error {
+	mg.options.stateFileName = stateFileName
+	if stateFileName == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(stateFileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state State
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+
+	mg.currentChunkIndex = state.NextChunkIndex
+	mg.initChunkIndex = state.NextInitChunkIndex
+	mg.hlsChunklist.RestoreState(state.Chunklist)
+	mg.nextChunkIsDisco = true
+
+	mg.options.log.Info("Restored state from ", stateFileName, ". Next chunk index: ", state.NextChunkIndex, ", next init chunk index: ", state.NextInitChunkIndex, ", media sequence: ", state.Chunklist.MediaSequence)
+
+	return nil
+}
+
+func (mg *ManifestGenerator) getState() State {
+	chunklistState := mg.hlsChunklist.GetState()
+
+	// The LHLS advanced chunks are in the chunklist before being complete, we can not resume them
+	if mg.options.lhlsAdvancedChunks > 0 {
+		numComplete := len(chunklistState.Chunks) - len(mg.currentChunks)
+		if numComplete < 0 {
+			numComplete = 0
+		}
+		chunklistState.Chunks = chunklistState.Chunks[:numComplete]
+	}
+
+	return State{NextChunkIndex: mg.currentChunkIndex + uint64(len(mg.currentChunks)), NextInitChunkIndex: mg.initChunkIndex + 1, Chunklist: chunklistState}
+}
+
+// saveState Writes the state file (atomically)
+func (mg *ManifestGenerator) saveState() {
+	if mg.options.stateFileName == "" {
+		return
+	}
+
+	data, err := json.Marshal(mg.getState())
+	if err == nil {
+		err = atomicfile.WriteFile(mg.options.stateFileName, data, mg.options.fileSync)
+	}
+
+	if err != nil {
+		mg.options.log.Error("Error saving state to ", mg.options.stateFileName, ". Err: ", err)
+	}
+}
@@ -0,0 +1,79 @@
+package tsanalyzer
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tspacket"
+)
+
+// Analyze Analyzes all the TS data of the reader (standalone mode, all the PMTs of the PAT are parsed)
+// The input packet size (188, 192 M2TS or 204 DVB) is detected when looking for the sync
+func Analyze(r io.Reader) (Report, error) {
+	a := New()
+	packet := tspacket.New(tspacket.TsDefaultPacketSize)
+	reader := bufio.NewReader(r)
+	lockSize := tspacket.DefaultSyncLockPackets * tspacket.TsRSPacketSize
+
+	packetSize := 0
+	for {
+		if packetSize == 0 {
+			// Resync
+			data, err := reader.Peek(lockSize)
+			if len(data) == 0 {
+				if err == io.EOF {
+					break
+				}
+				return a.GetReport(), err
+			}
+
+			start, size, locked := tspacket.DetectSync(data, tspacket.DefaultSyncLockPackets)
+			if !locked && start == 0 && err == io.EOF {
+				// Not enough data at the end to confirm the candidate
+				start, size, locked = tspacket.DetectSync(data, 1)
+			}
+			if start < 0 {
+				start = len(data)
+			} else if !locked && start == 0 {
+				start = 1
+			}
+			if start > 0 {
+				a.AddSkippedBytes(start)
+				reader.Discard(start)
+				continue
+			}
+			packetSize = size
+		}
+
+		data, err := reader.Peek(packetSize)
+		if len(data) < packetSize {
+			if err == io.EOF {
+				break
+			}
+			return a.GetReport(), err
+		}
+
+		offset := tspacket.GetSyncOffset(packetSize)
+		buf := data[offset : offset+tspacket.TsDefaultPacketSize]
+		if buf[0] != 0x47 {
+			a.AddSyncLoss()
+			packetSize = 0
+			continue
+		}
+
+		pID := int(buf[1]&0x1F)<<8 | int(buf[2])
+		pmtPID := -1
+		if a.IsPMTPID(pID) {
+			pmtPID = pID
+		}
+
+		packet.Reset()
+		packet.AddData(buf)
+		if packet.Parse(pmtPID, -1) {
+			a.AddPacket(&packet, packetSize)
+		}
+		reader.Discard(packetSize)
+	}
+
+	return a.GetReport(), nil
+}
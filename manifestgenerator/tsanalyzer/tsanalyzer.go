@@ -0,0 +1,349 @@
+package tsanalyzer
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tspacket"
+)
+
+const (
+	// PSIMaxIntervalS Max time between 2 PAT or 2 PMT sections (TR 101 290 1.3 and 1.5)
+	PSIMaxIntervalS float64 = 0.5
+
+	// PCRMaxIntervalS Max time between 2 PCRs of a PID, and max PCR jump without discontinuity indicator (TR 101 290 2.3)
+	PCRMaxIntervalS float64 = 0.1
+
+	// PCRMaxAccuracyErrorS Max PCR inaccuracy, measured assuming constant bitrate between PCRs (TR 101 290 2.4)
+	PCRMaxAccuracyErrorS float64 = 500e-9
+)
+
+// Priority1Report TR 101 290 priority 1 errors (the stream can not be decoded)
+type Priority1Report struct {
+	// TSSyncLoss Number of sync losses (1.1 and 1.2)
+	TSSyncLoss uint64
+
+	// PATErrors PAT missing for more than PSIMaxIntervalS (counted once per gap), scrambled or with other table ID (1.3)
+	PATErrors uint64
+
+	// CCErrors Packets lost, out of order or duplicated more than once (1.4)
+	CCErrors uint64
+
+	// PMTErrors PMT (of every PMT PID) missing for more than PSIMaxIntervalS (counted once per gap) or scrambled (1.5)
+	PMTErrors uint64
+}
+
+// Priority2Report TR 101 290 priority 2 errors (recommended to monitor)
+type Priority2Report struct {
+	// TransportErrors Packets with the transport error indicator set (2.1)
+	TransportErrors uint64
+
+	// CRCErrors PSI sections with bad CRC or length (2.2)
+	CRCErrors uint64
+
+	// PCRRepetitionErrors PCRs more than PCRMaxIntervalS after the previous one (2.3a)
+	PCRRepetitionErrors uint64
+
+	// PCRDiscontinuityErrors PCRs that go back or jump more than PCRMaxIntervalS (compared to the data received at the average bitrate) without discontinuity indicator (2.3b)
+	PCRDiscontinuityErrors uint64
+
+	// PCRAccuracyErrors PCRs that differ more than PCRMaxAccuracyErrorS from the value expected for the bitrate of the previous PCR interval (2.4), only meaningful for constant bitrate streams
+	PCRAccuracyErrors uint64
+}
+
+// PIDReport Packets and errors of a PID
+type PIDReport struct {
+	PID             int
+	Packets         uint64
+	CCErrors        uint64
+	TransportErrors uint64
+	PCRs            uint64
+}
+
+// Report Result of the analysis
+type Report struct {
+	Packets uint64
+
+	// DurationS Time analyzed (from the PCRs)
+	DurationS float64
+
+	// BitrateBps Average bitrate (from the PCRs)
+	BitrateBps float64
+
+	Priority1 Priority1Report
+	Priority2 Priority2Report
+
+	// PIDs Sorted by PID
+	PIDs []PIDReport
+}
+
+// JSON Returns the report in JSON
+func (r Report) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// pidData Analysis status of a PID
+type pidData struct {
+	report PIDReport
+
+	// Continuity counter (-1 = none) and number of times it has been repeated
+	lastCC     int
+	ccRepeated int
+
+	// Last PCRs (-1 = none) and their packet positions (bytes)
+	lastPCRS   float64
+	lastPCRPos uint64
+	prevPCRS   float64
+	prevPCRPos uint64
+}
+
+// psiTimer Arrival of a PSI table (PAT or PMT of a PID)
+type psiTimer struct {
+	// Analysis time of the last section received (or when it was expected for the 1st time)
+	lastTimeS float64
+
+	// The PSI is missing, the error is already counted
+	isMissing bool
+}
+
+// Analyzer TS error analyzer (TR 101 290 priority 1 and 2), the packets have to be parsed before adding them
+// The packets arrival time is not known, the time is measured with the PCRs of the 1st PCR PID
+type Analyzer struct {
+	report Report
+	pids   map[int]*pidData
+
+	// PAT and PMTs (PIDs found in the PAT) arrival
+	pat     psiTimer
+	pmtPIDs map[int]*psiTimer
+
+	// Bytes received
+	pos uint64
+
+	// Reference PCR PID (-1 = none), analysis time and data used to calculate the average bitrate
+	clockPID      int
+	clockS        float64
+	bitrateBytes  uint64
+	bitrateTimeS  float64
+	psiErrorsSeen uint64
+}
+
+// New Creates a TS analyzer
+func New() Analyzer {
+	return Analyzer{Report{}, make(map[int]*pidData), psiTimer{0, false}, make(map[int]*psiTimer), 0, -1, 0, 0, 0, 0}
+}
+
+// IsPMTPID Returns true if the PID is a PMT of the PATs received
+func (a *Analyzer) IsPMTPID(pID int) bool {
+	return a.pmtPIDs[pID] != nil
+}
+
+// AddSyncLoss Called when the TS sync is lost
+func (a *Analyzer) AddSyncLoss() {
+	a.report.Priority1.TSSyncLoss++
+}
+
+// AddSkippedBytes Called with the bytes discarded to find the sync, needed to know the packets position
+func (a *Analyzer) AddSkippedBytes(skippedBytes int) {
+	a.pos += uint64(skippedBytes)
+}
+
+// AddPacket Analyzes a parsed packet, inputPacketSize is the size of the packet in the input (188, 192 M2TS or 204 DVB)
+func (a *Analyzer) AddPacket(packet *tspacket.TsPacket, inputPacketSize int) {
+	pID := packet.GetPID()
+	if pID < 0 {
+		return
+	}
+
+	pos := a.pos
+	a.pos += uint64(inputPacketSize)
+	a.report.Packets++
+
+	p := a.pids[pID]
+	if p == nil {
+		p = &pidData{PIDReport{PID: pID}, -1, 0, -1, 0, -1, 0}
+		a.pids[pID] = p
+	}
+	p.report.Packets++
+
+	if psiErrors := packet.GetPSIErrors(); psiErrors > a.psiErrorsSeen {
+		a.report.Priority2.CRCErrors += psiErrors - a.psiErrorsSeen
+		a.psiErrorsSeen = psiErrors
+	}
+
+	if packet.IsTransportError() {
+		// The rest of the packet data can not be trusted
+		p.report.TransportErrors++
+		a.report.Priority2.TransportErrors++
+		return
+	}
+
+	if pID != int(tspacket.NullPID) {
+		a.checkContinuity(p, packet)
+	}
+	if pcrS := packet.GetPCRS(); pcrS >= 0 {
+		a.checkPCR(p, packet, pcrS, pos)
+	}
+
+	if pID == int(tspacket.PATPID) {
+		for _, program := range packet.GetPATPrograms() {
+			if a.pmtPIDs[program.PMTPID] == nil {
+				a.pmtPIDs[program.PMTPID] = &psiTimer{a.clockS, false}
+			}
+		}
+		if a.checkPSI(&a.pat, packet, tspacket.PATTableID) {
+			a.report.Priority1.PATErrors++
+		}
+	} else if pmt := a.pmtPIDs[pID]; pmt != nil {
+		if a.checkPSI(pmt, packet, tspacket.PMTTableID) {
+			a.report.Priority1.PMTErrors++
+		}
+	}
+}
+
+// GetReport Returns the analysis result so far
+func (a *Analyzer) GetReport() Report {
+	a.checkPSITimeouts()
+
+	report := a.report
+	report.DurationS = a.clockS
+	if a.bitrateTimeS > 0 {
+		report.BitrateBps = float64(a.bitrateBytes*8) / a.bitrateTimeS
+	}
+
+	report.PIDs = make([]PIDReport, 0, len(a.pids))
+	for _, p := range a.pids {
+		report.PIDs = append(report.PIDs, p.report)
+	}
+	sort.Slice(report.PIDs, func(i, j int) bool { return report.PIDs[i].PID < report.PIDs[j].PID })
+
+	return report
+}
+
+// checkContinuity CC is incremented in every packet with payload, a packet can be duplicated once
+func (a *Analyzer) checkContinuity(p *pidData, packet *tspacket.TsPacket) {
+	if !packet.HasPayload() {
+		return
+	}
+
+	cc := packet.GetContinuityCounter()
+	if p.lastCC >= 0 && !packet.IsDiscontinuity() {
+		if cc == p.lastCC {
+			p.ccRepeated++
+			if p.ccRepeated > 1 {
+				p.report.CCErrors++
+				a.report.Priority1.CCErrors++
+			}
+			return
+		}
+		if cc != (p.lastCC+1)&0x0F {
+			p.report.CCErrors++
+			a.report.Priority1.CCErrors++
+		}
+	}
+
+	p.lastCC = cc
+	p.ccRepeated = 0
+}
+
+// checkPCR Checks the PCR interval, jumps and accuracy, the reference PCR PID advances the analysis time
+func (a *Analyzer) checkPCR(p *pidData, packet *tspacket.TsPacket, pcrS float64, pos uint64) {
+	p.report.PCRs++
+	if a.clockPID < 0 {
+		a.clockPID = p.report.PID
+	}
+
+	if p.lastPCRS >= 0 && !packet.IsDiscontinuity() {
+		pcrDeltaS := pcrS - p.lastPCRS
+		if pcrDeltaS < -tspacket.MaxPCRSValue/2 {
+			// Wrap around
+			pcrDeltaS += tspacket.MaxPCRSValue
+		}
+		bytes := pos - p.lastPCRPos
+
+		// The PCR jumped if it advanced much more than the time needed to receive the data at the average bitrate
+		isDiscontinuity := pcrDeltaS < 0
+		if !isDiscontinuity && pcrDeltaS > PCRMaxIntervalS && a.bitrateTimeS > 0 {
+			arrivalDeltaS := float64(bytes) * a.bitrateTimeS / float64(a.bitrateBytes)
+			isDiscontinuity = pcrDeltaS-arrivalDeltaS > PCRMaxIntervalS
+		}
+
+		if isDiscontinuity {
+			a.report.Priority2.PCRDiscontinuityErrors++
+		} else if pcrDeltaS > PCRMaxIntervalS {
+			a.report.Priority2.PCRRepetitionErrors++
+		} else if p.prevPCRS >= 0 {
+			// Constant bitrate between the last 2 PCRs
+			prevDeltaS := p.lastPCRS - p.prevPCRS
+			if prevDeltaS < 0 {
+				prevDeltaS += tspacket.MaxPCRSValue
+			}
+			expectedS := p.lastPCRS + float64(bytes)*prevDeltaS/float64(p.lastPCRPos-p.prevPCRPos)
+			if diffS := pcrS - expectedS; diffS > PCRMaxAccuracyErrorS || diffS < -PCRMaxAccuracyErrorS {
+				a.report.Priority2.PCRAccuracyErrors++
+			}
+		}
+
+		if p.report.PID == a.clockPID && !isDiscontinuity {
+			a.clockS += pcrDeltaS
+			a.bitrateBytes += bytes
+			a.bitrateTimeS += pcrDeltaS
+			a.checkPSITimeouts()
+		}
+
+		if isDiscontinuity {
+			p.prevPCRS = -1
+		} else {
+			p.prevPCRS = p.lastPCRS
+			p.prevPCRPos = p.lastPCRPos
+		}
+	} else {
+		p.prevPCRS = -1
+	}
+
+	p.lastPCRS = pcrS
+	p.lastPCRPos = pos
+}
+
+// checkPSITimeouts Counts the PAT and PMTs not received in the last PSIMaxIntervalS (once per gap)
+func (a *Analyzer) checkPSITimeouts() {
+	if a.isPSIMissing(&a.pat) {
+		a.report.Priority1.PATErrors++
+	}
+	for _, pmt := range a.pmtPIDs {
+		if a.isPSIMissing(pmt) {
+			a.report.Priority1.PMTErrors++
+		}
+	}
+}
+
+// isPSIMissing Returns true the 1st time the PSI is detected as missing
+func (a *Analyzer) isPSIMissing(t *psiTimer) bool {
+	if t.isMissing || a.clockS-t.lastTimeS <= PSIMaxIntervalS {
+		return false
+	}
+	t.isMissing = true
+
+	return true
+}
+
+// checkPSI Checks a PAT / PMT packet, returns true if the PSI is scrambled or has other table ID (PAT)
+func (a *Analyzer) checkPSI(t *psiTimer, packet *tspacket.TsPacket, tableID uint8) bool {
+	if packet.GetScramblingControl() != 0 {
+		return true
+	}
+
+	payload := packet.GetPayload()
+	if !packet.IsPayloadUnitStart() || len(payload) == 0 || 1+int(payload[0]) >= len(payload) {
+		return false
+	}
+	if payload[1+int(payload[0])] != tableID {
+		// Only the PAT PID is reserved to one table
+		return tableID == tspacket.PATTableID
+	}
+
+	// The missing time is counted by checkPSITimeouts
+	t.lastTimeS = a.clockS
+	t.isMissing = false
+
+	return false
+}
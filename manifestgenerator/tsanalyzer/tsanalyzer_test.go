@@ -0,0 +1,179 @@
+package tsanalyzer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jordicenzano/go-ts-segmenter/manifestgenerator/tspacket"
+)
+
+const packetSize = tspacket.TsDefaultPacketSize
+
+func loadFixture(t *testing.T) []byte {
+	data, err := ioutil.ReadFile("../../fixture/testSmall.ts")
+	if err != nil {
+		t.Fatal("Error opening test file. Err: ", err)
+	}
+
+	return data
+}
+
+func getPID(packet []byte) int {
+	return int(packet[1]&0x1F)<<8 | int(packet[2])
+}
+
+// findPackets Returns the positions of the packets of pID
+func findPackets(data []byte, pID int) []int {
+	ret := []int{}
+	for pos := 0; pos+packetSize <= len(data); pos += packetSize {
+		if getPID(data[pos:]) == pID {
+			ret = append(ret, pos)
+		}
+	}
+
+	return ret
+}
+
+func analyze(t *testing.T, data []byte) Report {
+	report, err := Analyze(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Error analyzing. Err: ", err)
+	}
+
+	return report
+}
+
+func TestAnalyzeClean(t *testing.T) {
+	report := analyze(t, loadFixture(t))
+
+	if report.Packets != 1835 || report.Priority1 != (Priority1Report{}) || report.Priority2.TransportErrors != 0 || report.Priority2.CRCErrors != 0 || report.Priority2.PCRDiscontinuityErrors != 0 {
+		t.Errorf("Wrong report of a clean stream, got: %+v", report)
+	}
+	if report.DurationS < 10 || report.DurationS > 13 {
+		t.Errorf("Wrong duration, got: %f", report.DurationS)
+	}
+	if len(report.PIDs) != 5 || report.PIDs[0].PID != 0 || report.PIDs[0].Packets != 46 {
+		t.Errorf("Wrong PIDs, got: %+v", report.PIDs)
+	}
+}
+
+func TestAnalyzeErrors(t *testing.T) {
+	data := loadFixture(t)
+	videoPackets := findPackets(data, 0x100)
+	patPackets := findPackets(data, 0)
+
+	// Lost video packet
+	lost := append(append([]byte{}, data[:videoPackets[100]]...), data[videoPackets[100]+packetSize:]...)
+	if report := analyze(t, lost); report.Priority1.CCErrors != 1 || report.PIDs[2].PID != 0x100 || report.PIDs[2].CCErrors != 1 {
+		t.Errorf("Wrong CC errors, got: %+v", report)
+	}
+
+	// Corrupted video packet
+	corrupted := append([]byte{}, data...)
+	corrupted[videoPackets[100]+1] |= 0x80
+	if report := analyze(t, corrupted); report.Priority2.TransportErrors != 1 {
+		t.Errorf("Wrong transport errors, got: %+v", report.Priority2)
+	}
+
+	// Bad PAT CRC
+	badCRC := append([]byte{}, data...)
+	badCRC[patPackets[3]+10] ^= 0xFF
+	if report := analyze(t, badCRC); report.Priority2.CRCErrors != 1 || report.Priority1.PATErrors != 0 {
+		t.Errorf("Wrong CRC errors, got: %+v", report)
+	}
+
+	// 2s without PAT
+	noPAT := []byte{}
+	for pos := 0; pos+packetSize <= len(data); pos += packetSize {
+		if pos > patPackets[3] && pos < patPackets[10] && getPID(data[pos:]) == 0 {
+			continue
+		}
+		noPAT = append(noPAT, data[pos:pos+packetSize]...)
+	}
+	if report := analyze(t, noPAT); report.Priority1.PATErrors != 1 || report.Priority1.PMTErrors != 0 {
+		t.Errorf("Wrong PAT errors, got: %+v", report.Priority1)
+	}
+
+	// No PAT at all (a single error for the whole gap)
+	neverPAT := []byte{}
+	for _, pos := range findPackets(data, 0x100) {
+		neverPAT = append(neverPAT, data[pos:pos+packetSize]...)
+	}
+	if report := analyze(t, neverPAT); report.Priority1.PATErrors != 1 || report.Priority1.PMTErrors != 0 {
+		t.Errorf("Wrong PAT errors without PAT, got: %+v", report.Priority1)
+	}
+
+	// 2s without PMT
+	pmtPackets := findPackets(data, 0x1000)
+	noPMT := []byte{}
+	for pos := 0; pos+packetSize <= len(data); pos += packetSize {
+		if pos > pmtPackets[3] && pos < pmtPackets[10] && getPID(data[pos:]) == 0x1000 {
+			continue
+		}
+		noPMT = append(noPMT, data[pos:pos+packetSize]...)
+	}
+	if report := analyze(t, noPMT); report.Priority1.PMTErrors != 1 || report.Priority1.PATErrors != 0 {
+		t.Errorf("Wrong PMT errors, got: %+v", report.Priority1)
+	}
+
+	// Last PMT more than 0.5s before the end
+	lastPMT := []byte{}
+	for pos := 0; pos+packetSize <= len(data); pos += packetSize {
+		if pos > pmtPackets[len(pmtPackets)-10] && getPID(data[pos:]) == 0x1000 {
+			continue
+		}
+		lastPMT = append(lastPMT, data[pos:pos+packetSize]...)
+	}
+	if report := analyze(t, lastPMT); report.Priority1.PMTErrors != 1 {
+		t.Errorf("Wrong PMT errors at the end, got: %+v", report.Priority1)
+	}
+
+	// Garbage in the middle
+	noSync := append(append(append([]byte{}, data[:100*packetSize]...), 1, 2, 3, 4, 5), data[100*packetSize:]...)
+	if report := analyze(t, noSync); report.Priority1.TSSyncLoss != 1 || report.Packets != 1835 || report.Priority1.CCErrors != 0 {
+		t.Errorf("Wrong sync loss, got: %+v", report)
+	}
+
+	// PCR jump of 5s without discontinuity indicator
+	jump := append([]byte{}, data...)
+	for _, pos := range videoPackets[len(videoPackets)/2:] {
+		packet := jump[pos : pos+packetSize]
+		if packet[3]&0x20 == 0 || packet[4] == 0 || packet[5]&0x10 == 0 {
+			continue
+		}
+		base := uint64(packet[6])<<25 | uint64(packet[7])<<17 | uint64(packet[8])<<9 | uint64(packet[9])<<1 | uint64(packet[10]>>7)
+		base += 5 * 90000
+		packet[6], packet[7], packet[8], packet[9] = byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1)
+		packet[10] = (packet[10] & 0x7F) | byte(base<<7)
+	}
+	if report := analyze(t, jump); report.Priority2.PCRDiscontinuityErrors != 1 || report.DurationS > 13 {
+		t.Errorf("Wrong PCR discontinuity errors, got: %+v", report)
+	}
+}
+
+func TestAnalyzePacketSizes(t *testing.T) {
+	data := loadFixture(t)
+
+	m2ts := []byte{}
+	rs := []byte{}
+	for pos := 0; pos+packetSize <= len(data); pos += packetSize {
+		m2ts = append(append(m2ts, 0, 0, byte(pos>>8), byte(pos)), data[pos:pos+packetSize]...)
+		rs = append(append(rs, data[pos:pos+packetSize]...), make([]byte, tspacket.TsRSPacketSize-packetSize)...)
+	}
+
+	clean := analyze(t, data)
+	for _, input := range [][]byte{m2ts, rs} {
+		report := analyze(t, input)
+		if report.Packets != 1835 || report.Priority1 != (Priority1Report{}) || report.Priority2.CRCErrors != 0 {
+			t.Errorf("Wrong report, got: %+v", report)
+		}
+
+		// The bitrate is measured with the input packet size
+		inputPacketSize := float64(len(input)) / float64(len(data)/packetSize)
+		wantBitrateBps := clean.BitrateBps * inputPacketSize / float64(packetSize)
+		if diff := report.BitrateBps - wantBitrateBps; diff > 1 || diff < -1 || report.DurationS != clean.DurationS {
+			t.Errorf("Wrong bitrate with %f bytes packets, got: %f, want: %f", inputPacketSize, report.BitrateBps, wantBitrateBps)
+		}
+	}
+}
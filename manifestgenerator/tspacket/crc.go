@@ -0,0 +1,27 @@
+package tspacket
+
+var crc32MPEG2Table = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc = crc << 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// CRC32MPEG2 CRC used by the PSI sections (PAT, PMT), a section including its CRC returns 0
+func CRC32MPEG2(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc = crc<<8 ^ crc32MPEG2Table[byte(crc>>24)^b]
+	}
+
+	return crc
+}
@@ -0,0 +1,125 @@
+package tspacket
+
+const (
+	// AC3StreamType indicates AC-3 audio ES (ATSC)
+	AC3StreamType uint8 = 0x81
+
+	// EAC3StreamType indicates E-AC-3 audio ES (ATSC)
+	EAC3StreamType uint8 = 0x87
+
+	// PrivatePESStreamType indicates private data PES (DVB uses it for AC-3 / E-AC-3 with descriptors)
+	PrivatePESStreamType uint8 = 0x06
+
+	// RegistrationDescriptorTag registration_descriptor, format_identifier of the stream
+	RegistrationDescriptorTag uint8 = 0x05
+
+	// ISO639LanguageDescriptorTag ISO_639_language_descriptor, language(s) of the stream
+	ISO639LanguageDescriptorTag uint8 = 0x0A
+
+	// AC3DescriptorTag DVB AC-3 descriptor
+	AC3DescriptorTag uint8 = 0x6A
+
+	// EAC3DescriptorTag DVB enhanced AC-3 descriptor
+	EAC3DescriptorTag uint8 = 0x7A
+
+	// ATSCAC3DescriptorTag ATSC AC-3 audio descriptor
+	ATSCAC3DescriptorTag uint8 = 0x81
+
+	// ATSCEAC3DescriptorTag ATSC E-AC-3 audio descriptor
+	ATSCEAC3DescriptorTag uint8 = 0xCC
+)
+
+const (
+	// CodecH264 H.264 video (HLS CODECS prefix)
+	CodecH264 string = "avc1"
+
+	// CodecAAC AAC audio (HLS CODECS prefix)
+	CodecAAC string = "mp4a"
+
+	// CodecAC3 AC-3 audio (HLS CODECS)
+	CodecAC3 string = "ac-3"
+
+	// CodecEAC3 E-AC-3 audio (HLS CODECS)
+	CodecEAC3 string = "ec-3"
+)
+
+// PMTDescriptor Raw descriptor of a PMT elementary stream
+type PMTDescriptor struct {
+	Tag  uint8
+	Data []byte
+}
+
+// PMTStream Elementary stream of the PMT with the info of its descriptors
+type PMTStream struct {
+	StreamType uint8
+	PID        uint16
+
+	// Language ISO 639-2 code of the 1st language of the ISO 639 language descriptor ("" if not present)
+	Language string
+
+	// AudioType audio_type of the ISO 639 language descriptor (0 = undefined, 1 = clean effects, 2 = hearing impaired, 3 = visual impaired commentary)
+	AudioType uint8
+
+	// Registration format_identifier of the registration descriptor ("" if not present)
+	Registration string
+
+	// Codec HLS codec detected from the stream type and descriptors ("" if unknown)
+	Codec string
+
+	Descriptors []PMTDescriptor
+}
+
+// newPMTStream Creates the stream info from the PMT ES loop entry, the descriptors data is not copied
+func newPMTStream(streamType uint8, pID uint16, descriptors []byte) PMTStream {
+	s := PMTStream{StreamType: streamType, PID: pID}
+
+	switch streamType {
+	case H264StreamType:
+		s.Codec = CodecH264
+	case ADTSStreamType:
+		s.Codec = CodecAAC
+	case AC3StreamType:
+		s.Codec = CodecAC3
+	case EAC3StreamType:
+		s.Codec = CodecEAC3
+	}
+
+	for pos := 0; pos+2 <= len(descriptors); {
+		tag := descriptors[pos]
+		dataEnd := pos + 2 + int(descriptors[pos+1])
+		if dataEnd > len(descriptors) {
+			break
+		}
+		data := descriptors[pos+2 : dataEnd]
+		s.Descriptors = append(s.Descriptors, PMTDescriptor{tag, data})
+
+		switch tag {
+		case ISO639LanguageDescriptorTag:
+			if len(data) >= 4 && s.Language == "" {
+				s.Language = string(data[:3])
+				s.AudioType = data[3]
+			}
+		case RegistrationDescriptorTag:
+			if len(data) >= 4 {
+				s.Registration = string(data[:4])
+				if s.Registration == "AC-3" && s.Codec == "" {
+					s.Codec = CodecAC3
+				} else if s.Registration == "EAC3" && s.Codec == "" {
+					s.Codec = CodecEAC3
+				}
+			}
+		case AC3DescriptorTag, ATSCAC3DescriptorTag:
+			if streamType == PrivatePESStreamType || streamType == AC3StreamType {
+				s.Codec = CodecAC3
+			}
+		case EAC3DescriptorTag, ATSCEAC3DescriptorTag:
+			if streamType == PrivatePESStreamType || streamType == EAC3StreamType {
+				s.Codec = CodecEAC3
+			}
+		}
+
+		pos = dataEnd
+	}
+
+	return s
+}
@@ -0,0 +1,244 @@
+package tspacket
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// PATTableID Table ID of the PAT sections
+	PATTableID uint8 = 0x00
+
+	// PMTTableID Table ID of the PMT sections
+	PMTTableID uint8 = 0x02
+
+	// stuffingTableID Table ID used to stuff the rest of the packet after the last section
+	stuffingTableID uint8 = 0xFF
+
+	// psiHeaderSize table_id + section_syntax_indicator ... section_length
+	psiHeaderSize int = 3
+
+	// psiMaxSectionLength Max section_length of PAT and PMT sections
+	psiMaxSectionLength int = 1021
+
+	// psiCRCSize CRC32 at the end of every section
+	psiCRCSize int = 4
+)
+
+// psiSection PSI section being assembled from the TS packets of a PID
+type psiSection struct {
+	data []byte
+
+	// TS packets that carry the section
+	packets []byte
+
+	// Last continuity counter received (-1 = none)
+	lastCC int
+}
+
+// psiAssembler Assembles the PSI sections (PAT, PMT) that span multiple TS packets and validates them
+type psiAssembler struct {
+	sections map[uint16]*psiSection
+
+	// Number of sections rejected (bad length, syntax or CRC)
+	errors uint64
+}
+
+func newPSIAssembler() psiAssembler {
+	return psiAssembler{make(map[uint16]*psiSection), 0}
+}
+
+// addPacket Adds the payload of a TS packet, it returns the complete and valid sections of tableID and the TS packets that carry them
+// A section that ends in this packet only lists the packets from the one where it started
+func (a *psiAssembler) addPacket(packet []byte, pID uint16, payloadUnitStart bool, cc uint8, payload []byte, tableID uint8) (sections [][]byte, packets []byte) {
+	s := a.sections[pID]
+	if s == nil {
+		s = &psiSection{nil, nil, -1}
+		a.sections[pID] = s
+	}
+
+	if s.lastCC >= 0 {
+		if int(cc) == s.lastCC && !payloadUnitStart {
+			// Duplicated packet
+			return
+		}
+		if int(cc) != (s.lastCC+1)&0x0F {
+			// Lost packets, the section in process is incomplete
+			s.data = s.data[:0]
+		}
+	}
+	s.lastCC = int(cc)
+
+	if payloadUnitStart {
+		if len(payload) == 0 || 1+int(payload[0]) > len(payload) {
+			s.data = s.data[:0]
+			return
+		}
+		pointer := int(payload[0])
+		if len(s.data) > 0 {
+			// End of the section started in previous packets
+			s.data = append(s.data, payload[1:1+pointer]...)
+			s.packets = append(s.packets, packet...)
+			sections, packets = a.popSections(s, tableID, sections, packets)
+		}
+
+		s.data = append(s.data[:0], payload[1+pointer:]...)
+		s.packets = append(s.packets[:0], packet...)
+	} else if len(s.data) > 0 {
+		s.data = append(s.data, payload...)
+		s.packets = append(s.packets, packet...)
+	}
+
+	sections, packets = a.popSections(s, tableID, sections, packets)
+
+	return
+}
+
+// popSections Removes the complete sections from the start of the data and returns the valid ones of tableID
+func (a *psiAssembler) popSections(s *psiSection, tableID uint8, sections [][]byte, packets []byte) ([][]byte, []byte) {
+	for len(s.data) > 0 {
+		if s.data[0] == stuffingTableID {
+			// Rest of the packet is stuffing
+			s.data = s.data[:0]
+			break
+		}
+		if len(s.data) < psiHeaderSize {
+			break
+		}
+
+		sectionLength := int(binary.BigEndian.Uint16(s.data[1:]) & 0x0FFF)
+		if sectionLength > psiMaxSectionLength || sectionLength < 5+psiCRCSize {
+			a.errors++
+			s.data = s.data[:0]
+			break
+		}
+		sectionEnd := psiHeaderSize + sectionLength
+		if len(s.data) < sectionEnd {
+			break
+		}
+
+		section := s.data[:sectionEnd]
+		if section[1]&0x80 == 0 || CRC32MPEG2(section) != 0 {
+			a.errors++
+		} else if section[0] == tableID && section[5]&0x01 != 0 {
+			// Only current sections (current_next_indicator = 1)
+			sections = append(sections, append([]byte(nil), section...))
+			if packets == nil {
+				packets = append([]byte(nil), s.packets...)
+			}
+		}
+
+		s.data = s.data[sectionEnd:]
+	}
+
+	if len(s.data) == 0 {
+		s.data = nil
+	}
+
+	return sections, packets
+}
+
+// parsePSI Adds the packet payload to the PSI assembler and parses the PAT / PMT sections completed
+func (p *TsPacket) parsePSI(pmtPID int, pmtProgramNumber int) {
+	if p.transportPacket.AdaptationFieldControl&0x1 == 0 {
+		return
+	}
+	start := 4
+	if p.transportPacket.AdaptationFieldControl&0x2 != 0 {
+		start += 1 + int(p.buf[4])
+	}
+	if start >= len(p.buf) {
+		return
+	}
+
+	tableID := PATTableID
+	if p.transportPacket.PID != PATPID {
+		tableID = PMTTableID
+	}
+
+	sections, packets := p.psi.addPacket(p.buf, p.transportPacket.PID, p.transportPacket.PayloadUnitStartIndicator, p.transportPacket.ContinuityCounter, p.buf[start:], tableID)
+	if len(sections) == 0 {
+		return
+	}
+	if len(packets) > len(p.buf) {
+		p.psiPackets = packets
+	}
+
+	for _, section := range sections {
+		if tableID == PATTableID {
+			p.parsePATSection(section)
+		} else {
+			p.parsePMTSection(section, pmtProgramNumber)
+		}
+	}
+}
+
+// parsePATSection Parses a valid PAT section, PmtPID is the PMT of the 1st program (the network PID is skipped)
+func (p *TsPacket) parsePATSection(section []byte) {
+	programsEnd := len(section) - psiCRCSize
+	for pos := 8; pos+4 <= programsEnd; pos += 4 {
+		programNumber := int(binary.BigEndian.Uint16(section[pos:]))
+		if programNumber == 0 {
+			// Network PID
+			continue
+		}
+
+		p.transportPacket.Pat.Programs = append(p.transportPacket.Pat.Programs, PATProgram{programNumber, int(binary.BigEndian.Uint16(section[pos+2:]) & 0x1FFF)})
+	}
+	if len(p.transportPacket.Pat.Programs) == 0 {
+		return
+	}
+
+	p.transportPacket.Pat.PmtPID = uint16(p.transportPacket.Pat.Programs[0].PMTPID)
+	p.transportPacket.Pat.valid = true
+}
+
+// parsePMTSection Parses a valid PMT section, the elementary streams are classified by stream type and their descriptors parsed
+// The sections of other programs than programNumber (-1 = any) are ignored, several programs can share the PMT PID
+func (p *TsPacket) parsePMTSection(section []byte, programNumber int) {
+	if len(section) < 12+psiCRCSize {
+		return
+	}
+	if programNumber >= 0 && int(binary.BigEndian.Uint16(section[3:])) != programNumber {
+		return
+	}
+
+	p.transportPacket.Pmt.Version = (section[5] >> 1) & 0x1F
+
+	esEnd := len(section) - psiCRCSize
+	for pos := 12 + int(binary.BigEndian.Uint16(section[10:])&0x0FFF); pos+5 <= esEnd; {
+		streamType := section[pos]
+		pid := binary.BigEndian.Uint16(section[pos+1:]) & 0x1FFF
+		descriptorsEnd := pos + 5 + int(binary.BigEndian.Uint16(section[pos+3:])&0x0FFF)
+		if descriptorsEnd > esEnd {
+			break
+		}
+
+		switch streamType {
+		case H264StreamType:
+			p.transportPacket.Pmt.Videoh264 = append(p.transportPacket.Pmt.Videoh264, pid)
+		case ADTSStreamType:
+			p.transportPacket.Pmt.AudioADTS = append(p.transportPacket.Pmt.AudioADTS, pid)
+		default:
+			p.transportPacket.Pmt.Other = append(p.transportPacket.Pmt.Other, pid)
+		}
+		p.transportPacket.Pmt.Streams = append(p.transportPacket.Pmt.Streams, newPMTStream(streamType, pid, section[pos+5:descriptorsEnd]))
+
+		pos = descriptorsEnd
+	}
+
+	p.transportPacket.Pmt.valid = true
+}
+
+// GetPSIBuffer Gets the TS packets that carry the PAT / PMT completed in this packet (the packet buffer if the section fits in it)
+func (p *TsPacket) GetPSIBuffer() []byte {
+	if p.psiPackets != nil {
+		return p.psiPackets
+	}
+
+	return p.buf
+}
+
+// GetPSIErrors Gets the number of PSI sections rejected so far (bad length, syntax or CRC)
+func (p *TsPacket) GetPSIErrors() uint64 {
+	return p.psi.errors
+}
@@ -0,0 +1,104 @@
+package tspacket
+
+const (
+	// DefaultSyncLockPackets Consecutive sync bytes (at packet size spacing) needed to lock, 0x47 is common in the payload
+	DefaultSyncLockPackets int = 3
+
+	// TsM2TSPacketSize M2TS (Blu-ray) packet size, 4 bytes header (copy permission and arrival timestamp) + TS packet
+	TsM2TSPacketSize int = 192
+
+	// TsRSPacketSize DVB packet size, TS packet + 16 Reed-Solomon bytes
+	TsRSPacketSize int = 204
+
+	// M2TSHeaderSize Size of the header before the TS packet in M2TS
+	M2TSHeaderSize int = 4
+)
+
+// PacketSizes Input packet sizes supported, in detection order
+var PacketSizes = []int{TsDefaultPacketSize, TsM2TSPacketSize, TsRSPacketSize}
+
+// GetSyncOffset Returns the position of the TS packet (sync byte) inside an input packet
+func GetSyncOffset(packetSize int) int {
+	if packetSize == TsM2TSPacketSize {
+		return M2TSHeaderSize
+	}
+	return 0
+}
+
+// GetM2TSArrivalTimestamp Returns the arrival timestamp (27MHz, 30 bits) of the M2TS header
+func GetM2TSArrivalTimestamp(header []byte) uint32 {
+	return (uint32(header[0])<<24 | uint32(header[1])<<16 | uint32(header[2])<<8 | uint32(header[3])) & 0x3FFFFFFF
+}
+
+// FindSync Returns the position of the 1st sync byte followed by numPackets-1 sync bytes at packetSize spacing (locked = true)
+// If there is not enough data to check all of them it returns the 1st candidate that passes the checks possible (locked = false), -1 if none
+func FindSync(buf []byte, packetSize int, numPackets int) (pos int, locked bool) {
+	for start := 0; start < len(buf); start++ {
+		if buf[start] != tsStartByte {
+			continue
+		}
+
+		n := countSyncBytes(buf, start, packetSize, numPackets)
+		if n >= numPackets {
+			return start, true
+		}
+		if start+n*packetSize >= len(buf) {
+			// Not enough data to confirm it
+			return start, false
+		}
+	}
+
+	return -1, false
+}
+
+// DetectSync Like FindSync trying all the PacketSizes, returns the position of the input packet (before the sync byte in M2TS) and its size
+// If there is not enough data to confirm a candidate it returns the 1st byte that can belong to it and packetSize 0
+func DetectSync(buf []byte, numPackets int) (pos int, packetSize int, locked bool) {
+	for start := 0; start < len(buf); start++ {
+		if buf[start] != tsStartByte {
+			continue
+		}
+
+		isCandidate := false
+		for _, size := range PacketSizes {
+			offset := GetSyncOffset(size)
+			if start < offset {
+				// Header lost
+				continue
+			}
+
+			n := countSyncBytes(buf, start, size, numPackets)
+			if n >= numPackets {
+				return start - offset, size, true
+			}
+			if start+n*size >= len(buf) {
+				isCandidate = true
+			}
+		}
+		if isCandidate {
+			// Not enough data to confirm it, keeps the possible M2TS header
+			return max(0, start-M2TSHeaderSize), 0, false
+		}
+	}
+
+	return -1, 0, false
+}
+
+// countSyncBytes Counts the consecutive sync bytes (up to numPackets) from start at packetSize spacing
+func countSyncBytes(buf []byte, start int, packetSize int, numPackets int) int {
+	n := 1
+	for ; n < numPackets; n++ {
+		next := start + n*packetSize
+		if next >= len(buf) || buf[next] != tsStartByte {
+			break
+		}
+	}
+	return n
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -1,7 +1,6 @@
 package tspacket
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 )
@@ -13,6 +12,9 @@ const (
 	// MaxPCRSValue (in seconds). 2^33 / 90000 (33 bits used by pcr with timebase of 90KHz)
 	MaxPCRSValue float64 = 95443
 
+	// MaxPTSValue PTS / DTS rollover (33 bits, 90KHz)
+	MaxPTSValue int64 = 1 << 33
+
 	// tsStartByte Start byte for TS pakcets
 	tsStartByte uint8 = 0x47
 
@@ -24,6 +26,9 @@ const (
 
 	// PATPID PID of PAT table
 	PATPID uint16 = 0
+
+	// NullPID PID of the null (stuffing) packets
+	NullPID uint16 = 0x1FFF
 )
 
 // transportPacketData TS packet info
@@ -69,10 +74,13 @@ func (t *transportPacketData) Reset() {
 	t.AdaptationField.PCRData.PCRs = 0
 	t.Pat.valid = false
 	t.Pat.PmtPID = 0
+	t.Pat.Programs = t.Pat.Programs[:0]
 	t.Pmt.valid = false
+	t.Pmt.Version = 0
 	t.Pmt.AudioADTS = t.Pmt.AudioADTS[:0]
 	t.Pmt.Videoh264 = t.Pmt.Videoh264[:0]
 	t.Pmt.Other = t.Pmt.Other[:0]
+	t.Pmt.Streams = t.Pmt.Streams[:0]
 }
 
 // transportPacketAdaptationFieldData TS adaptation field packet info
@@ -98,18 +106,29 @@ type transportPacketAdaptationPCRFieldData struct {
 	valid                          bool
 }
 
-// PAT data storing the PMT ID
+// PAT data storing the PMT ID (1st program) and all the programs
 type programAddressTable struct {
-	valid  bool
-	PmtPID uint16
+	valid    bool
+	PmtPID   uint16
+	Programs []PATProgram
+}
+
+// PATProgram Program listed in the PAT
+type PATProgram struct {
+	ProgramNumber int
+	PMTPID        int
 }
 
 // PMT data storing the video and audio PIDs to process
 type programMapTable struct {
 	valid     bool
+	Version   uint8
 	Videoh264 []uint16
 	AudioADTS []uint16
 	Other     []uint16
+
+	// All the streams (in PMT order) with their descriptors
+	Streams []PMTStream
 }
 
 // TsPacket Transport stream packet
@@ -119,11 +138,15 @@ type TsPacket struct {
 	transportPacket transportPacketData
 	pat             programAddressTable
 	pmt             programMapTable
+
+	// PSI sections assembler (kept between packets) and TS packets of the sections completed in this packet
+	psi        psiAssembler
+	psiPackets []byte
 }
 
 // New Creates a TsPacket instance
 func New(packetSize int) TsPacket {
-	p := TsPacket{make([]byte, packetSize), 0, *new(transportPacketData), programAddressTable{valid: false, PmtPID: 0}, programMapTable{valid: false}}
+	p := TsPacket{make([]byte, packetSize), 0, *new(transportPacketData), programAddressTable{valid: false, PmtPID: 0}, programMapTable{valid: false}, newPSIAssembler(), nil}
 
 	return p
 }
@@ -132,13 +155,16 @@ func New(packetSize int) TsPacket {
 func CloneFrom(srcPckt TsPacket) TsPacket {
 	pcktSize := len(srcPckt.buf)
 
-	newPckt := TsPacket{make([]byte, pcktSize), 0, *new(transportPacketData), programAddressTable{valid: false, PmtPID: 0}, programMapTable{valid: false}}
+	newPckt := TsPacket{make([]byte, pcktSize), 0, *new(transportPacketData), programAddressTable{valid: false, PmtPID: 0}, programMapTable{valid: false}, newPSIAssembler(), nil}
 	copy(newPckt.buf, srcPckt.buf)
 
 	// Copy all data
 	newPckt.lastIndex = srcPckt.lastIndex
 	newPckt.transportPacket = srcPckt.transportPacket
+	newPckt.transportPacket.Pat.Programs = append([]PATProgram(nil), srcPckt.transportPacket.Pat.Programs...)
+	newPckt.transportPacket.Pmt.Streams = append([]PMTStream(nil), srcPckt.transportPacket.Pmt.Streams...)
 	newPckt.pat = srcPckt.pat
+	newPckt.psiPackets = append([]byte(nil), srcPckt.psiPackets...)
 
 	newPckt.pmt.AudioADTS = make([]uint16, len(srcPckt.pmt.AudioADTS))
 	copy(newPckt.pmt.AudioADTS, srcPckt.pmt.AudioADTS)
@@ -151,10 +177,41 @@ func CloneFrom(srcPckt TsPacket) TsPacket {
 	return newPckt
 }
 
+// CopyFrom Copies all the packet data (except the PSI assembler state) reusing the buffers of the packet
+func (p *TsPacket) CopyFrom(srcPckt *TsPacket) {
+	p.buf = append(p.buf[:0], srcPckt.buf...)
+	p.lastIndex = srcPckt.lastIndex
+
+	programs := append(p.transportPacket.Pat.Programs[:0], srcPckt.transportPacket.Pat.Programs...)
+	streams := append(p.transportPacket.Pmt.Streams[:0], srcPckt.transportPacket.Pmt.Streams...)
+	videoh264 := append(p.transportPacket.Pmt.Videoh264[:0], srcPckt.transportPacket.Pmt.Videoh264...)
+	audioADTS := append(p.transportPacket.Pmt.AudioADTS[:0], srcPckt.transportPacket.Pmt.AudioADTS...)
+	other := append(p.transportPacket.Pmt.Other[:0], srcPckt.transportPacket.Pmt.Other...)
+	p.transportPacket = srcPckt.transportPacket
+	p.transportPacket.Pat.Programs = programs
+	p.transportPacket.Pmt.Streams = streams
+	p.transportPacket.Pmt.Videoh264 = videoh264
+	p.transportPacket.Pmt.AudioADTS = audioADTS
+	p.transportPacket.Pmt.Other = other
+
+	p.pat = srcPckt.pat
+	p.pmt.valid = srcPckt.pmt.valid
+	p.pmt.AudioADTS = append(p.pmt.AudioADTS[:0], srcPckt.pmt.AudioADTS...)
+	p.pmt.Videoh264 = append(p.pmt.Videoh264[:0], srcPckt.pmt.Videoh264...)
+	p.pmt.Other = append(p.pmt.Other[:0], srcPckt.pmt.Other...)
+
+	if srcPckt.psiPackets != nil {
+		p.psiPackets = append(p.psiPackets[:0], srcPckt.psiPackets...)
+	} else {
+		p.psiPackets = nil
+	}
+}
+
 // Reset packet
 func (p *TsPacket) Reset() {
 	p.lastIndex = 0
 	p.transportPacket.Reset()
+	p.psiPackets = nil
 }
 
 // AddData Adds bytes to the packet
@@ -176,205 +233,60 @@ func (p *TsPacket) IsComplete() bool {
 	return false
 }
 
-// Parse Parse the packet
-func (p *TsPacket) Parse(pmtPID int) bool {
+// Parse Parse the packet, the PMT sections are only parsed if they are from pmtPID and the program pmtProgramNumber (-1 = any)
+func (p *TsPacket) Parse(pmtPID int, pmtProgramNumber int) bool {
 	if !p.IsComplete() {
 		return false
 	}
 
-	var transportPacket struct {
-		SyncByte                      uint8
-		ErrorIndicatorPayloadUnitPid  uint16
-		ScrambledAdapFieldContCounter uint8
-	}
-
-	r := bytes.NewReader(p.buf)
-	err := binary.Read(r, binary.BigEndian, &transportPacket)
-	if err != nil {
-		return false
-	}
+	// Direct access to the packet buffer (4 bytes header + adaptation field), no allocations
+	buf := p.buf
 	p.transportPacket.Reset()
+	p.psiPackets = nil
 
-	p.transportPacket.SyncByte = transportPacket.SyncByte
-	if transportPacket.ErrorIndicatorPayloadUnitPid&0x8000 > 0 {
-		p.transportPacket.TransportErrorIndicator = true
-	}
-	if transportPacket.ErrorIndicatorPayloadUnitPid&0x4000 > 0 {
-		p.transportPacket.PayloadUnitStartIndicator = true
-	}
-	if transportPacket.ErrorIndicatorPayloadUnitPid&0x2000 > 0 {
-		p.transportPacket.TransportPriority = true
-	}
-	p.transportPacket.PID = transportPacket.ErrorIndicatorPayloadUnitPid & 0x1FFF
+	p.transportPacket.SyncByte = buf[0]
+	p.transportPacket.TransportErrorIndicator = buf[1]&0x80 > 0
+	p.transportPacket.PayloadUnitStartIndicator = buf[1]&0x40 > 0
+	p.transportPacket.TransportPriority = buf[1]&0x20 > 0
+	p.transportPacket.PID = uint16(buf[1]&0x1F)<<8 | uint16(buf[2])
 
-	p.transportPacket.TransportScramblingControl = (transportPacket.ScrambledAdapFieldContCounter & 0xC0) >> 6
-	p.transportPacket.AdaptationFieldControl = (transportPacket.ScrambledAdapFieldContCounter & 0x30) >> 4
-	p.transportPacket.ContinuityCounter = transportPacket.ScrambledAdapFieldContCounter & 0x0F
+	p.transportPacket.TransportScramblingControl = (buf[3] & 0xC0) >> 6
+	p.transportPacket.AdaptationFieldControl = (buf[3] & 0x30) >> 4
+	p.transportPacket.ContinuityCounter = buf[3] & 0x0F
 
 	if p.transportPacket.AdaptationFieldControl == 2 || p.transportPacket.AdaptationFieldControl == 3 {
-		var adaptationFieldLength uint8
-		err := binary.Read(r, binary.BigEndian, &adaptationFieldLength)
-		if err != nil {
-			return false
-		}
+		adaptationFieldLength := buf[4]
 
 		if adaptationFieldLength > 0 {
-			var adaptationFieldFlags uint8
-			err := binary.Read(r, binary.BigEndian, &adaptationFieldFlags)
-			if err != nil {
-				return false
-			}
-			if (adaptationFieldFlags & 0x80) > 0 {
-				p.transportPacket.AdaptationField.DiscontinuityIndicator = true
-			}
-			if (adaptationFieldFlags & 0x40) > 0 {
-				p.transportPacket.AdaptationField.RandomAccessIndicator = true
-			}
-			if (adaptationFieldFlags & 0x20) > 0 {
-				p.transportPacket.AdaptationField.ElementaryStreamPriorityIndicator = true
-			}
-			if (adaptationFieldFlags & 0x10) > 0 {
-				p.transportPacket.AdaptationField.PCRFlag = true
-			}
-			if (adaptationFieldFlags & 0x08) > 0 {
-				p.transportPacket.AdaptationField.OPCRFlag = true
-			}
-			if (adaptationFieldFlags & 0x04) > 0 {
-				p.transportPacket.AdaptationField.SplicingPointFlag = true
-			}
-			if (adaptationFieldFlags & 0x02) > 0 {
-				p.transportPacket.AdaptationField.TransportPrivateDataFlag = true
-			}
-			if (adaptationFieldFlags & 0x01) > 0 {
-				p.transportPacket.AdaptationField.AdaptationFieldExtensionFlag = true
-			}
-
-			if p.transportPacket.AdaptationField.PCRFlag == true {
-				var pcrDataFirst32b uint32
-				err := binary.Read(r, binary.BigEndian, &pcrDataFirst32b)
-				if err != nil {
-					return false
-				}
-
-				var pcrDataLast16b uint16
-				err = binary.Read(r, binary.BigEndian, &pcrDataLast16b)
-				if err != nil {
-					return false
-				}
-				p.transportPacket.AdaptationField.PCRData.ProgramClockReferenceExtension = uint16(pcrDataLast16b & 0x1FF)
-				p.transportPacket.AdaptationField.PCRData.reserved = uint8((pcrDataLast16b >> 9) & 0x3F)
-
-				p.transportPacket.AdaptationField.PCRData.ProgramClockReferenceBase = uint64(pcrDataFirst32b)*2 + uint64((pcrDataLast16b>>15)&0x1)
-
-				p.transportPacket.AdaptationField.PCRData.PCRs = calculatePCRS(p.transportPacket.AdaptationField.PCRData.ProgramClockReferenceBase, p.transportPacket.AdaptationField.PCRData.ProgramClockReferenceExtension)
-
-				p.transportPacket.AdaptationField.PCRData.valid = true
+			adaptationFieldFlags := buf[5]
+			adaptationField := &p.transportPacket.AdaptationField
+			adaptationField.DiscontinuityIndicator = adaptationFieldFlags&0x80 > 0
+			adaptationField.RandomAccessIndicator = adaptationFieldFlags&0x40 > 0
+			adaptationField.ElementaryStreamPriorityIndicator = adaptationFieldFlags&0x20 > 0
+			adaptationField.PCRFlag = adaptationFieldFlags&0x10 > 0
+			adaptationField.OPCRFlag = adaptationFieldFlags&0x08 > 0
+			adaptationField.SplicingPointFlag = adaptationFieldFlags&0x04 > 0
+			adaptationField.TransportPrivateDataFlag = adaptationFieldFlags&0x02 > 0
+			adaptationField.AdaptationFieldExtensionFlag = adaptationFieldFlags&0x01 > 0
+
+			if adaptationField.PCRFlag == true {
+				pcrDataFirst32b := binary.BigEndian.Uint32(buf[6:10])
+				pcrDataLast16b := binary.BigEndian.Uint16(buf[10:12])
+				adaptationField.PCRData.ProgramClockReferenceExtension = uint16(pcrDataLast16b & 0x1FF)
+				adaptationField.PCRData.reserved = uint8((pcrDataLast16b >> 9) & 0x3F)
+
+				adaptationField.PCRData.ProgramClockReferenceBase = uint64(pcrDataFirst32b)*2 + uint64((pcrDataLast16b>>15)&0x1)
+
+				adaptationField.PCRData.PCRs = calculatePCRS(adaptationField.PCRData.ProgramClockReferenceBase, adaptationField.PCRData.ProgramClockReferenceExtension)
+
+				adaptationField.PCRData.valid = true
 			}
 		}
 	}
 
+	// PSI sections (PAT, PMT), they can span multiple packets
 	if p.transportPacket.PID == PATPID || int(p.transportPacket.PID) == pmtPID {
-		if p.transportPacket.PayloadUnitStartIndicator {
-			var length uint8
-
-			err = binary.Read(r, binary.BigEndian, &length)
-			if err != nil {
-				return false
-			}
-
-			var n uint8
-			var dummyByte uint8
-			for n < length {
-				err = binary.Read(r, binary.BigEndian, &dummyByte)
-				if err != nil {
-					return false
-				}
-
-				n++
-			}
-		}
-	}
-
-	// PAT Packet (Getting the 1st PMT info, so assuming only one program and there is NO network ID)
-	if p.transportPacket.PID == PATPID {
-		var pmtPID16b struct {
-			TableID                    uint8
-			FlagsReservedSectionLength uint16
-			TSId                       uint16
-			Flags                      uint8
-			SectionNumber              uint8
-			LastSectionNumber          uint8
-
-			//Initial PMT
-			ProgramNumber  uint16
-			ReservedPMTPID uint16
-		}
-		err = binary.Read(r, binary.BigEndian, &pmtPID16b)
-		if err != nil {
-			return false
-		}
-		p.transportPacket.Pat.PmtPID = pmtPID16b.ReservedPMTPID & 0x1FFF
-		p.transportPacket.Pat.valid = true
-	}
-
-	// PMT Packet
-	if pmtPID == int(p.transportPacket.PID) {
-		var tableInfo struct {
-			_                uint8
-			SectionLength    uint16
-			_                uint32
-			_                uint16
-			_                uint8
-			ProgamInfoLength uint16
-		}
-		err = binary.Read(r, binary.BigEndian, &tableInfo)
-		if err != nil {
-			return false
-		}
-
-		sectionLength := tableInfo.SectionLength & 0x0FFF
-		tableEnd := int(sectionLength - 13)
-
-		programInfoLength := tableInfo.ProgamInfoLength & 0x0FFF
-
-		paddingBytes := programInfoLength
-		offset := 0
-
-		for offset < tableEnd {
-			for paddingBytes > 0 {
-				var pad uint8
-				err = binary.Read(r, binary.BigEndian, &pad)
-				if err != nil {
-					return false
-				}
-				paddingBytes = paddingBytes - 1
-				offset = offset + 1
-			}
-			var program struct {
-				StreamType uint8
-				PID        uint16
-				Next       uint16
-			}
-			err = binary.Read(r, binary.BigEndian, &program)
-			if err != nil {
-				return false
-			}
-			offset = offset + 5
-
-			paddingBytes = program.Next & 0x0FFF
-			pid := program.PID & 0x1FFF
-
-			switch program.StreamType {
-			case H264StreamType:
-				p.transportPacket.Pmt.Videoh264 = append(p.transportPacket.Pmt.Videoh264, pid)
-			case ADTSStreamType:
-				p.transportPacket.Pmt.AudioADTS = append(p.transportPacket.Pmt.AudioADTS, pid)
-			default:
-				p.transportPacket.Pmt.Other = append(p.transportPacket.Pmt.Other, pid)
-			}
-
-			p.transportPacket.Pmt.valid = true
-		}
+		p.parsePSI(pmtPID, pmtProgramNumber)
 	}
 
 	p.transportPacket.valid = true
@@ -406,6 +318,31 @@ func (p *TsPacket) GetPCRS() (PCRs float64) {
 	return
 }
 
+// GetPTS Gets the PTS (90KHz) of the PES packet that starts in this packet (-1 if none)
+func (p *TsPacket) GetPTS() int64 {
+	if !p.IsPayloadUnitStart() {
+		return -1
+	}
+
+	// PES header: start code (3), stream ID, length (2), flags (2), header length, PTS (5)
+	payload := p.GetPayload()
+	if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return -1
+	}
+	if payload[6]&0xC0 != 0x80 || payload[7]&0x80 == 0 {
+		// No optional PES header or no PTS
+		return -1
+	}
+
+	pts := int64(payload[9]>>1&0x07) << 30
+	pts |= int64(payload[10]) << 22
+	pts |= int64(payload[11]>>1) << 15
+	pts |= int64(payload[12]) << 7
+	pts |= int64(payload[13] >> 1)
+
+	return pts
+}
+
 // GetPATdata Gets the PAT info if present (so PMT PID)
 func (p *TsPacket) GetPATdata() (PMTPID int) {
 	PMTPID = -1
@@ -433,6 +370,90 @@ func (p *TsPacket) GetPMTdata() (valid bool, Videoh264 []uint16, AudioADTS []uin
 	return
 }
 
+// GetPATPrograms Gets all the programs of the PAT if present (nil if it is not a PAT packet)
+func (p *TsPacket) GetPATPrograms() []PATProgram {
+	if !p.transportPacket.valid || !p.transportPacket.Pat.valid {
+		return nil
+	}
+
+	return p.transportPacket.Pat.Programs
+}
+
+// FilterPATProgram Rewrites the PAT packet keeping only the program programNumber (the other programs are not in the output)
+// A PAT that spans multiple packets is rewritten in its 1st packet (see GetPSIBuffer)
+// Returns false if it is not a PAT packet or the program is not in it
+func (p *TsPacket) FilterPATProgram(programNumber int) bool {
+	pmtPID := -1
+	for _, program := range p.GetPATPrograms() {
+		if program.ProgramNumber == programNumber {
+			pmtPID = program.PMTPID
+		}
+	}
+	if pmtPID < 0 {
+		return false
+	}
+
+	buf := p.GetPSIBuffer()[:len(p.buf)]
+	adaptationFieldControl := (buf[3] >> 4) & 0x3
+	if buf[1]&0x40 == 0 || adaptationFieldControl&0x1 == 0 {
+		return false
+	}
+
+	start := 4
+	if adaptationFieldControl&0x2 != 0 {
+		start += 1 + int(buf[4])
+	}
+	if start >= len(buf) {
+		return false
+	}
+	section := start + 1 + int(buf[start])
+	if section+8+4+4 > len(buf) {
+		return false
+	}
+
+	// Header (8 bytes) + program + CRC
+	sectionLength := 5 + 4 + 4
+	buf[section+1] = (buf[section+1] & 0xF0) | byte(sectionLength>>8)&0x0F
+	buf[section+2] = byte(sectionLength)
+	programPos := section + 8
+	buf[programPos] = byte(programNumber >> 8)
+	buf[programPos+1] = byte(programNumber)
+	buf[programPos+2] = 0xE0 | byte(pmtPID>>8)&0x1F
+	buf[programPos+3] = byte(pmtPID)
+
+	crc := CRC32MPEG2(buf[section : programPos+4])
+	binary.BigEndian.PutUint32(buf[programPos+4:], crc)
+	for i := programPos + 8; i < len(buf); i++ {
+		buf[i] = 0xFF
+	}
+	if p.psiPackets != nil {
+		p.psiPackets = buf
+	}
+
+	p.transportPacket.Pat.Programs = append(p.transportPacket.Pat.Programs[:0], PATProgram{programNumber, pmtPID})
+	p.transportPacket.Pat.PmtPID = uint16(pmtPID)
+
+	return true
+}
+
+// GetPMTStreams Gets all the streams of the PMT with their descriptors if present (nil if it is not a PMT packet)
+func (p *TsPacket) GetPMTStreams() []PMTStream {
+	if !p.transportPacket.valid || !p.transportPacket.Pmt.valid {
+		return nil
+	}
+
+	return p.transportPacket.Pmt.Streams
+}
+
+// GetPMTVersion Gets the PMT version number if present (-1 if it is not a PMT packet)
+func (p *TsPacket) GetPMTVersion() int {
+	if !p.transportPacket.valid || !p.transportPacket.Pmt.valid {
+		return -1
+	}
+
+	return int(p.transportPacket.Pmt.Version)
+}
+
 // GetPID Adds bytes to the packet
 func (p *TsPacket) GetPID() (pID int) {
 	pID = -1
@@ -456,6 +477,57 @@ func (p *TsPacket) String() string {
 	return ret
 }
 
+// GetContinuityCounter Gets the continuity counter (-1 if the packet is not valid)
+func (p *TsPacket) GetContinuityCounter() int {
+	if !p.transportPacket.valid {
+		return -1
+	}
+
+	return int(p.transportPacket.ContinuityCounter)
+}
+
+// HasPayload Return true if the packet carries payload (the continuity counter only increments in these packets)
+func (p *TsPacket) HasPayload() bool {
+	return p.transportPacket.valid && p.transportPacket.AdaptationFieldControl&0x1 != 0
+}
+
+// IsDiscontinuity Return true if the discontinuity indicator is set (the continuity counter can jump)
+func (p *TsPacket) IsDiscontinuity() bool {
+	return p.transportPacket.valid && p.transportPacket.AdaptationField.DiscontinuityIndicator
+}
+
+// IsTransportError Return true if the transport error indicator is set (the packet is corrupted)
+func (p *TsPacket) IsTransportError() bool {
+	return p.transportPacket.valid && p.transportPacket.TransportErrorIndicator
+}
+
+// GetScramblingControl Gets the transport scrambling control (0 = not scrambled)
+func (p *TsPacket) GetScramblingControl() int {
+	return int(p.transportPacket.TransportScramblingControl)
+}
+
+// GetPayload Gets the packet payload (nil if the packet does not have payload)
+func (p *TsPacket) GetPayload() []byte {
+	if !p.HasPayload() {
+		return nil
+	}
+
+	start := 4
+	if p.transportPacket.AdaptationFieldControl&0x2 != 0 {
+		start += 1 + int(p.buf[4])
+	}
+	if start >= len(p.buf) {
+		return nil
+	}
+
+	return p.buf[start:]
+}
+
+// IsPayloadUnitStart Return true if a PES packet or PSI section starts in this packet
+func (p *TsPacket) IsPayloadUnitStart() bool {
+	return p.transportPacket.valid && p.transportPacket.PayloadUnitStartIndicator
+}
+
 // IsRandomAccess Return true if this is a random access point
 func (p *TsPacket) IsRandomAccess(pID int) (isIDR bool) {
 	isIDR = false
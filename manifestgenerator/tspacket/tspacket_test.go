@@ -1,8 +1,11 @@
 package tspacket
 
 import (
+	"bytes"
 	"encoding/hex"
+	"io/ioutil"
 	"testing"
+	"time"
 )
 
 func parseHexString(h string) []byte {
@@ -19,7 +22,7 @@ func TestTSPacketPIDNoIDR(t *testing.T) {
 	// Generate TS packet
 	buf := parseHexString("474011100042F0250001C10000FF01FF0001FC80144812010646466D70656709536572766963653031777C43CAFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF")
 	tsPckt.AddData(buf)
-	tsPckt.Parse(-1)
+	tsPckt.Parse(-1, -1)
 
 	videoPid := 17
 
@@ -33,6 +36,10 @@ func TestTSPacketPIDNoIDR(t *testing.T) {
 		t.Errorf("PCR is not correct, got = %f, want %f", pcrS, xpectedPCRS)
 	}
 
+	if pts := tsPckt.GetPTS(); pts != -1 {
+		t.Errorf("PTS is not correct, got = %d, want %d", pts, -1)
+	}
+
 	xpectedisRandomAccess := false
 	if isRandomAccess := tsPckt.IsRandomAccess(videoPid); isRandomAccess != xpectedisRandomAccess {
 		t.Errorf("RandomAccess is not correct, got = %t, want %t", isRandomAccess, xpectedisRandomAccess)
@@ -45,7 +52,7 @@ func TestTSPacketPIDIDRPCR(t *testing.T) {
 	// Generate TS packet
 	buf := parseHexString("47410030075000007B0C7E00000001E0000080C00A310007EFD1110007D8610000000109F000000001674D4029965280A00B74A40404050000030001000003003C840000000168E90935200000000165888040006B6FFEF7D4B7CCB2D9A9BED82EA3DE8A78997D0DD494066F86757E1D7F4A3FA82C376EE9C0FE81F4F746A24E305C9A3E0DD5859DE0D287E8BEF70EA0CCF9008A25F52EF9A9CFA59B78AA5D34CB88001425FE7AB544EF7171FC56F27719F9C72D13FA7B0F5F3211A6")
 	tsPckt.AddData(buf)
-	tsPckt.Parse(-1)
+	tsPckt.Parse(-1, -1)
 
 	videoPid := 256
 
@@ -59,8 +66,379 @@ func TestTSPacketPIDIDRPCR(t *testing.T) {
 		t.Errorf("IDR is not correct, got = %f, want %f", pcrS, xpectedPCRS)
 	}
 
+	xpectedPTS := int64(129000)
+	if pts := tsPckt.GetPTS(); pts != xpectedPTS {
+		t.Errorf("PTS is not correct, got = %d, want %d", pts, xpectedPTS)
+	}
+
 	xpectedisRandomAccess := true
 	if isRandomAccess := tsPckt.IsRandomAccess(videoPid); isRandomAccess != xpectedisRandomAccess {
 		t.Errorf("RandomAccess is not correct, got = %t, want %t", isRandomAccess, xpectedisRandomAccess)
 	}
 }
+
+func TestTSPacketPMTVersion(t *testing.T) {
+	tsPckt := New(TsDefaultPacketSize)
+
+	// PMT version 1, H.264 0x100 and ADTS 0x101
+	section := parseHexString("02B0170001C30000E100F0001BE100F0000FE101F000")
+	crc := CRC32MPEG2(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	buf := append(parseHexString("4750001000"), section...)
+	for len(buf) < TsDefaultPacketSize {
+		buf = append(buf, 0xFF)
+	}
+	tsPckt.AddData(buf)
+	tsPckt.Parse(0x1000, -1)
+
+	if version := tsPckt.GetPMTVersion(); version != 1 {
+		t.Errorf("PMT version is not correct, got = %d, want %d", version, 1)
+	}
+	valid, videoh264, audioADTS, _ := tsPckt.GetPMTdata()
+	if !valid || len(videoh264) != 1 || videoh264[0] != 0x100 || len(audioADTS) != 1 || audioADTS[0] != 0x101 {
+		t.Errorf("PMT data is not correct, got = %v, %v, %v", valid, videoh264, audioADTS)
+	}
+
+	// Not a PMT
+	tsPckt.Parse(-1, -1)
+	if version := tsPckt.GetPMTVersion(); version != -1 {
+		t.Errorf("PMT version is not correct, got = %d, want %d", version, -1)
+	}
+}
+
+func TestTSPacketPMTProgramNumber(t *testing.T) {
+	// PMT of program 1, H.264 0x100 and ADTS 0x101
+	section := parseHexString("02B0170001C30000E100F0001BE100F0000FE101F000")
+	crc := CRC32MPEG2(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	buf := append(parseHexString("4750001000"), section...)
+	for len(buf) < TsDefaultPacketSize {
+		buf = append(buf, 0xFF)
+	}
+
+	for _, programNumber := range []int{-1, 1, 2} {
+		tsPckt := New(TsDefaultPacketSize)
+		tsPckt.AddData(buf)
+		tsPckt.Parse(0x1000, programNumber)
+
+		valid, _, _, _ := tsPckt.GetPMTdata()
+		if valid != (programNumber != 2) {
+			t.Errorf("PMT valid is not correct for program %d, got = %t, want %t", programNumber, valid, programNumber != 2)
+		}
+	}
+}
+
+func TestCRC32MPEG2(t *testing.T) {
+	if crc := CRC32MPEG2([]byte("123456789")); crc != 0x0376E6E7 {
+		t.Errorf("CRC is not correct, got = %x, want %x", crc, 0x0376E6E7)
+	}
+}
+
+func TestTSPacketPATPrograms(t *testing.T) {
+	tsPckt := New(TsDefaultPacketSize)
+
+	// Network PID 0x10 and programs 1 (PMT 0x100), 2 (PMT 0x200) and 3 (PMT 0x300)
+	section := parseHexString("00B01900010100000000E0100001E1000002E2000003E300")
+	crc := CRC32MPEG2(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	buf := append(parseHexString("4740001500"), section...)
+	for len(buf) < TsDefaultPacketSize {
+		buf = append(buf, 0xFF)
+	}
+	tsPckt.AddData(buf)
+	tsPckt.Parse(-1, -1)
+
+	if pmtPID := tsPckt.GetPATdata(); pmtPID != 0x100 {
+		t.Errorf("PMT PID is not correct, got = %d, want %d", pmtPID, 0x100)
+	}
+	programs := tsPckt.GetPATPrograms()
+	if len(programs) != 3 || programs[2].ProgramNumber != 3 || programs[2].PMTPID != 0x300 {
+		t.Errorf("PAT programs are not correct, got = %v", programs)
+	}
+
+	if tsPckt.FilterPATProgram(4) {
+		t.Error("Filtered a program not present in the PAT")
+	}
+	if !tsPckt.FilterPATProgram(2) {
+		t.Fatal("Error filtering the PAT")
+	}
+
+	filtered := New(TsDefaultPacketSize)
+	filtered.AddData(tsPckt.GetBuffer())
+	filtered.Parse(-1, -1)
+	programs = filtered.GetPATPrograms()
+	if len(programs) != 1 || programs[0].ProgramNumber != 2 || programs[0].PMTPID != 0x200 || filtered.GetPATdata() != 0x200 {
+		t.Errorf("Filtered PAT programs are not correct, got = %v", programs)
+	}
+	if crc := CRC32MPEG2(tsPckt.GetBuffer()[5 : 5+3+13]); crc != 0 {
+		t.Errorf("Filtered PAT CRC is not correct, got = %x", crc)
+	}
+	if tsPckt.GetBuffer()[3] != 0x15 {
+		t.Error("Filtered PAT header changed")
+	}
+}
+
+// createPSIPackets Splits a PSI section (CRC added) in TS packets of pID
+func createPSIPackets(pID int, section []byte) []byte {
+	crc := CRC32MPEG2(section)
+	payload := append([]byte{0}, section...)
+	payload = append(payload, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	packets := []byte{}
+	for cc := 0; len(payload) > 0; cc++ {
+		packet := []byte{0x47, byte(pID>>8) & 0x1F, byte(pID), 0x10 | byte(cc&0x0F)}
+		if cc == 0 {
+			packet[1] |= 0x40
+		}
+		n := len(payload)
+		if n > TsDefaultPacketSize-4 {
+			n = TsDefaultPacketSize - 4
+		}
+		packet = append(packet, payload[:n]...)
+		payload = payload[n:]
+		for len(packet) < TsDefaultPacketSize {
+			packet = append(packet, 0xFF)
+		}
+		packets = append(packets, packet...)
+	}
+
+	return packets
+}
+
+func TestTSPacketPSIMultiPacket(t *testing.T) {
+	// PMT with H.264 0x100, ADTS 0x101 and 50 other streams with descriptors (3 packets)
+	section := parseHexString("02B0000001C30000E100F000" + "1BE100F000" + "0FE101F000")
+	for pid := 0x200; pid < 0x200+50; pid++ {
+		section = append(section, 0x06, 0xE0|byte(pid>>8), byte(pid), 0xF0, 0x04, 0x0A, 0x02, 'e', 'n')
+	}
+	section[1] |= byte((len(section) - 3 + 4) >> 8)
+	section[2] = byte(len(section) - 3 + 4)
+	packets := createPSIPackets(0x1000, section)
+	if len(packets) != 3*TsDefaultPacketSize {
+		t.Fatalf("Bad test, PMT in %d bytes", len(packets))
+	}
+
+	tsPckt := New(TsDefaultPacketSize)
+	for pos := 0; pos < len(packets); pos += TsDefaultPacketSize {
+		tsPckt.Reset()
+		tsPckt.AddData(packets[pos : pos+TsDefaultPacketSize])
+		tsPckt.Parse(0x1000, -1)
+
+		valid, videoh264, audioADTS, other := tsPckt.GetPMTdata()
+		if pos+TsDefaultPacketSize < len(packets) {
+			if valid {
+				t.Errorf("PMT parsed before the last packet (%d)", pos/TsDefaultPacketSize)
+			}
+			continue
+		}
+		if !valid || len(videoh264) != 1 || videoh264[0] != 0x100 || len(audioADTS) != 1 || audioADTS[0] != 0x101 || len(other) != 50 || other[49] != 0x200+49 {
+			t.Errorf("PMT data is not correct, got = %v, %v, %v, %v", valid, videoh264, audioADTS, other)
+		}
+		if !bytes.Equal(tsPckt.GetPSIBuffer(), packets) {
+			t.Error("PSI buffer does not contain all the PMT packets")
+		}
+	}
+
+	// Lost packet
+	tsPckt = New(TsDefaultPacketSize)
+	for _, pos := range []int{0, 2 * TsDefaultPacketSize} {
+		tsPckt.Reset()
+		tsPckt.AddData(packets[pos : pos+TsDefaultPacketSize])
+		tsPckt.Parse(0x1000, -1)
+	}
+	if valid, _, _, _ := tsPckt.GetPMTdata(); valid {
+		t.Error("PMT parsed with a lost packet")
+	}
+}
+
+func TestTSPacketPSIPointerField(t *testing.T) {
+	// End of a previous PAT and a new PAT with program 1 (PMT 0x100) in the same packet
+	pat := createPSIPackets(0, parseHexString("00B00D0001C100000001E100"))
+	section := pat[5 : 5+16]
+	buf := append(parseHexString("4740001003AABBCC"), section...)
+	for len(buf) < TsDefaultPacketSize {
+		buf = append(buf, 0xFF)
+	}
+
+	tsPckt := New(TsDefaultPacketSize)
+	tsPckt.AddData(buf)
+	tsPckt.Parse(-1, -1)
+	if pmtPID := tsPckt.GetPATdata(); pmtPID != 0x100 {
+		t.Errorf("PMT PID is not correct, got = %d, want %d", pmtPID, 0x100)
+	}
+	if !bytes.Equal(tsPckt.GetPSIBuffer(), buf) {
+		t.Error("PSI buffer is not the packet")
+	}
+}
+
+func TestTSPacketPSIBadCRC(t *testing.T) {
+	pat := createPSIPackets(0, parseHexString("00B00D0001C100000001E100"))
+	pat[10] ^= 0x01
+
+	tsPckt := New(TsDefaultPacketSize)
+	tsPckt.AddData(pat)
+	if !tsPckt.Parse(-1, -1) {
+		t.Error("Packet rejected because of the section")
+	}
+	if pmtPID := tsPckt.GetPATdata(); pmtPID != -1 {
+		t.Errorf("Parsed a PAT with bad CRC, got PMT PID = %d", pmtPID)
+	}
+	if errors := tsPckt.GetPSIErrors(); errors != 1 {
+		t.Errorf("PSI errors are not correct, got = %d, want %d", errors, 1)
+	}
+
+	// Section length bigger than the max
+	pat = createPSIPackets(0, parseHexString("00B3FE0001C100000001E100"))
+	tsPckt.Reset()
+	tsPckt.AddData(pat)
+	tsPckt.Parse(-1, -1)
+	if errors := tsPckt.GetPSIErrors(); errors != 2 {
+		t.Errorf("PSI errors are not correct, got = %d, want %d", errors, 2)
+	}
+}
+
+func TestTSPacketPMTDescriptors(t *testing.T) {
+	// H.264 0x100, ADTS 0x101 (eng), DVB AC-3 0x102 (spa), ATSC E-AC-3 0x103 (fra, visual impaired) and SCTE-35 0x104 (CUEI)
+	section := parseHexString("02B0000001C30000E100F000" +
+		"1BE100F000" +
+		"0FE101F0060A04656E6700" +
+		"06E102F0090A04737061006A0100" +
+		"87E103F0060A0466726103" +
+		"86E104F006050443554549")
+	section[2] = byte(len(section) - 3 + 4)
+
+	tsPckt := New(TsDefaultPacketSize)
+	tsPckt.AddData(createPSIPackets(0x1000, section))
+	tsPckt.Parse(0x1000, -1)
+
+	streams := tsPckt.GetPMTStreams()
+	if len(streams) != 5 {
+		t.Fatalf("PMT streams are not correct, got = %v", streams)
+	}
+	expected := []struct {
+		pID          uint16
+		language     string
+		audioType    uint8
+		registration string
+		codec        string
+	}{
+		{0x100, "", 0, "", CodecH264},
+		{0x101, "eng", 0, "", CodecAAC},
+		{0x102, "spa", 0, "", CodecAC3},
+		{0x103, "fra", 3, "", CodecEAC3},
+		{0x104, "", 0, "CUEI", ""},
+	}
+	for i, e := range expected {
+		s := streams[i]
+		if s.PID != e.pID || s.Language != e.language || s.AudioType != e.audioType || s.Registration != e.registration || s.Codec != e.codec {
+			t.Errorf("PMT stream %d is not correct, got = %+v", i, s)
+		}
+	}
+	if len(streams[2].Descriptors) != 2 || streams[2].Descriptors[1].Tag != AC3DescriptorTag || !bytes.Equal(streams[2].Descriptors[1].Data, []byte{0}) {
+		t.Errorf("PMT descriptors are not correct, got = %v", streams[2].Descriptors)
+	}
+}
+
+func TestFindSync(t *testing.T) {
+	packetSize := TsDefaultPacketSize
+	buf := make([]byte, 10+3*packetSize)
+	// False sync in the garbage
+	buf[2] = tsStartByte
+	buf[2+packetSize] = tsStartByte
+	for n := 0; n < 3; n++ {
+		buf[10+n*packetSize] = tsStartByte
+	}
+
+	if pos, locked := FindSync(buf, packetSize, 3); pos != 10 || !locked {
+		t.Errorf("FindSync is not correct, got: %d %t, want: %d %t", pos, locked, 10, true)
+	}
+	if pos, locked := FindSync(buf, packetSize, 2); pos != 2 || !locked {
+		t.Errorf("FindSync is not correct, got: %d %t, want: %d %t", pos, locked, 2, true)
+	}
+	// Not enough data to confirm the 2nd candidate
+	if pos, locked := FindSync(buf[:5+2*packetSize], packetSize, 3); pos != 10 || locked {
+		t.Errorf("FindSync is not correct, got: %d %t, want: %d %t", pos, locked, 10, false)
+	}
+	if pos, _ := FindSync(buf[3:10], packetSize, 3); pos != -1 {
+		t.Errorf("FindSync is not correct, got: %d, want: %d", pos, -1)
+	}
+}
+
+func TestDetectSync(t *testing.T) {
+	for _, packetSize := range PacketSizes {
+		offset := GetSyncOffset(packetSize)
+		buf := make([]byte, 7+3*packetSize)
+		// False sync in the garbage
+		buf[1] = tsStartByte
+		for n := 0; n < 3; n++ {
+			buf[7+n*packetSize+offset] = tsStartByte
+		}
+
+		if pos, size, locked := DetectSync(buf, 3); pos != 7 || size != packetSize || !locked {
+			t.Errorf("DetectSync is not correct, got: %d %d %t, want: %d %d %t", pos, size, locked, 7, packetSize, true)
+		}
+		// Not enough data to confirm it, the possible M2TS header is kept
+		truncated := append([]byte{}, buf[:7+offset+packetSize+1]...)
+		truncated[1] = 0
+		if pos, size, locked := DetectSync(truncated, 3); pos != 7+offset-M2TSHeaderSize || size != 0 || locked {
+			t.Errorf("DetectSync is not correct, got: %d %d %t, want: %d %d %t", pos, size, locked, 7+offset-M2TSHeaderSize, 0, false)
+		}
+	}
+
+	if ts := GetM2TSArrivalTimestamp([]byte{0xC1, 0x02, 0x03, 0x04}); ts != 0x01020304 {
+		t.Errorf("M2TS arrival timestamp is not correct, got: %x, want: %x", ts, 0x01020304)
+	}
+}
+
+func TestTSPacketCopyFrom(t *testing.T) {
+	// Programs 1 (PMT 0x100) and 2 (PMT 0x200)
+	section := parseHexString("00B01100010100000001E1000002E200")
+	crc := CRC32MPEG2(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	buf := append(parseHexString("47400015"), append([]byte{0}, section...)...)
+	for len(buf) < TsDefaultPacketSize {
+		buf = append(buf, 0xFF)
+	}
+
+	tsPckt := New(TsDefaultPacketSize)
+	tsPckt.AddData(buf)
+	tsPckt.Parse(-1, -1)
+
+	copied := New(TsDefaultPacketSize)
+	copied.CopyFrom(&tsPckt)
+
+	// The copy does not share data with the source
+	tsPckt.Reset()
+	tsPckt.AddData(parseHexString("47410030075000007B0C7E00000001E0000080C00A310007EFD1110007D8610000000109F000000001674D4029965280A00B74A40404050000030001000003003C840000000168E90935200000000165888040006B6FFEF7D4B7CCB2D9A9BED82EA3DE8A78997D0DD494066F86757E1D7F4A3FA82C376EE9C0FE81F4F746A24E305C9A3E0DD5859DE0D287E8BEF70EA0CCF9008A25F52EF9A9CFA59B78AA5D34CB88001425FE7AB544EF7171FC56F27719F9C72D13FA7B0F5F3211A6"))
+	tsPckt.Parse(-1, -1)
+
+	programs := copied.GetPATPrograms()
+	if len(programs) != 2 || programs[1].ProgramNumber != 2 || programs[1].PMTPID != 0x200 || copied.GetPATdata() != 0x100 {
+		t.Errorf("Copied PAT programs are not correct, got = %v", programs)
+	}
+	if !bytes.Equal(copied.GetBuffer(), buf) || !bytes.Equal(copied.GetPSIBuffer(), buf) {
+		t.Error("Copied buffer is not correct")
+	}
+}
+
+func BenchmarkTSPacketParse(b *testing.B) {
+	data, err := ioutil.ReadFile("../../fixture/testSmall.ts")
+	if err != nil {
+		b.Fatal("Error opening test file. Err: ", err)
+	}
+	numPackets := len(data) / TsDefaultPacketSize
+
+	tsPckt := New(TsDefaultPacketSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for n := 0; n < b.N; n++ {
+		pos := (n % numPackets) * TsDefaultPacketSize
+		tsPckt.Reset()
+		tsPckt.AddData(data[pos : pos+TsDefaultPacketSize])
+		if !tsPckt.Parse(0x1000, -1) {
+			b.Fatal("Error parsing packet ", n%numPackets)
+		}
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "packets/s")
+}
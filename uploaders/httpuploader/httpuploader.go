@@ -2,10 +2,16 @@ package httpuploader
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -13,41 +19,358 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
 )
 
 // HTTPUploader HTTP uploader class class
 type HTTPUploader struct {
 	HTTPClient *http.Client
 
-	Log                     *logrus.Logger
-	HTTPSInsecure           bool
-	HTTPScheme              string
-	HTTPHost                string
-	MaxHTTPRetries          int
+	Log           *logrus.Logger
+	HTTPSInsecure bool
+	HTTPScheme    string
+	HTTPHost      string
+	RetryPolicy   RetryPolicy
+
+	// MaxHTTPRetries Deprecated: use RetryPolicy.MaxRetries, if set (> 0) it overrides it
+	MaxHTTPRetries int
+
+	// InitialHTTPRetryDelayMs Deprecated: use RetryPolicy.InitialDelayMs, if set (> 0) it overrides it
 	InitialHTTPRetryDelayMs int
+
+	// HTTPMethod Method used for all the uploads (POST, PUT)
+	HTTPMethod string
+
+	// HTTPBasePath Path prefix added to all the uploads
+	HTTPBasePath string
+
+	// Auth Authentication added to all the uploads
+	Auth AuthConfig
+
+	// ExtraHeaders Static headers added to all the uploads
+	ExtraHeaders map[string]string
+
+	// MaxChunkedTransferBufferBytes Max bytes kept in memory per chunked transfer upload to allow retries (0 = no limit)
+	MaxChunkedTransferBufferBytes int
+}
+
+// TLSOptions TLS settings used for HTTPS uploads
+type TLSOptions struct {
+	// Insecure Skips CA verification
+	Insecure bool
+
+	// CAFile PEM file with the CAs used to verify the server (added to the system ones)
+	CAFile string
+
+	// ClientCertFile and ClientKeyFile PEM files with the client certificate used for mTLS
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+// TransportOptions Connection settings shared by all the uploads
+type TransportOptions struct {
+	// DisableHTTP2 Forces HTTP/1.1 for HTTPS (by default HTTP/2 is negotiated with ALPN)
+	DisableHTTP2 bool
+
+	// H2C Uses HTTP/2 cleartext with prior knowledge (only for http scheme)
+	H2C bool
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+
+	// MaxConnsPerHost Max connections per host, including the active ones (0 = no limit)
+	MaxConnsPerHost int
+
+	IdleConnTimeoutMs int
+	DialTimeoutMs     int
+	KeepAliveMs       int
+
+	// ResponseHeaderTimeoutMs Time to wait for the response headers after sending the body (0 = no limit)
+	ResponseHeaderTimeoutMs int
+
+	TLSHandshakeTimeoutMs int
+}
+
+// DefaultTransportOptions Returns the default connection settings, tuned to reuse connections with many concurrent uploads to the same host
+func DefaultTransportOptions() TransportOptions {
+	return TransportOptions{
+		DisableHTTP2:            false,
+		H2C:                     false,
+		MaxIdleConns:            100,
+		MaxIdleConnsPerHost:     32,
+		MaxConnsPerHost:         0,
+		IdleConnTimeoutMs:       90000,
+		DialTimeoutMs:           30000,
+		KeepAliveMs:             30000,
+		ResponseHeaderTimeoutMs: 0,
+		TLSHandshakeTimeoutMs:   10000,
+	}
+}
+
+// AuthTypes indicates the HTTP authentication type
+type AuthTypes int
+
+const (
+	// AuthNone No authentication
+	AuthNone AuthTypes = iota
+
+	// AuthBasic HTTP basic authentication (user and password)
+	AuthBasic
+
+	// AuthBearer HTTP bearer token authentication
+	AuthBearer
+)
+
+// AuthConfig HTTP authentication data
+type AuthConfig struct {
+	Type     AuthTypes
+	User     string
+	Password string
+	Token    string
+}
+
+const (
+	// DefaultHTTPMethod Default method used for the uploads
+	DefaultHTTPMethod = "POST"
+
+	// DefaultMaxChunkedTransferBufferBytes Default max bytes kept in memory per chunked transfer upload
+	DefaultMaxChunkedTransferBufferBytes = 32 * 1024 * 1024
+)
+
+// RetryPolicy Indicates when and how the failed uploads are retried
+type RetryPolicy struct {
+	// MaxRetries Max number of attempts
+	MaxRetries int
+
+	// InitialDelayMs Delay before the 1st retry, it is multiplied by BackoffMultiplier in every retry
+	InitialDelayMs    int
+	BackoffMultiplier float64
+	MaxDelayMs        int
+
+	// JitterFactor Random variation applied to every delay (0.2 = +-20%)
+	JitterFactor float64
+
+	// MaxElapsedTimeMs Give up if the next retry would start after this time since the 1st attempt (0 = no limit)
+	MaxElapsedTimeMs int
+
+	// AttemptTimeoutMs Timeout for every attempt of a regular upload (0 = no timeout). Not used in chunked transfer
+	AttemptTimeoutMs int
+
+	RetryableStatusCodes []int
+	RetryNetworkErrors   bool
+	RetryTimeouts        bool
+}
+
+// NewRetryPolicy Creates a retry policy with exponential backoff and the default retryable conditions
+func NewRetryPolicy(maxRetries int, initialDelayMs int) RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:           maxRetries,
+		InitialDelayMs:       initialDelayMs,
+		BackoffMultiplier:    2.0,
+		MaxDelayMs:           5000,
+		JitterFactor:         0.2,
+		MaxElapsedTimeMs:     0,
+		AttemptTimeoutMs:     0,
+		RetryableStatusCodes: []int{http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		RetryNetworkErrors:   true,
+		RetryTimeouts:        true,
+	}
+}
+
+// getDelay Returns the delay to wait before the retry number retryIntent (starting at 1)
+func (p *RetryPolicy) getDelay(retryIntent int) time.Duration {
+	delayMs := float64(p.InitialDelayMs)
+	if retryIntent > 1 && p.BackoffMultiplier > 1 {
+		delayMs = delayMs * math.Pow(p.BackoffMultiplier, float64(retryIntent-1))
+	}
+	if p.MaxDelayMs > 0 && delayMs > float64(p.MaxDelayMs) {
+		delayMs = float64(p.MaxDelayMs)
+	}
+	if p.JitterFactor > 0 {
+		delayMs = delayMs * (1 + p.JitterFactor*(2*rand.Float64()-1))
+	}
+
+	return time.Duration(delayMs * float64(time.Millisecond))
+}
+
+// canRetry Indicates if we can do the retry number retryIntent (starting at 1) after waiting delay
+func (p *RetryPolicy) canRetry(err error, retryIntent int, startedAt time.Time, delay time.Duration) bool {
+	if !isRetryableError(err) || retryIntent >= p.MaxRetries {
+		return false
+	}
+	if p.MaxElapsedTimeMs > 0 && time.Since(startedAt)+delay > time.Duration(p.MaxElapsedTimeMs)*time.Millisecond {
+		return false
+	}
+
+	return true
+}
+
+func (p *RetryPolicy) checkResponseStatus(resp *http.Response) error {
+	if resp.StatusCode < 400 {
+		return nil
+	}
+
+	err := fmt.Errorf("HTTP Error: %d", resp.StatusCode)
+	for _, code := range p.RetryableStatusCodes {
+		if code == resp.StatusCode {
+			return &uploadError{err: err, retryable: true}
+		}
+	}
+	return &uploadError{err: err, retryable: false}
+}
+
+func (p *RetryPolicy) checkRequestError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &uploadError{err: err, retryable: p.RetryTimeouts}
+	}
+	return &uploadError{err: err, retryable: p.RetryNetworkErrors}
+}
+
+// uploadError Upload error that indicates if we can retry it
+type uploadError struct {
+	err       error
+	retryable bool
+}
+
+func (e *uploadError) Error() string {
+	return e.err.Error()
+}
+
+func isRetryableError(err error) bool {
+	var upErr *uploadError
+	if errors.As(err, &upErr) {
+		return upErr.retryable
+	}
+	return false
 }
 
 // New Creates a chunk instance
 func New(log *logrus.Logger, httpsInsecure bool, httpScheme string, httpHost string, maxHTTPRetries int, initialHTTPRetryDelayMs int) HTTPUploader {
+	// No files to load, so it can not fail
+	h, _ := NewWithTLS(log, TLSOptions{Insecure: httpsInsecure}, httpScheme, httpHost, maxHTTPRetries, initialHTTPRetryDelayMs)
+
+	return h
+}
+
+// NewWithTLS Creates an uploader instance that can use a custom CA bundle and a client certificate (mTLS) for HTTPS
+func NewWithTLS(log *logrus.Logger, tlsOptions TLSOptions, httpScheme string, httpHost string, maxHTTPRetries int, initialHTTPRetryDelayMs int) (HTTPUploader, error) {
+	return NewWithOptions(log, tlsOptions, DefaultTransportOptions(), httpScheme, httpHost, maxHTTPRetries, initialHTTPRetryDelayMs)
+}
+
+// NewWithOptions Creates an uploader instance with custom TLS and connection settings
+func NewWithOptions(log *logrus.Logger, tlsOptions TLSOptions, transportOptions TransportOptions, httpScheme string, httpHost string, maxHTTPRetries int, initialHTTPRetryDelayMs int) (HTTPUploader, error) {
 	if log == nil {
 		log = logrus.New()
 		log.SetLevel(logrus.DebugLevel)
 	}
 
-	var tr = http.DefaultTransport
-	if (strings.Compare(httpScheme, "https") == 0) && (httpsInsecure) {
-		// Setup HTTPS client in dev env, skips CA verification
-		log.Warn("Skipping CA cert verification!")
-		tlsConfig := &tls.Config{InsecureSkipVerify: true}
-		tr = &http.Transport{TLSClientConfig: tlsConfig}
+	var tlsConfig *tls.Config = nil
+	if strings.Compare(httpScheme, "https") == 0 {
+		var err error
+		tlsConfig, err = createTLSConfig(log, tlsOptions)
+		if err != nil {
+			return HTTPUploader{}, err
+		}
+	}
+
+	tr, err := createTransport(httpScheme, tlsConfig, transportOptions)
+	if err != nil {
+		return HTTPUploader{}, err
 	}
 	client := http.Client{
 		Transport: tr,
 		Timeout:   0,
 	}
-	h := HTTPUploader{&client, log, httpsInsecure, httpScheme, httpHost, maxHTTPRetries, initialHTTPRetryDelayMs}
+	h := HTTPUploader{&client, log, tlsOptions.Insecure, httpScheme, httpHost, NewRetryPolicy(maxHTTPRetries, initialHTTPRetryDelayMs), 0, 0, DefaultHTTPMethod, "", AuthConfig{Type: AuthNone}, map[string]string{}, DefaultMaxChunkedTransferBufferBytes}
 
-	return h
+	return h, nil
+}
+
+// createTransport Creates the transport shared by all the uploads, so connections are reused
+func createTransport(httpScheme string, tlsConfig *tls.Config, transportOptions TransportOptions) (http.RoundTripper, error) {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(transportOptions.DialTimeoutMs) * time.Millisecond,
+		KeepAlive: time.Duration(transportOptions.KeepAliveMs) * time.Millisecond,
+	}
+
+	if transportOptions.H2C {
+		if strings.Compare(httpScheme, "http") != 0 {
+			return nil, errors.New("HTTP/2 cleartext (h2c) can only be used with http scheme")
+		}
+
+		// HTTP/2 with prior knowledge over TCP, all the uploads are multiplexed in the same connection
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			ReadIdleTimeout: time.Duration(transportOptions.KeepAliveMs) * time.Millisecond,
+		}, nil
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = dialer.DialContext
+	tr.MaxIdleConns = transportOptions.MaxIdleConns
+	tr.MaxIdleConnsPerHost = transportOptions.MaxIdleConnsPerHost
+	tr.MaxConnsPerHost = transportOptions.MaxConnsPerHost
+	tr.IdleConnTimeout = time.Duration(transportOptions.IdleConnTimeoutMs) * time.Millisecond
+	tr.ResponseHeaderTimeout = time.Duration(transportOptions.ResponseHeaderTimeoutMs) * time.Millisecond
+	tr.TLSHandshakeTimeout = time.Duration(transportOptions.TLSHandshakeTimeoutMs) * time.Millisecond
+	if tlsConfig != nil {
+		tr.TLSClientConfig = tlsConfig
+	}
+	if transportOptions.DisableHTTP2 {
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	} else {
+		tr.ForceAttemptHTTP2 = true
+	}
+
+	return tr, nil
+}
+
+// createTLSConfig Returns nil if the default TLS config can be used
+func createTLSConfig(log *logrus.Logger, tlsOptions TLSOptions) (*tls.Config, error) {
+	if !tlsOptions.Insecure && tlsOptions.CAFile == "" && tlsOptions.ClientCertFile == "" && tlsOptions.ClientKeyFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if tlsOptions.Insecure {
+		// Setup HTTPS client in dev env, skips CA verification
+		log.Warn("Skipping CA cert verification!")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if tlsOptions.CAFile != "" {
+		caData, err := ioutil.ReadFile(tlsOptions.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		caPool, err := x509.SystemCertPool()
+		if err != nil || caPool == nil {
+			caPool = x509.NewCertPool()
+		}
+		if !caPool.AppendCertsFromPEM(caData) {
+			return nil, errors.New("No valid certificates found in CA file " + tlsOptions.CAFile)
+		}
+		tlsConfig.RootCAs = caPool
+	}
+
+	if tlsOptions.ClientCertFile != "" || tlsOptions.ClientKeyFile != "" {
+		if tlsOptions.ClientCertFile == "" || tlsOptions.ClientKeyFile == "" {
+			return nil, errors.New("Client certificate and key files are both needed for mTLS")
+		}
+		cert, err := tls.LoadX509KeyPair(tlsOptions.ClientCertFile, tlsOptions.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
 
 // UploadLocalFile Uploads a file from the filesystem
@@ -67,77 +390,192 @@ func (h *HTTPUploader) UploadData(data []byte, dstPathFile string, headers map[s
 	return h.uploadDataRetries(bytes.NewReader(data), dstPathFile, headers)
 }
 
-// UploadChunkedTransfer Uploads data as soon as arrives to the returned channel (no retries for chunked transfer, future improvement)
-func (h *HTTPUploader) UploadChunkedTransfer(dstPathFile string, headers map[string]string) chan []byte {
-	r, w := io.Pipe()
+// UploadChunkedTransfer Uploads data as soon as arrives to the returned channel.
+// All the data sent is kept in memory (up to MaxChunkedTransferBufferBytes), so if the
+// connection fails the whole chunk is uploaded again from the buffer and then the streaming continues.
+// The final result of the upload is sent to the returned error channel after the data channel is closed
+func (h *HTTPUploader) UploadChunkedTransfer(dstPathFile string, headers map[string]string) (chan []byte, <-chan error) {
 	writeChan := make(chan []byte)
+	resultChan := make(chan error, 1)
 
-	// open request
-	req := &http.Request{
-		Method: "POST",
-		URL: &url.URL{
-			Scheme: h.HTTPScheme,
-			Host:   h.HTTPHost,
-			Path:   "/" + dstPathFile,
-		},
-		ProtoMajor:    1,
-		ProtoMinor:    1,
-		ContentLength: -1,
-		Body:          r,
-		Header:        http.Header{},
-	}
+	go h.chunkedTransferLoop(writeChan, resultChan, dstPathFile, headers)
 
-	// Add headers
-	for k, v := range headers {
-		req.Header.Set(k, v)
+	return writeChan, resultChan
+}
+
+func (h *HTTPUploader) chunkedTransferLoop(writeChan <-chan []byte, resultChan chan<- error, dstPathFile string, headers map[string]string) {
+	buffer := []byte{}
+	isBufferOverflow := false
+	isInputClosed := false
+	retryIntent := 0
+	startedAt := time.Now()
+	retryPolicy := h.getRetryPolicy()
+
+	// Saves the data to be able to resend it if the upload fails
+	bufferData := func(buf []byte) {
+		if isBufferOverflow {
+			return
+		}
+		if h.MaxChunkedTransferBufferBytes > 0 && len(buffer)+len(buf) > h.MaxChunkedTransferBufferBytes {
+			h.Log.Warn("Chunked transfer buffer full for ", dstPathFile, ", retries disabled for this upload")
+			isBufferOverflow = true
+			buffer = nil
+			return
+		}
+		buffer = append(buffer, buf...)
 	}
 
-	go func() {
-		defer w.Close()
+	for {
+		r, w := io.Pipe()
+		reqResultChan := make(chan error, 1)
+
+		go func() {
+			err := h.doChunkedTransferRequest(r, dstPathFile, headers)
+			// Unblocks any pending write if the request finished before reading all the data
+			r.CloseWithError(errors.New("Chunked transfer request finished"))
+			reqResultChan <- err
+		}()
+
+		// Resend the data already received
+		var errWrite error
+		if len(buffer) > 0 {
+			_, errWrite = w.Write(buffer)
+		}
+
+		// Continue streaming
+		for errWrite == nil && !isInputClosed {
+			buf, ok := <-writeChan
+			if !ok {
+				isInputClosed = true
+				break
+			}
+			bufferData(buf)
 
-		for buf := range writeChan {
 			n, err := w.Write(buf)
 			h.Log.Debug("Wrote ", n, " bytes to ", dstPathFile)
-			if n != len(buf) && err != nil {
-				panic(err)
+			errWrite = err
+		}
+		w.Close()
+
+		errReq := <-reqResultChan
+		if errReq == nil && errWrite != nil {
+			// The server answered before receiving all the data
+			errReq = &uploadError{err: fmt.Errorf("Upload finished before sending all the data. Err: %v", errWrite), retryable: true}
+		}
+		if errReq == nil {
+			h.Log.Debug("Upload to ", dstPathFile, " complete")
+			break
+		}
+		if errWrite != nil {
+			h.Log.Debug("Error writing data to upload ", dstPathFile, ". Error: ", errWrite)
+		}
+
+		// Fails the upload, consuming the pending data to not block the producer
+		failUpload := func(err error) {
+			h.Log.Error("ERROR data lost uploading ", dstPathFile, ". Error: ", err)
+
+			for !isInputClosed {
+				if _, ok := <-writeChan; !ok {
+					isInputClosed = true
+				}
 			}
+
+			resultChan <- err
 		}
-	}()
 
-	go func() {
-		h.Log.Debug("Opening connection to upload to ", dstPathFile)
-		h.Log.Debug("Req: ", req)
-		_, err := h.HTTPClient.Do(req)
+		retryIntent++
+		delay := retryPolicy.getDelay(retryIntent)
+		if isBufferOverflow || !retryPolicy.canRetry(errReq, retryIntent, startedAt, delay) {
+			failUpload(errReq)
+			return
+		}
 
-		if err != nil {
-			h.Log.Error("Error uploading to ", dstPathFile, ". Error: ", err)
-		} else {
-			h.Log.Debug("Upload to ", dstPathFile, " complete")
+		h.Log.Warn("Error uploading to ", dstPathFile, ", RETRYING (", retryIntent, "). Error: ", errReq)
+
+		// Keep receiving data while waiting to retry
+		timer := time.NewTimer(delay)
+		isWaiting := true
+		for isWaiting {
+			if isInputClosed {
+				<-timer.C
+				break
+			}
+			select {
+			case buf, ok := <-writeChan:
+				if !ok {
+					isInputClosed = true
+				} else {
+					bufferData(buf)
+				}
+			case <-timer.C:
+				isWaiting = false
+			}
 		}
-	}()
 
-	return writeChan
+		// The data received while waiting did not fit in the buffer, the retry can not send the whole chunk
+		if isBufferOverflow {
+			failUpload(fmt.Errorf("Chunked transfer buffer full while waiting to retry. Err: %v", errReq))
+			return
+		}
+	}
+
+	resultChan <- nil
 }
 
-func (h *HTTPUploader) uploadDataRetries(dataReader io.Reader, dstPathFile string, headers map[string]string) error {
+func (h *HTTPUploader) doChunkedTransferRequest(body io.ReadCloser, dstPathFile string, headers map[string]string) error {
+	req := h.createRequest(body, dstPathFile, headers)
+
+	h.Log.Debug("Opening connection to upload to ", dstPathFile)
+	h.Log.Debug("Req: ", req.Method, " ", req.URL.String())
+	resp, err := h.HTTPClient.Do(req)
+	if err != nil {
+		return h.RetryPolicy.checkRequestError(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return h.RetryPolicy.checkResponseStatus(resp)
+}
+
+// getRetryPolicy Returns the retry policy with the deprecated retry fields applied
+func (h *HTTPUploader) getRetryPolicy() RetryPolicy {
+	retryPolicy := h.RetryPolicy
+	if h.MaxHTTPRetries > 0 {
+		retryPolicy.MaxRetries = h.MaxHTTPRetries
+	}
+	if h.InitialHTTPRetryDelayMs > 0 {
+		retryPolicy.InitialDelayMs = h.InitialHTTPRetryDelayMs
+	}
+
+	return retryPolicy
+}
+
+// uploadDataRetries Uploads the data following the retry policy, the data is rewinded before each attempt
+func (h *HTTPUploader) uploadDataRetries(dataReader io.ReadSeeker, dstPathFile string, headers map[string]string) error {
 	var ret error = nil
-	maxRetries := h.MaxHTTPRetries
-	retryPauseInitialMs := h.InitialHTTPRetryDelayMs
 	retryIntent := 0
+	startedAt := time.Now()
+	retryPolicy := h.getRetryPolicy()
 
 	for {
-		if retryIntent >= maxRetries {
-			h.Log.Error("ERROR data lost because server busy, ", dstPathFile)
+		if _, errSeek := dataReader.Seek(0, io.SeekStart); errSeek != nil {
+			return errSeek
+		}
+
+		ret = h.uploadData(dataReader, dstPathFile, headers)
+		if ret == nil {
 			break
-		} else {
-			retryErr := h.uploadData(dataReader, dstPathFile, headers)
-			if retryErr != nil {
-				time.Sleep(time.Duration(retryPauseInitialMs*retryIntent) * time.Millisecond)
-			} else {
-				break
-			}
 		}
+
 		retryIntent++
+		delay := retryPolicy.getDelay(retryIntent)
+		if !retryPolicy.canRetry(ret, retryIntent, startedAt, delay) {
+			h.Log.Error("ERROR data lost uploading ", dstPathFile, ". Error: ", ret)
+			break
+		}
+
+		h.Log.Debug("Warning error uploading to ", dstPathFile, ", RETRYING (", retryIntent, ") in ", delay)
+		time.Sleep(delay)
 	}
 
 	return ret
@@ -146,42 +584,80 @@ func (h *HTTPUploader) uploadDataRetries(dataReader io.Reader, dstPathFile strin
 func (h *HTTPUploader) uploadData(fileData io.Reader, dstPathFile string, headers map[string]string) error {
 	var ret error = nil
 
+	req := h.createRequest(ioutil.NopCloser(fileData), dstPathFile, headers)
+
+	if h.RetryPolicy.AttemptTimeoutMs > 0 {
+		ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(h.RetryPolicy.AttemptTimeoutMs)*time.Millisecond)
+		defer cancelFn()
+		req = req.WithContext(ctx)
+	}
+
+	resp, errReq := h.HTTPClient.Do(req)
+	if errReq != nil {
+		h.Log.Error("Error uploading to ", dstPathFile, ")", "Error: ", errReq)
+		ret = h.RetryPolicy.checkRequestError(errReq)
+	} else {
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, resp.Body)
+
+		ret = h.RetryPolicy.checkResponseStatus(resp)
+		if ret == nil {
+			// Done
+			h.Log.Info("Upload to ", dstPathFile, " complete")
+		} else if !isRetryableError(ret) {
+			// Not retirable error
+			h.Log.Error("Error server uploading to ", dstPathFile, ")", "HTTP Error: ", resp.StatusCode)
+		}
+	}
+
+	return ret
+}
+
+func (h *HTTPUploader) createRequest(body io.ReadCloser, dstPathFile string, headers map[string]string) *http.Request {
+	method := h.HTTPMethod
+	if method == "" {
+		method = DefaultHTTPMethod
+	}
+
 	req := &http.Request{
-		Method: "POST",
+		Method: method,
 		URL: &url.URL{
 			Scheme: h.HTTPScheme,
 			Host:   h.HTTPHost,
-			Path:   "/" + dstPathFile,
+			Path:   h.getDstPath(dstPathFile),
 		},
 		ProtoMajor:    1,
 		ProtoMinor:    1,
 		ContentLength: -1,
-		Body:          ioutil.NopCloser(fileData),
+		Body:          body,
 		Header:        http.Header{},
 	}
 
+	// Add static headers first, so they can be overwritten by the upload ones
+	for k, v := range h.ExtraHeaders {
+		req.Header.Set(k, v)
+	}
+
 	// Add headers
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
 
-	resp, errReq := h.HTTPClient.Do(req)
-	if errReq != nil {
-		h.Log.Error("Error uploading to ", dstPathFile, ")", "Error: ", errReq)
-	} else {
-		defer resp.Body.Close()
-		if resp.StatusCode < 400 {
-			// Done
-			h.Log.Info("Upload to ", dstPathFile, " complete")
-		} else if resp.StatusCode == http.StatusServiceUnavailable {
-			// Need to retry
-			h.Log.Debug("Warning server busy, uploading to ", dstPathFile, ", RETRYING!")
-			ret = errors.New("Retryable upload error")
-		} else {
-			// Not retirable error
-			h.Log.Error("Error server uploading to ", dstPathFile, ")", "HTTP Error: ", resp.StatusCode)
-		}
+	// Add auth
+	if h.Auth.Type == AuthBasic {
+		req.SetBasicAuth(h.Auth.User, h.Auth.Password)
+	} else if h.Auth.Type == AuthBearer {
+		req.Header.Set("Authorization", "Bearer "+h.Auth.Token)
 	}
 
-	return ret
+	return req
+}
+
+func (h *HTTPUploader) getDstPath(dstPathFile string) string {
+	basePath := strings.Trim(h.HTTPBasePath, "/")
+	if basePath == "" {
+		return "/" + dstPathFile
+	}
+
+	return "/" + basePath + "/" + strings.TrimPrefix(dstPathFile, "/")
 }
@@ -1,14 +1,29 @@
 package httpuploader
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // TestMain will exec each test, one by one
@@ -181,13 +196,12 @@ func TestUploadChunkedData(t *testing.T) {
 		bufChunk := make([]byte, 3)
 		for {
 			nRead, errRead := req.Body.Read(bufChunk)
+			buf = append(buf, bufChunk[0:nRead]...)
 			if errRead == io.EOF {
 				break
 			} else if errRead != nil {
 				t.Error("Error reading the sent chunks. Err: ", errRead)
 				break
-			} else {
-				buf = append(buf, bufChunk[0:nRead]...)
 			}
 		}
 		totalData := append(dataChunk1, dataChunk2...)
@@ -214,7 +228,7 @@ func TestUploadChunkedData(t *testing.T) {
 
 	// Create channel
 	h := map[string]string{headerName: headerValue}
-	channel := up.UploadChunkedTransfer(UploadFilePath, h)
+	channel, resultChannel := up.UploadChunkedTransfer(UploadFilePath, h)
 	if channel == nil {
 		t.Error("Error creating channel")
 	}
@@ -226,4 +240,657 @@ func TestUploadChunkedData(t *testing.T) {
 
 	// Wait to process the data
 	wg.Wait()
+
+	if errUpload := <-resultChannel; errUpload != nil {
+		t.Error("Error uploading chunked data. Err ", errUpload)
+	}
+}
+
+func TestUploadChunkedDataRetry(t *testing.T) {
+	dataChunk1 := []byte("ABCDE")
+	dataChunk2 := []byte("123456")
+	UploadFilePath := "test/fileChunkedRetry.ts"
+
+	var mutex sync.Mutex
+	numRequests := 0
+
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		numRequests++
+		currentRequest := numRequests
+		mutex.Unlock()
+
+		// Fail the 1st request
+		if currentRequest == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		// Check data
+		buf, errReadReq := ioutil.ReadAll(req.Body)
+		if errReadReq != nil {
+			t.Error("Error reading the sent body. Err: ", errReadReq)
+		}
+		totalData := append(dataChunk1, dataChunk2...)
+		if !testBinary(buf, totalData) {
+			t.Errorf("Different data from original and uploaded file, got: %d (bytes), want: %d (bytes).", len(buf), len(totalData))
+		}
+
+		rw.Write([]byte(`OK`))
+	}
+	// Close the server when test finishes
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	// Use test server data
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := New(nil, false, u.Scheme, u.Host, 3, 10)
+
+	channel, resultChannel := up.UploadChunkedTransfer(UploadFilePath, map[string]string{})
+
+	// Upload 2 chunks
+	channel <- dataChunk1
+	channel <- dataChunk2
+	close(channel)
+
+	if errUpload := <-resultChannel; errUpload != nil {
+		t.Error("Error uploading chunked data. Err ", errUpload)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if numRequests != 2 {
+		t.Errorf("Wrong number of requests, got: %d, want: %d.", numRequests, 2)
+	}
+}
+
+// failFirstTransport Fails the 1st request without reading its body, the rest are sent to the server
+type failFirstTransport struct {
+	mutex       sync.Mutex
+	numRequests int
+}
+
+func (f *failFirstTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mutex.Lock()
+	f.numRequests++
+	currentRequest := f.numRequests
+	f.mutex.Unlock()
+
+	if currentRequest == 1 {
+		return nil, errors.New("Connection dropped")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestUploadChunkedDataBufferOverflowWhileRetrying(t *testing.T) {
+	var mutex sync.Mutex
+	numServerRequests := 0
+
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		numServerRequests++
+		mutex.Unlock()
+
+		ioutil.ReadAll(req.Body)
+		rw.Write([]byte(`OK`))
+	}
+	// Close the server when test finishes
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	// Use test server data
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := New(nil, false, u.Scheme, u.Host, 3, 200)
+	up.MaxChunkedTransferBufferBytes = 8
+	up.HTTPClient = &http.Client{Transport: &failFirstTransport{}}
+
+	channel, resultChannel := up.UploadChunkedTransfer("test/fileChunkedOverflow.ts", map[string]string{})
+
+	// Sending it fails (the 1st request is finished), so the upload waits to retry
+	channel <- []byte("ABCDE")
+	// Received while waiting to retry, it does not fit in the buffer
+	channel <- []byte("123456")
+	close(channel)
+
+	if errUpload := <-resultChannel; errUpload == nil {
+		t.Error("Expected error uploading chunked data after a buffer overflow")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if numServerRequests != 0 {
+		t.Errorf("Truncated data uploaded, got: %d requests, want: %d.", numServerRequests, 0)
+	}
+}
+
+func TestUploadChunkedDataNoRetryableError(t *testing.T) {
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusForbidden)
+	}
+	// Close the server when test finishes
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	// Use test server data
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := New(nil, false, u.Scheme, u.Host, 3, 10)
+
+	channel, resultChannel := up.UploadChunkedTransfer("test/fileChunkedForbidden.ts", map[string]string{})
+
+	channel <- []byte("ABCDE")
+	channel <- []byte("123456")
+	close(channel)
+
+	if errUpload := <-resultChannel; errUpload == nil {
+		t.Error("Expected error uploading chunked data to a forbidden destination")
+	}
+}
+
+func TestUploadChunkedDataEarlyResponse(t *testing.T) {
+	// The server answers without reading the body, the data sent after that can not be written
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Connection", "close")
+		rw.Write([]byte(`OK`))
+	}
+	// Close the server when test finishes
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	// Use test server data
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := New(nil, false, u.Scheme, u.Host, 2, 10)
+
+	channel, resultChannel := up.UploadChunkedTransfer("test/fileChunkedEarlyResponse.ts", map[string]string{})
+
+	// The producer never blocks
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			channel <- []byte("ABCDE")
+			time.Sleep(50 * time.Millisecond)
+		}
+		close(channel)
+		<-resultChannel
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Chunked transfer upload blocked after an early response")
+	}
+}
+
+func TestUploadDataNoRetryableError(t *testing.T) {
+	var mutex sync.Mutex
+	numRequests := 0
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		numRequests++
+		mutex.Unlock()
+		rw.WriteHeader(http.StatusForbidden)
+	}
+	// Close the server when test finishes
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	// Use test server data
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := New(nil, false, u.Scheme, u.Host, 3, 10)
+
+	errUpload := up.UploadData([]byte("ABCDE"), "test/fileForbidden.ts", map[string]string{})
+	if errUpload == nil {
+		t.Error("Expected error uploading data to a forbidden destination")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if numRequests != 1 {
+		t.Errorf("Wrong number of requests, got: %d, want: %d.", numRequests, 1)
+	}
+}
+
+func TestUploadDataMaxRetries(t *testing.T) {
+	var mutex sync.Mutex
+	numRequests := 0
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		numRequests++
+		mutex.Unlock()
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	// Close the server when test finishes
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	// Use test server data
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := New(nil, false, u.Scheme, u.Host, 3, 1)
+
+	errUpload := up.UploadData([]byte("ABCDE"), "test/fileBusy.ts", map[string]string{})
+	if errUpload == nil {
+		t.Error("Expected error uploading data after max retries")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if numRequests != 3 {
+		t.Errorf("Wrong number of requests, got: %d, want: %d.", numRequests, 3)
+	}
+}
+
+func TestUploadDataDeprecatedRetryFields(t *testing.T) {
+	var mutex sync.Mutex
+	numRequests := 0
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		numRequests++
+		mutex.Unlock()
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	// Close the server when test finishes
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	// Use test server data
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := New(nil, false, u.Scheme, u.Host, 3, 100)
+	up.MaxHTTPRetries = 2
+	up.InitialHTTPRetryDelayMs = 1
+
+	startedAt := time.Now()
+	errUpload := up.UploadData([]byte("ABCDE"), "test/fileBusy.ts", map[string]string{})
+	if errUpload == nil {
+		t.Error("Expected error uploading data after max retries")
+	}
+	if elapsed := time.Since(startedAt); elapsed > 50*time.Millisecond {
+		t.Errorf("Deprecated initial retry delay not applied, upload took: %v", elapsed)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if numRequests != 2 {
+		t.Errorf("Wrong number of requests, got: %d, want: %d.", numRequests, 2)
+	}
+}
+
+func TestUploadLocalFileRetryResendsBody(t *testing.T) {
+	testFilePath := "../../fixture/testSmall.ts"
+	bufExpected, errReadLocalExpected := ioutil.ReadFile(testFilePath)
+	if errReadLocalExpected != nil {
+		t.Error("Error reading the local expected result file. Err: ", errReadLocalExpected)
+	}
+
+	numRequests := 0
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		numRequests++
+
+		buf, errReadReq := ioutil.ReadAll(req.Body)
+		if errReadReq != nil {
+			t.Error("Error reading the sent body. Err: ", errReadReq)
+		}
+		if !testBinary(buf, bufExpected) {
+			t.Errorf("Different data from original and uploaded file in request %d, got: %d (bytes), want: %d (bytes).", numRequests, len(buf), len(bufExpected))
+		}
+
+		// Fail the 1st request
+		if numRequests == 1 {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		rw.Write([]byte(`OK`))
+	}
+	// Close the server when test finishes
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	// Use test server data
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := New(nil, false, u.Scheme, u.Host, 3, 1)
+
+	errUpload := up.UploadLocalFile(testFilePath, "test/testSmallRetry.ts", map[string]string{})
+	if errUpload != nil {
+		t.Error("Error uploading localfile. Err ", errUpload)
+	}
+	if numRequests != 2 {
+		t.Errorf("Wrong number of requests, got: %d, want: %d.", numRequests, 2)
+	}
+}
+
+func TestUploadDataRetryTimeout(t *testing.T) {
+	var mutex sync.Mutex
+	numRequests := 0
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		numRequests++
+		currentRequest := numRequests
+		mutex.Unlock()
+		ioutil.ReadAll(req.Body)
+
+		// Too slow the 1st time
+		if currentRequest == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		rw.Write([]byte(`OK`))
+	}
+	// Close the server when test finishes
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	// Use test server data
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := New(nil, false, u.Scheme, u.Host, 3, 1)
+	up.RetryPolicy.AttemptTimeoutMs = 50
+
+	errUpload := up.UploadData([]byte("ABCDE"), "test/fileTimeout.ts", map[string]string{})
+	if errUpload != nil {
+		t.Error("Error uploading data. Err ", errUpload)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if numRequests != 2 {
+		t.Errorf("Wrong number of requests, got: %d, want: %d.", numRequests, 2)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := NewRetryPolicy(10, 100)
+	p.JitterFactor = 0
+	p.MaxDelayMs = 1000
+
+	xpectedDelaysMs := []int{100, 200, 400, 800, 1000}
+	for i, xpectedDelayMs := range xpectedDelaysMs {
+		if delay := p.getDelay(i + 1); delay != time.Duration(xpectedDelayMs)*time.Millisecond {
+			t.Errorf("Wrong delay for retry %d, got: %v, want: %dms.", i+1, delay, xpectedDelayMs)
+		}
+	}
+
+	p.JitterFactor = 0.5
+	for n := 0; n < 100; n++ {
+		if delay := p.getDelay(1); delay < 50*time.Millisecond || delay > 150*time.Millisecond {
+			t.Errorf("Delay with jitter out of range, got: %v", delay)
+		}
+	}
+}
+
+func TestUploadDataPutAuthHeaders(t *testing.T) {
+	data := []byte("ABCDE")
+	UploadFilePath := "test/fileData.ts"
+
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "PUT" {
+			t.Errorf("Server received wrong method, got: %s, want: %s.", req.Method, "PUT")
+		}
+		if req.URL.Path != "/ingest/live/"+UploadFilePath {
+			t.Errorf("Server received wrong path, got: %s, want: %s.", req.URL.Path, "/ingest/live/"+UploadFilePath)
+		}
+		if hVal := req.Header.Get("Authorization"); hVal != "Bearer secretToken" {
+			t.Errorf("Wrong auth header, got: %s, want: %s.", hVal, "Bearer secretToken")
+		}
+		if hVal := req.Header.Get("X-Static"); hVal != "staticValue" {
+			t.Errorf("Wrong static header, got: %s, want: %s.", hVal, "staticValue")
+		}
+		if hVal := req.Header.Get("Content-Type"); hVal != "video/MP2T" {
+			t.Errorf("Static header should be overwritten by the upload one, got: %s, want: %s.", hVal, "video/MP2T")
+		}
+
+		rw.Write([]byte(`OK`))
+	}
+	// Close the server when test finishes
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	// Use test server data
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := New(nil, false, u.Scheme, u.Host, 3, 100)
+	up.HTTPMethod = "PUT"
+	up.HTTPBasePath = "/ingest/live/"
+	up.Auth = AuthConfig{Type: AuthBearer, Token: "secretToken"}
+	up.ExtraHeaders = map[string]string{"X-Static": "staticValue", "Content-Type": "application/octet-stream"}
+
+	errUpload := up.UploadData(data, UploadFilePath, map[string]string{"Content-Type": "video/MP2T"})
+	if errUpload != nil {
+		t.Error("Error uploading data. Err ", errUpload)
+	}
+}
+
+func TestUploadDataBasicAuth(t *testing.T) {
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		user, password, ok := req.BasicAuth()
+		if !ok || user != "user" || password != "pass" {
+			t.Errorf("Wrong basic auth, got: %s:%s, want: %s:%s.", user, password, "user", "pass")
+		}
+
+		rw.Write([]byte(`OK`))
+	}
+	// Close the server when test finishes
+	server := httptest.NewServer(http.HandlerFunc(serverHandleTest))
+	defer server.Close()
+
+	// Use test server data
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := New(nil, false, u.Scheme, u.Host, 3, 100)
+	up.Auth = AuthConfig{Type: AuthBasic, User: "user", Password: "pass"}
+
+	errUpload := up.UploadData([]byte("ABCDE"), "test/fileData.ts", map[string]string{})
+	if errUpload != nil {
+		t.Error("Error uploading data. Err ", errUpload)
+	}
+}
+
+func writeTempPEM(t *testing.T, pemType string, data []byte) string {
+	f, err := ioutil.TempFile("", "httpuploader-*.pem")
+	if err != nil {
+		t.Fatal("Error creating temp file. Err: ", err)
+	}
+	defer f.Close()
+
+	if err := pem.Encode(f, &pem.Block{Type: pemType, Bytes: data}); err != nil {
+		t.Fatal("Error writing PEM file. Err: ", err)
+	}
+
+	return f.Name()
+}
+
+func createClientCert(t *testing.T) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating client key. Err: ", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("Error creating client cert. Err: ", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("Error marshaling client key. Err: ", err)
+	}
+
+	return writeTempPEM(t, "CERTIFICATE", certDer), writeTempPEM(t, "EC PRIVATE KEY", keyDer)
+}
+
+func TestUploadDataCustomCAAndClientCert(t *testing.T) {
+	receivedClientCert := false
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		receivedClientCert = req.TLS != nil && len(req.TLS.PeerCertificates) > 0
+		rw.Write([]byte(`OK`))
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(serverHandleTest))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+
+	caFile := writeTempPEM(t, "CERTIFICATE", server.Certificate().Raw)
+	defer os.Remove(caFile)
+	certFile, keyFile := createClientCert(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	// Without client cert the server refuses the connection
+	upNoCert, err := NewWithTLS(nil, TLSOptions{CAFile: caFile}, u.Scheme, u.Host, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating uploader. Err: ", err)
+	}
+	if errUpload := upNoCert.UploadData([]byte("ABCDE"), "test/fileData.ts", map[string]string{}); errUpload == nil {
+		t.Error("Expected error uploading without client certificate")
+	}
+
+	up, err := NewWithTLS(nil, TLSOptions{CAFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile}, u.Scheme, u.Host, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating uploader. Err: ", err)
+	}
+	if errUpload := up.UploadData([]byte("ABCDE"), "test/fileData.ts", map[string]string{}); errUpload != nil {
+		t.Error("Error uploading data with mTLS. Err ", errUpload)
+	}
+	if !receivedClientCert {
+		t.Error("Server did not receive the client certificate")
+	}
+}
+
+func TestNewWithTLSWrongFiles(t *testing.T) {
+	if _, err := NewWithTLS(nil, TLSOptions{CAFile: "../../fixture/testSmall.ts"}, "https", "localhost", 1, 1); err == nil {
+		t.Error("Expected error using a CA file without certificates")
+	}
+	if _, err := NewWithTLS(nil, TLSOptions{ClientCertFile: "missing.pem"}, "https", "localhost", 1, 1); err == nil {
+		t.Error("Expected error using a client certificate without key")
+	}
+}
+
+func TestUploadDataReusesConnections(t *testing.T) {
+	var mutex sync.Mutex
+	numConnections := 0
+
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		rw.Write([]byte(`OK`))
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(serverHandleTest))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mutex.Lock()
+			numConnections++
+			mutex.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	up := New(nil, false, u.Scheme, u.Host, 1, 1)
+
+	for n := 0; n < 5; n++ {
+		if errUpload := up.UploadData([]byte("ABCDE"), "test/fileData.ts", map[string]string{}); errUpload != nil {
+			t.Error("Error uploading data. Err ", errUpload)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if numConnections != 1 {
+		t.Errorf("Connections are not reused, got: %d connections, want: %d.", numConnections, 1)
+	}
+}
+
+func TestUploadChunkedDataH2C(t *testing.T) {
+	var mutex sync.Mutex
+	numConnections := 0
+
+	serverHandleTest := func(rw http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			t.Errorf("Wrong protocol, got: %s, want: HTTP/2.", req.Proto)
+		}
+		ioutil.ReadAll(req.Body)
+		rw.Write([]byte(`OK`))
+	}
+	server := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(serverHandleTest), &http2.Server{}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mutex.Lock()
+			numConnections++
+			mutex.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	u, errURL := url.Parse(server.URL)
+	if errURL != nil {
+		t.Error("Error parsing test server URL. Err ", errURL)
+	}
+	transportOptions := DefaultTransportOptions()
+	transportOptions.H2C = true
+	up, err := NewWithOptions(nil, TLSOptions{}, transportOptions, u.Scheme, u.Host, 1, 1)
+	if err != nil {
+		t.Fatal("Error creating uploader. Err: ", err)
+	}
+
+	// Concurrent chunked uploads
+	channels := []chan []byte{}
+	resultChannels := []<-chan error{}
+	for n := 0; n < 3; n++ {
+		channel, resultChannel := up.UploadChunkedTransfer("test/fileChunked"+strconv.Itoa(n)+".ts", map[string]string{})
+		channels = append(channels, channel)
+		resultChannels = append(resultChannels, resultChannel)
+	}
+	for _, channel := range channels {
+		channel <- []byte("ABCDE")
+	}
+	for n, channel := range channels {
+		close(channel)
+		if errUpload := <-resultChannels[n]; errUpload != nil {
+			t.Error("Error uploading chunked data. Err ", errUpload)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if numConnections != 1 {
+		t.Errorf("Uploads are not multiplexed, got: %d connections, want: %d.", numConnections, 1)
+	}
 }
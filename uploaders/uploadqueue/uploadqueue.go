@@ -0,0 +1,306 @@
+package uploadqueue
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OverflowPolicies indicates what to do when a job is added to a full queue
+type OverflowPolicies int
+
+const (
+	// OverflowBlock Blocks the caller until there is space in the queue (back-pressure)
+	OverflowBlock OverflowPolicies = iota
+
+	// OverflowDropNewest Rejects the new job
+	OverflowDropNewest
+
+	// OverflowDropOldest Drops the oldest job waiting in the queue to make space for the new one
+	// A job is never dropped if a queued WaitPrevious job depends on it, but a WaitPrevious job can be
+	// dropped if a newer one with the same name is queued (ex: an outdated chunklist)
+	OverflowDropOldest
+)
+
+var (
+	// ErrQueueFull Returned when a job is rejected because the queue is full
+	ErrQueueFull = errors.New("Upload queue full")
+
+	// ErrJobDropped Reported to the dropped jobs to make space for newer ones
+	ErrJobDropped = errors.New("Upload job dropped because the queue is full")
+
+	// ErrQueueClosed Returned when a job is added to a closed queue
+	ErrQueueClosed = errors.New("Upload queue closed")
+)
+
+// Job Upload job
+type Job struct {
+	// Name Used for logging
+	Name string
+
+	// Upload Does the upload
+	Upload func() error
+
+	// WaitPrevious The job only starts when all the jobs added before it are finished (ex: a manifest that references the previous chunks)
+	WaitPrevious bool
+
+	// OnDone Called (from the worker goroutine) with the final result of the job
+	OnDone func(err error)
+
+	// Discard Called when the job is rejected or dropped without running (ex: to delete its temp files)
+	Discard func()
+
+	seq uint64
+}
+
+// Stats Queue metrics
+type Stats struct {
+	Queued      int
+	InProgress  int
+	MaxQueued   int
+	Completed   uint64
+	Failed      uint64
+	Dropped     uint64
+	MaxSize     int
+	WorkersSize int
+}
+
+// Queue Bounded upload queue processed by a pool of workers
+type Queue struct {
+	log            *logrus.Logger
+	maxSize        int
+	overflowPolicy OverflowPolicies
+	numWorkers     int
+
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	jobs       []*Job
+	inProgress map[uint64]bool
+	nextSeq    uint64
+	isClosed   bool
+	stats      Stats
+
+	workersWg sync.WaitGroup
+}
+
+// New Creates a queue and starts its workers
+func New(log *logrus.Logger, numWorkers int, maxSize int, overflowPolicy OverflowPolicies) *Queue {
+	if log == nil {
+		log = logrus.New()
+		log.SetLevel(logrus.DebugLevel)
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	if maxSize < 1 {
+		maxSize = 1
+	}
+
+	q := &Queue{
+		log:            log,
+		maxSize:        maxSize,
+		overflowPolicy: overflowPolicy,
+		numWorkers:     numWorkers,
+		jobs:           make([]*Job, 0, maxSize),
+		inProgress:     make(map[uint64]bool),
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	q.stats.MaxSize = maxSize
+	q.stats.WorkersSize = numWorkers
+
+	q.workersWg.Add(numWorkers)
+	for n := 0; n < numWorkers; n++ {
+		go q.worker()
+	}
+
+	return q
+}
+
+// Add Adds a job to the queue, if the job is rejected its OnDone is also called with the error
+func (q *Queue) Add(job Job) error {
+	var dropped *Job = nil
+
+	q.mutex.Lock()
+	for !q.isClosed && len(q.jobs) >= q.maxSize && q.overflowPolicy == OverflowBlock {
+		q.cond.Wait()
+	}
+
+	if q.isClosed {
+		q.mutex.Unlock()
+		return q.reject(&job, ErrQueueClosed)
+	}
+
+	if len(q.jobs) >= q.maxSize {
+		if q.overflowPolicy == OverflowDropNewest {
+			q.stats.Dropped++
+			q.mutex.Unlock()
+			return q.reject(&job, ErrQueueFull)
+		}
+
+		i := q.oldestDroppableIndex(&job)
+		q.stats.Dropped++
+		if i < 0 {
+			// All queued jobs are needed
+			q.mutex.Unlock()
+			return q.reject(&job, ErrQueueFull)
+		}
+		dropped = q.jobs[i]
+		q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+	}
+
+	job.seq = q.nextSeq
+	q.nextSeq++
+	q.jobs = append(q.jobs, &job)
+	if len(q.jobs) > q.stats.MaxQueued {
+		q.stats.MaxQueued = len(q.jobs)
+	}
+	q.cond.Broadcast()
+	q.mutex.Unlock()
+
+	if dropped != nil {
+		q.reject(dropped, ErrJobDropped)
+	}
+
+	return nil
+}
+
+func (q *Queue) reject(job *Job, err error) error {
+	q.log.Error("Upload job ", job.Name, " rejected. Err: ", err)
+	if job.Discard != nil {
+		job.Discard()
+	}
+	if job.OnDone != nil {
+		job.OnDone(err)
+	}
+
+	return err
+}
+
+// oldestDroppableIndex Returns the index of the oldest queued job that can be dropped to add newJob (or -1)
+func (q *Queue) oldestDroppableIndex(newJob *Job) int {
+	jobs := append(q.jobs[:len(q.jobs):len(q.jobs)], newJob)
+	for i, job := range q.jobs {
+		if isDroppable(job, jobs[i+1:]) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// isDroppable Indicates if job can be dropped without breaking the jobs queued after it
+func isDroppable(job *Job, nextJobs []*Job) bool {
+	for _, next := range nextJobs {
+		if job.WaitPrevious {
+			if next.WaitPrevious && next.Name == job.Name {
+				// Replaced by a newer version
+				return true
+			}
+		} else if next.WaitPrevious {
+			// It depends on job
+			return false
+		}
+	}
+
+	return !job.WaitPrevious
+}
+
+// Flush Blocks until all the jobs added are finished
+func (q *Queue) Flush() {
+	q.mutex.Lock()
+	for len(q.jobs) > 0 || len(q.inProgress) > 0 {
+		q.cond.Wait()
+	}
+	q.mutex.Unlock()
+}
+
+// Close Waits for all the pending jobs and stops the workers
+func (q *Queue) Close() {
+	q.mutex.Lock()
+	q.isClosed = true
+	q.cond.Broadcast()
+	q.mutex.Unlock()
+
+	q.workersWg.Wait()
+}
+
+// GetStats Returns the current queue metrics
+func (q *Queue) GetStats() Stats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := q.stats
+	stats.Queued = len(q.jobs)
+	stats.InProgress = len(q.inProgress)
+
+	return stats
+}
+
+// nextRunnableIndex Returns the index of the 1st job that can be started (or -1)
+func (q *Queue) nextRunnableIndex() int {
+	for i, job := range q.jobs {
+		if !job.WaitPrevious {
+			return i
+		}
+
+		// All previous jobs are finished if there are no previous in the queue nor in progress
+		if i == 0 && !q.isAnyInProgressBefore(job.seq) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (q *Queue) isAnyInProgressBefore(seq uint64) bool {
+	for inProgressSeq := range q.inProgress {
+		if inProgressSeq < seq {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (q *Queue) worker() {
+	defer q.workersWg.Done()
+
+	q.mutex.Lock()
+	for {
+		i := q.nextRunnableIndex()
+		if i < 0 {
+			if q.isClosed && len(q.jobs) == 0 {
+				q.mutex.Unlock()
+				return
+			}
+			q.cond.Wait()
+			continue
+		}
+
+		job := q.jobs[i]
+		q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+		q.inProgress[job.seq] = true
+
+		// Space available for blocked producers
+		q.cond.Broadcast()
+		q.mutex.Unlock()
+
+		err := job.Upload()
+		if err != nil {
+			q.log.Error("Upload job ", job.Name, " failed. Err: ", err)
+		}
+		if job.OnDone != nil {
+			job.OnDone(err)
+		}
+
+		q.mutex.Lock()
+		delete(q.inProgress, job.seq)
+		if err != nil {
+			q.stats.Failed++
+		} else {
+			q.stats.Completed++
+		}
+		q.cond.Broadcast()
+	}
+}
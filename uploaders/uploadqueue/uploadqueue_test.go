@@ -0,0 +1,180 @@
+package uploadqueue
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueWaitPrevious(t *testing.T) {
+	q := New(nil, 4, 10, OverflowBlock)
+
+	var mutex sync.Mutex
+	finished := []string{}
+	addFinished := func(name string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		finished = append(finished, name)
+	}
+
+	// Slow chunks followed by a manifest that must wait for them
+	for _, name := range []string{"chunk1", "chunk2"} {
+		jobName := name
+		q.Add(Job{Name: jobName, Upload: func() error {
+			time.Sleep(50 * time.Millisecond)
+			addFinished(jobName)
+			return nil
+		}})
+	}
+	q.Add(Job{Name: "manifest", WaitPrevious: true, Upload: func() error {
+		addFinished("manifest")
+		return nil
+	}})
+	q.Close()
+
+	if len(finished) != 3 || finished[2] != "manifest" {
+		t.Errorf("Wrong jobs order, got: %v, want manifest at the end", finished)
+	}
+
+	stats := q.GetStats()
+	if stats.Completed != 3 || stats.Failed != 0 || stats.Queued != 0 || stats.InProgress != 0 {
+		t.Errorf("Wrong stats, got: %+v", stats)
+	}
+}
+
+func TestQueueOverflowDropNewest(t *testing.T) {
+	q := New(nil, 1, 1, OverflowDropNewest)
+
+	blockWorker := make(chan bool)
+	started := make(chan bool)
+	q.Add(Job{Name: "blocking", Upload: func() error {
+		started <- true
+		<-blockWorker
+		return nil
+	}})
+	<-started
+
+	// Fills the queue
+	if err := q.Add(Job{Name: "queued", Upload: func() error { return nil }}); err != nil {
+		t.Error("Error adding job. Err: ", err)
+	}
+
+	var droppedErr error
+	err := q.Add(Job{Name: "rejected", Upload: func() error { return nil }, OnDone: func(err error) { droppedErr = err }})
+	if err != ErrQueueFull || droppedErr != ErrQueueFull {
+		t.Errorf("Expected queue full error, got: %v (OnDone: %v)", err, droppedErr)
+	}
+
+	close(blockWorker)
+	q.Close()
+
+	stats := q.GetStats()
+	if stats.Completed != 2 || stats.Dropped != 1 {
+		t.Errorf("Wrong stats, got: %+v", stats)
+	}
+}
+
+func TestQueueOverflowDropOldest(t *testing.T) {
+	q := New(nil, 1, 1, OverflowDropOldest)
+
+	blockWorker := make(chan bool)
+	started := make(chan bool)
+	q.Add(Job{Name: "blocking", Upload: func() error {
+		started <- true
+		<-blockWorker
+		return nil
+	}})
+	<-started
+
+	var droppedErr error
+	q.Add(Job{Name: "oldest", Upload: func() error { return nil }, OnDone: func(err error) { droppedErr = err }})
+
+	newestDone := false
+	if err := q.Add(Job{Name: "newest", Upload: func() error { return nil }, OnDone: func(err error) { newestDone = err == nil }}); err != nil {
+		t.Error("Error adding job. Err: ", err)
+	}
+
+	close(blockWorker)
+	q.Close()
+
+	if droppedErr != ErrJobDropped {
+		t.Errorf("Expected oldest job dropped, got: %v", droppedErr)
+	}
+	if !newestDone {
+		t.Error("Newest job not uploaded")
+	}
+}
+
+func TestQueueOverflowDropOldestDependencies(t *testing.T) {
+	q := New(nil, 1, 3, OverflowDropOldest)
+
+	blockWorker := make(chan bool)
+	started := make(chan bool)
+	q.Add(Job{Name: "blocking", Upload: func() error {
+		started <- true
+		<-blockWorker
+		return nil
+	}})
+	<-started
+
+	var mutex sync.Mutex
+	done := map[string]error{}
+	discarded := map[string]bool{}
+	addJob := func(name string, waitPrevious bool) error {
+		return q.Add(Job{Name: name, WaitPrevious: waitPrevious, Upload: func() error { return nil },
+			OnDone: func(err error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				done[name] = err
+			},
+			Discard: func() { discarded[name] = true }})
+	}
+
+	addJob("chunk1", false)
+	addJob("manifest", true)
+	addJob("chunk2", false)
+
+	// chunk1 is needed by the manifest, chunk2 is dropped
+	if err := addJob("chunk3", false); err != nil {
+		t.Error("Error adding job. Err: ", err)
+	}
+	// The queued manifest is outdated
+	if err := addJob("manifest", true); err != nil {
+		t.Error("Error adding job. Err: ", err)
+	}
+	// All the queued jobs are needed by the last manifest
+	if err := addJob("chunk4", false); err != ErrQueueFull {
+		t.Errorf("Expected queue full error, got: %v", err)
+	}
+
+	close(blockWorker)
+	q.Close()
+
+	if done["chunk1"] != nil || done["chunk3"] != nil || done["manifest"] != nil {
+		t.Errorf("Wrong uploaded jobs, got: %v", done)
+	}
+	if done["chunk2"] != ErrJobDropped || done["chunk4"] != ErrQueueFull {
+		t.Errorf("Wrong dropped jobs, got: %v", done)
+	}
+	if len(discarded) != 3 || !discarded["chunk2"] || !discarded["manifest"] || !discarded["chunk4"] {
+		t.Errorf("Wrong discarded jobs, got: %v", discarded)
+	}
+
+	stats := q.GetStats()
+	if stats.Completed != 4 || stats.Dropped != 3 {
+		t.Errorf("Wrong stats, got: %+v", stats)
+	}
+}
+
+func TestQueueAddAfterClose(t *testing.T) {
+	q := New(nil, 1, 1, OverflowBlock)
+	q.Close()
+
+	discarded := false
+	if err := q.Add(Job{Name: "late", Upload: func() error { return nil }, Discard: func() { discarded = true }}); err != ErrQueueClosed {
+		t.Errorf("Expected queue closed error, got: %v", err)
+	}
+	if !discarded {
+		t.Error("Rejected job not discarded")
+	}
+}